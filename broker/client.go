@@ -1,6 +0,0 @@
-package main
-
-type ClientID string
-type Client struct {
-	ID ClientID
-}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shibayu36/go-mqtt-playground/server"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the configuration of the broker command. It is read from the
+// YAML file given by -config, then overridden by the environment variables
+// and finally by the command-line flags.
+type config struct {
+	// Listeners are the TCP addresses to listen on
+	Listeners []string `yaml:"listeners"`
+
+	MaxConnections    int `yaml:"max_connections"`
+	MaxPacketSize     int `yaml:"max_packet_size"`
+	MaxInflight       int `yaml:"max_inflight"`
+	MaxQueuedMessages int `yaml:"max_queued_messages"`
+	MaxOutboundQueue  int `yaml:"max_outbound_queue"`
+	MaxTopicDepth     int `yaml:"max_topic_depth"`
+
+	SlowConsumerPolicy         server.SlowConsumerPolicy         `yaml:"slow_consumer_policy"`
+	SharedSubscriptionStrategy server.SharedSubscriptionStrategy `yaml:"shared_subscription_strategy"`
+
+	// Users maps the user names to the passwords of the clients allowed to
+	// connect, in addition to the users in PasswordFile. With neither of
+	// them, any client can connect.
+	Users map[string]string `yaml:"users,omitempty"`
+	// PasswordFile is the path to the password file made by mqttpasswd
+	PasswordFile string `yaml:"password_file"`
+	// ACLFile is the path to the ACL file granting the clients the topics
+	// to publish and subscribe to. Without it, every topic is allowed.
+	ACLFile string `yaml:"acl_file"`
+
+	LogLevel server.LogLevel `yaml:"log_level"`
+}
+
+// envPrefix is the prefix of the environment variables overriding the config.
+// The rest of the name is the flag name in upper case with "_" instead of "-",
+// e.g. MQTT_BROKER_MAX_PACKET_SIZE for -max-packet-size.
+const envPrefix = "MQTT_BROKER_"
+
+// defaultConfig returns the config used when nothing is specified.
+func defaultConfig() config {
+	options := server.DefaultOptions()
+	return config{
+		Listeners:                  []string{options.Addr},
+		MaxConnections:             options.MaxConnections,
+		MaxPacketSize:              options.MaxPacketSize,
+		MaxInflight:                options.MaxInflight,
+		MaxQueuedMessages:          options.MaxQueuedMessages,
+		MaxOutboundQueue:           options.MaxOutboundQueue,
+		MaxTopicDepth:              options.MaxTopicDepth,
+		SlowConsumerPolicy:         options.SlowConsumerPolicy,
+		SharedSubscriptionStrategy: options.SharedSubscriptionStrategy,
+		LogLevel:                   options.LogLevel,
+	}
+}
+
+// commandLine holds the command-line arguments which are not a part of the
+// config.
+type commandLine struct {
+	configPath  string
+	printConfig bool
+}
+
+// loadConfig builds the config from the command-line arguments and the
+// environment, and the server configured by it. getenv is os.Getenv except in
+// tests.
+func loadConfig(args []string, getenv func(string) string) (config, *server.Server, commandLine, error) {
+	// The flags are parsed first to find the config file, and applied after
+	// the file and the environment variables because they take precedence
+	var cl commandLine
+	flags := flag.NewFlagSet("broker", flag.ContinueOnError)
+	flags.StringVar(&cl.configPath, "config", "", "path to the YAML config file (env "+envPrefix+"CONFIG)")
+	flags.BoolVar(&cl.printConfig, "print-config", false, "print the effective config and exit")
+	parsed := defaultConfig()
+	parsed.addFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return config{}, nil, cl, err
+	}
+	if flags.NArg() > 0 {
+		return config{}, nil, cl, fmt.Errorf("unexpected arguments: %v", flags.Args())
+	}
+
+	if cl.configPath == "" {
+		cl.configPath = getenv(envPrefix + "CONFIG")
+	}
+	c := defaultConfig()
+	if cl.configPath != "" {
+		if err := c.readFile(cl.configPath); err != nil {
+			return config{}, nil, cl, err
+		}
+	}
+
+	overrides := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	c.addFlags(overrides)
+	var err error
+	overrides.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value := getenv(name)
+		if value == "" || err != nil {
+			return
+		}
+		if setErr := overrides.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, name, setErr)
+		}
+	})
+	if err != nil {
+		return config{}, nil, cl, err
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if overrides.Lookup(f.Name) != nil {
+			// The values have already been validated by Parse
+			overrides.Set(f.Name, f.Value.String())
+		}
+	})
+
+	s, err := c.validate()
+	if err != nil {
+		return config{}, nil, cl, err
+	}
+	return c, s, cl, nil
+}
+
+// addFlags defines the flags which set the fields of c.
+func (c *config) addFlags(flags *flag.FlagSet) {
+	flags.Var((*stringList)(&c.Listeners), "listen", "comma-separated TCP addresses to listen on")
+	flags.IntVar(&c.MaxConnections, "max-connections", c.MaxConnections, "maximum number of connected clients, 0 for no limit")
+	flags.IntVar(&c.MaxPacketSize, "max-packet-size", c.MaxPacketSize, "maximum size in bytes of packets")
+	flags.IntVar(&c.MaxInflight, "max-inflight", c.MaxInflight, "maximum number of unacknowledged messages per client, 0 for no limit")
+	flags.IntVar(&c.MaxQueuedMessages, "max-queued-messages", c.MaxQueuedMessages, "maximum number of messages queued per client, -1 for no limit")
+	flags.IntVar(&c.MaxOutboundQueue, "max-outbound-queue", c.MaxOutboundQueue, "maximum number of messages waiting to be written per client, -1 for no limit")
+	flags.IntVar(&c.MaxTopicDepth, "max-topic-depth", c.MaxTopicDepth, "maximum number of topic levels, 0 for no limit")
+	flags.StringVar((*string)(&c.SlowConsumerPolicy), "slow-consumer-policy", string(c.SlowConsumerPolicy), "drop-oldest, drop-newest or disconnect")
+	flags.StringVar((*string)(&c.SharedSubscriptionStrategy), "shared-subscription-strategy", string(c.SharedSubscriptionStrategy), "round-robin, random, least-inflight or sticky")
+	flags.Var((*userMap)(&c.Users), "users", "comma-separated username:password pairs of the clients allowed to connect, better given by the environment variable")
+	flags.StringVar(&c.PasswordFile, "password-file", c.PasswordFile, "path to the password file made by mqttpasswd")
+	flags.StringVar(&c.ACLFile, "acl-file", c.ACLFile, "path to the ACL file granting the clients the topics")
+	flags.StringVar((*string)(&c.LogLevel), "log-level", string(c.LogLevel), "debug, info or error")
+}
+
+// readFile overrides c by the YAML config file. Unknown keys are reported as
+// errors so that typos do not go unnoticed.
+func (c *config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	// An empty file leaves the config as it is
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// validate reports all the problems of the config at once. It returns the
+// server built from the config, so that the password file is read only once.
+func (c config) validate() (*server.Server, error) {
+	var errs []error
+	if len(c.Listeners) == 0 {
+		errs = append(errs, errors.New("listeners: at least one address is required"))
+	}
+	for _, listener := range c.Listeners {
+		if _, port, err := net.SplitHostPort(listener); err != nil {
+			errs = append(errs, fmt.Errorf("listeners: invalid address %q: %w", listener, err))
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			errs = append(errs, fmt.Errorf("listeners: invalid port in %q", listener))
+		}
+	}
+	for username := range c.Users {
+		if username == "" {
+			errs = append(errs, errors.New("users: empty user name"))
+		}
+	}
+	// The rest is validated by the server
+	options, err := c.serverOptions()
+	var s *server.Server
+	if err == nil {
+		s, err = server.New(options)
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return s, nil
+}
+
+// serverOptions returns the options of the server, reading the password file
+// and the ACL file. The listeners are not included because the command listens
+// on them by itself.
+func (c config) serverOptions() (server.Options, error) {
+	authenticator, err := c.authenticator()
+	if err != nil {
+		return server.Options{}, err
+	}
+	var hooks []server.Hook
+	if c.ACLFile != "" {
+		aclFile, err := server.LoadACLFile(c.ACLFile)
+		if err != nil {
+			return server.Options{}, fmt.Errorf("acl_file: %w", err)
+		}
+		hooks = append(hooks, aclFile)
+	}
+	return server.Options{
+		Authenticator:              authenticator,
+		Hooks:                      hooks,
+		MaxConnections:             c.MaxConnections,
+		MaxPacketSize:              c.MaxPacketSize,
+		MaxInflight:                c.MaxInflight,
+		MaxQueuedMessages:          c.MaxQueuedMessages,
+		MaxOutboundQueue:           c.MaxOutboundQueue,
+		MaxTopicDepth:              c.MaxTopicDepth,
+		SlowConsumerPolicy:         c.SlowConsumerPolicy,
+		SharedSubscriptionStrategy: c.SharedSubscriptionStrategy,
+		LogLevel:                   c.LogLevel,
+	}, nil
+}
+
+// authenticator returns the authenticator of the users in the config and the
+// password file, or nil if there are no users.
+func (c config) authenticator() (server.Authenticator, error) {
+	var authenticators server.Authenticators
+	if len(c.Users) > 0 {
+		authenticators = append(authenticators, server.StaticUsers(c.Users))
+	}
+	if c.PasswordFile != "" {
+		passwordFile, err := server.LoadPasswordFile(c.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("password_file: %w", err)
+		}
+		authenticators = append(authenticators, passwordFile)
+	}
+	if len(authenticators) == 0 {
+		return nil, nil
+	}
+	return authenticators, nil
+}
+
+// redacted returns the config whose passwords are hidden, to be printed.
+func (c config) redacted() config {
+	if len(c.Users) == 0 {
+		return c
+	}
+	users := make(map[string]string, len(c.Users))
+	for username := range c.Users {
+		users[username] = "<redacted>"
+	}
+	c.Users = users
+	return c
+}
+
+// stringList is a flag.Value of comma-separated strings.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = strings.Split(value, ",")
+	return nil
+}
+
+// userMap is a flag.Value of comma-separated "username:password" pairs, which
+// replace the users in the config file.
+type userMap map[string]string
+
+func (m *userMap) String() string {
+	if m == nil {
+		return ""
+	}
+	usernames := make([]string, 0, len(*m))
+	for username := range *m {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	pairs := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		pairs = append(pairs, username+":"+(*m)[username])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *userMap) Set(value string) error {
+	users := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		username, password, ok := strings.Cut(pair, ":")
+		if !ok {
+			return errors.New("expected username:password pairs")
+		}
+		users[username] = password
+	}
+	*m = users
+	return nil
+}
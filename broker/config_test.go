@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shibayu36/go-mqtt-playground/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	writeFile := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "broker.yaml")
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	t.Run("defaults to the server options", func(t *testing.T) {
+		c, s, cl, err := loadConfig(nil, noEnv)
+		assert.NoError(t, err)
+		assert.NotNil(t, s)
+		assert.Equal(t, defaultConfig(), c)
+		assert.Equal(t, []string{":1883"}, c.Listeners)
+		assert.Equal(t, commandLine{}, cl)
+	})
+
+	t.Run("flags override environment variables which override the file", func(t *testing.T) {
+		path := writeFile(t, `
+listeners: [":1883", "127.0.0.1:1884"]
+max_packet_size: 2048
+max_inflight: 10
+slow_consumer_policy: drop-oldest
+log_level: error
+`)
+		env := map[string]string{
+			"MQTT_BROKER_MAX_PACKET_SIZE": "4096",
+			"MQTT_BROKER_MAX_INFLIGHT":    "20",
+			"MQTT_BROKER_LOG_LEVEL":       "debug",
+		}
+		c, _, cl, err := loadConfig(
+			[]string{"-config", path, "-max-inflight", "30", "-print-config"},
+			func(name string) string { return env[name] },
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, commandLine{configPath: path, printConfig: true}, cl)
+
+		expected := defaultConfig()
+		expected.Listeners = []string{":1883", "127.0.0.1:1884"}
+		expected.MaxPacketSize = 4096
+		expected.MaxInflight = 30
+		expected.SlowConsumerPolicy = server.SlowConsumerDropOldest
+		expected.LogLevel = server.LogLevelDebug
+		assert.Equal(t, expected, c)
+	})
+
+	t.Run("reads the file given by the environment variable", func(t *testing.T) {
+		path := writeFile(t, "max_connections: 5\n")
+		c, _, _, err := loadConfig(nil, func(name string) string {
+			if name == "MQTT_BROKER_CONFIG" {
+				return path
+			}
+			return ""
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 5, c.MaxConnections)
+	})
+
+	t.Run("splits comma-separated listeners", func(t *testing.T) {
+		c, _, _, err := loadConfig([]string{"-listen", ":1883,:1884"}, noEnv)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{":1883", ":1884"}, c.Listeners)
+	})
+
+	t.Run("authenticates the users in the file", func(t *testing.T) {
+		path := writeFile(t, "users:\n  alice: secret\n")
+		c, _, _, err := loadConfig([]string{"-config", path}, noEnv)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"alice": "<redacted>"}, c.redacted().Users)
+		assert.Equal(t, map[string]string{"alice": "secret"}, c.Users)
+
+		options, err := c.serverOptions()
+		assert.NoError(t, err)
+		assert.NoError(t, options.Authenticator.Authenticate("client1", "alice", []byte("secret")))
+		assert.ErrorIs(t, options.Authenticator.Authenticate("client1", "alice", []byte("wrong")), server.ErrBadUsernameOrPassword)
+	})
+
+	t.Run("reads the users from the environment variable", func(t *testing.T) {
+		path := writeFile(t, "users:\n  alice: secret\n")
+		c, _, _, err := loadConfig([]string{"-config", path}, func(name string) string {
+			if name == "MQTT_BROKER_USERS" {
+				return "bob:secret,carol:pass:word"
+			}
+			return ""
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"bob": "secret", "carol": "pass:word"}, c.Users)
+	})
+
+	t.Run("authorizes the topics by the ACL file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "acl")
+		assert.NoError(t, os.WriteFile(path, []byte("topic read a/#\n"), 0o600))
+		c, _, _, err := loadConfig([]string{"-acl-file", path}, noEnv)
+		assert.NoError(t, err)
+		assert.Equal(t, path, c.ACLFile)
+
+		options, err := c.serverOptions()
+		assert.NoError(t, err)
+		assert.Len(t, options.Hooks, 1)
+		client := &server.Client{ID: "client1"}
+		assert.True(t, options.Hooks[0].OnACLCheck(client, "a/b", false))
+		assert.False(t, options.Hooks[0].OnACLCheck(client, "a/b", true))
+	})
+
+	t.Run("reports invalid configs", func(t *testing.T) {
+		tests := []struct {
+			name string
+			args []string
+			env  map[string]string
+			file string
+		}{
+			{name: "unknown key in the file", file: "max_conections: 5\n"},
+			{name: "wrong type in the file", file: "max_connections: many\n"},
+			{name: "invalid environment variable", env: map[string]string{"MQTT_BROKER_MAX_CONNECTIONS": "many"}},
+			{name: "unknown flag", args: []string{"-max-conections", "5"}},
+			{name: "no listeners", file: "listeners: []\n"},
+			{name: "listener without port", args: []string{"-listen", "localhost"}},
+			{name: "negative limit", args: []string{"-max-inflight", "-1"}},
+			{name: "limit below -1", args: []string{"-max-queued-messages", "-2"}},
+			{name: "unknown policy", args: []string{"-slow-consumer-policy", "block"}},
+			{name: "unknown log level", args: []string{"-log-level", "verbose"}},
+			{name: "missing password file", args: []string{"-password-file", filepath.Join(t.TempDir(), "missing")}},
+			{name: "missing ACL file", args: []string{"-acl-file", filepath.Join(t.TempDir(), "missing")}},
+			{name: "user without password", env: map[string]string{"MQTT_BROKER_USERS": "alice"}},
+			{name: "missing file", args: []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				args := tt.args
+				if tt.file != "" {
+					args = append([]string{"-config", writeFile(t, tt.file)}, args...)
+				}
+				_, _, _, err := loadConfig(args, func(name string) string { return tt.env[name] })
+				assert.Error(t, err)
+			})
+		}
+	})
+}
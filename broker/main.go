@@ -1,83 +1,83 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/shibayu36/go-mqtt-playground/server"
+	"gopkg.in/yaml.v3"
 )
 
+// shutdownTimeout is how long to wait for the connections to be closed on
+// SIGINT or SIGTERM.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	listener, err := net.Listen("tcp", ":1883")
+	c, s, cl, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Invalid config: %v", err)
 	}
-	defer listener.Close()
 
-	log.Println("Listening on port 1883")
-
-	handler := NewHandler()
-
-	for {
-		conn, err := listener.Accept()
+	if cl.printConfig {
+		out, err := yaml.Marshal(c.redacted())
 		if err != nil {
-			log.Println("Error accepting connection: ", err)
-			continue
+			log.Fatal(err)
 		}
-
-		log.Println("New connection accepted")
-		go handleConn(conn, handler)
+		fmt.Print(string(out))
+		return
 	}
-}
-
-func handleConn(conn net.Conn, handler *Handler) {
-	defer conn.Close()
-
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-
-	handler.Handle(reader, writer)
-}
 
-// MQTTのFixed HeaderのRemaining Lengthを読み込む
-func readRemainingLength(reader *bufio.Reader) (int, error) {
-	var value int
-	var multiplier int = 1
-
-	for {
-		digit, err := reader.ReadByte()
+	// All the addresses are listened on before serving, so that a wrong one
+	// stops the broker at startup
+	listeners := make([]net.Listener, 0, len(c.Listeners))
+	for _, addr := range c.Listeners {
+		listener, err := net.Listen("tcp", addr)
 		if err != nil {
-			return 0, err
-		}
-
-		// 最下位7bitをvalueとして使い、最上位1bitを継続判定として利用している
-		value += int(digit&127) * multiplier
-		multiplier *= 128
-
-		if digit&128 == 0 {
-			break
+			log.Fatal(err)
 		}
+		log.Printf("Listening on %s\n", listener.Addr())
+		listeners = append(listeners, listener)
 	}
 
-	return value, nil
-}
-
-func encodeRemainingLength(length int) []byte {
-	encoded := make([]byte, 0)
-
-	for {
-		digit := length % 128
-		length = length / 128
-
-		if length > 0 {
-			digit = digit | 0x80
+	// Shutdown keeps running after Serve returns, so main waits for it to
+	// finish
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Println("Error shutting down: ", err)
 		}
+	}()
 
-		encoded = append(encoded, byte(digit))
-
-		if length == 0 {
-			break
+	served := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			served <- s.Serve(listener)
+		}(listener)
+	}
+	for range listeners {
+		if err := <-served; !errors.Is(err, server.ErrServerClosed) {
+			log.Fatal(err)
 		}
 	}
-
-	return encoded
+	<-shutdown
 }
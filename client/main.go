@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"net"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
 )
 
 func main() {
@@ -16,49 +18,27 @@ func main() {
 	defer conn.Close()
 
 	// Send CONNECT packet
-	connectPacket := []byte{
-		0x10,       // CONNECT packet type
-		13,         // Remaining Length
-		0x00, 0x04, // Length of protocol name
-		'M', 'Q', 'T', 'T', // Protocol name
-		0x05,       // Protocol level (MQTT 5.0)
-		0x02,       // Connect flags (Clean Start)
-		0x00, 0x3C, // Keep Alive (60 seconds)
-		0x00, // Properties (none)
-		0x00, // Client ID (empty)
-	}
-	_, err = conn.Write(connectPacket)
+	connectPacket := &packets.Connect{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: packets.Version5, // Protocol level (MQTT 5.0)
+		CleanSession:  true,             // Connect flags (Clean Start)
+		KeepAlive:     60,               // Keep Alive (60 seconds)
+		ClientID:      "",               // Client ID (empty)
+	}
+	err = connectPacket.Encode(conn, packets.Version5)
 	if err != nil {
 		log.Fatal("Error sending CONNECT:", err)
 	}
 
 	// Read CONNACK packet
 	reader := bufio.NewReader(conn)
-	header, err := reader.ReadByte()
-	if err != nil {
-		log.Fatal("Error reading CONNACK header:", err)
-	}
-
-	// Check if it's a CONNACK packet (0x20)
-	if header>>4 != 2 {
-		log.Fatal("Received non-CONNACK packet")
-	}
-
-	_, err = reader.ReadByte() // Read Remaining Length (assuming it's small enough to be in one byte)
-	if err != nil {
-		log.Fatal("Error reading Remaining Length:", err)
-	}
-
-	// Read the rest of the CONNACK packet
-	connAckFlags, err := reader.ReadByte()
-	if err != nil {
-		log.Fatal("Error reading CONNACK flags:", err)
-	}
-	returnCode, err := reader.ReadByte()
+	connack := &packets.Connack{}
+	err = connack.Decode(reader, packets.Version5)
 	if err != nil {
-		log.Fatal("Error reading CONNACK return code:", err)
+		log.Fatal("Error reading CONNACK:", err)
 	}
 
 	// Output the result
-	fmt.Printf("CONNACK Flags: 0x%X, Return Code: 0x%X\n", connAckFlags, returnCode)
+	fmt.Printf("CONNACK Session Present: %v, Reason Code: 0x%X\n", connack.SessionPresent, connack.ReturnCode)
+	fmt.Printf("Assigned Client Identifier: %s\n", connack.Properties.AssignedClientIdentifier)
 }
@@ -0,0 +1,128 @@
+// Command mqttpasswd manages the password file of the broker.
+//
+//	mqttpasswd [-c] passwordfile username             reads the password from stdin
+//	mqttpasswd [-c] -b passwordfile username password
+//	mqttpasswd -D passwordfile username
+//
+// The password typed on a terminal is not echoed and is asked twice.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/shibayu36/go-mqtt-playground/server"
+	"golang.org/x/term"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "mqttpasswd:", err)
+		}
+		os.Exit(2)
+	}
+}
+
+func run(args []string, stdin io.Reader, stderr io.Writer) error {
+	flags := flag.NewFlagSet("mqttpasswd", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	create := flags.Bool("c", false, "create a new password file, overwriting the existing one")
+	batch := flags.Bool("b", false, "take the password from the command line")
+	del := flags.Bool("D", false, "delete the user")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: mqttpasswd [-c] [-b] passwordfile username [password]")
+		fmt.Fprintln(stderr, "       mqttpasswd -D passwordfile username")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	expectedArgs := 2
+	if *batch {
+		expectedArgs = 3
+	}
+	if flags.NArg() != expectedArgs || (*del && (*create || *batch)) {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	path, username := flags.Arg(0), flags.Arg(1)
+
+	passwordFile := server.NewPasswordFile()
+	if !*create {
+		loaded, err := server.LoadPasswordFile(path)
+		if err != nil {
+			return err
+		}
+		passwordFile = loaded
+	}
+
+	if *del {
+		if !passwordFile.Delete(username) {
+			return fmt.Errorf("user %q not found", username)
+		}
+		return passwordFile.Save(path)
+	}
+
+	password := flags.Arg(2)
+	if !*batch {
+		read, err := readPassword(stdin, stderr)
+		if err != nil {
+			return err
+		}
+		password = read
+	}
+	if password == "" {
+		return errors.New("empty password")
+	}
+	if err := passwordFile.SetPassword(username, []byte(password)); err != nil {
+		return err
+	}
+	return passwordFile.Save(path)
+}
+
+// readPassword reads the password from the first line of stdin. A password
+// typed on a terminal is read without echo and asked twice to catch typos.
+func readPassword(stdin io.Reader, stderr io.Writer) (string, error) {
+	if f, ok := stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		return readTerminalPassword(int(f.Fd()), stderr)
+	}
+
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", fmt.Errorf("reading password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func readTerminalPassword(fd int, stderr io.Writer) (string, error) {
+	read := func(prompt string) (string, error) {
+		fmt.Fprint(stderr, prompt)
+		password, err := term.ReadPassword(fd)
+		// The newline typed after the password is not echoed either
+		fmt.Fprintln(stderr)
+		if err != nil {
+			return "", fmt.Errorf("reading password: %w", err)
+		}
+		return string(password), nil
+	}
+
+	password, err := read("Password: ")
+	if err != nil {
+		return "", err
+	}
+	again, err := read("Reenter password: ")
+	if err != nil {
+		return "", err
+	}
+	if again != password {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
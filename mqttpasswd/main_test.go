@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shibayu36/go-mqtt-playground/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+	noInput := strings.NewReader("")
+
+	// The file must exist unless it is created
+	assert.Error(t, run([]string{"-b", path, "alice", "secret"}, noInput, io.Discard))
+
+	assert.NoError(t, run([]string{"-c", "-b", path, "alice", "secret"}, noInput, io.Discard))
+	assert.NoError(t, run([]string{path, "bob"}, strings.NewReader("hunter2\n"), io.Discard))
+
+	passwordFile, err := server.LoadPasswordFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, passwordFile.Authenticate("client1", "alice", []byte("secret")))
+	assert.NoError(t, passwordFile.Authenticate("client1", "bob", []byte("hunter2")))
+
+	assert.NoError(t, run([]string{"-D", path, "alice"}, noInput, io.Discard))
+	assert.Error(t, run([]string{"-D", path, "alice"}, noInput, io.Discard))
+	passwordFile, err = server.LoadPasswordFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bob"}, passwordFile.Usernames())
+
+	// Wrong usages
+	assert.Error(t, run([]string{path}, noInput, io.Discard))
+	assert.Error(t, run([]string{"-D", "-b", path, "bob", "secret"}, noInput, io.Discard))
+	assert.Error(t, run([]string{path, "carol"}, noInput, io.Discard), "Expected an empty password to be rejected")
+}
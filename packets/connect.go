@@ -0,0 +1,228 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// UnsupportedProtocolError is returned when CONNECT has a combination of the
+// protocol name and level which is not supported. The server responds to it
+// with CONNACK, so the error carries the protocol level to encode CONNACK in.
+type UnsupportedProtocolError struct {
+	ProtocolName  string
+	ProtocolLevel byte
+}
+
+func (e *UnsupportedProtocolError) Error() string {
+	return fmt.Sprintf("packets: unsupported protocol %q level %d", e.ProtocolName, e.ProtocolLevel)
+}
+
+// isSupportedProtocol reports whether the protocol name and level are MQTT
+// 3.1, 3.1.1 or 5.0.
+func isSupportedProtocol(name string, level byte) bool {
+	switch name {
+	case "MQIsdp":
+		return level == Version31
+	case "MQTT":
+		return level == Version311 || level == Version5
+	}
+	return false
+}
+
+// Connect is the CONNECT packet, sent by a client to request a connection.
+type Connect struct {
+	ProtocolName  string
+	ProtocolLevel byte
+
+	// Connect Flags
+	UsernameFlag bool
+	PasswordFlag bool
+	WillRetain   bool
+	WillQoS      byte
+	WillFlag     bool
+	// CleanSession is called Clean Start in MQTT 5.0.
+	CleanSession bool
+
+	KeepAlive uint16
+
+	// Properties is only present in MQTT 5.0.
+	Properties Properties
+
+	// Payload
+	ClientID string
+	// WillProperties is only present in MQTT 5.0.
+	WillProperties Properties
+	WillTopic      string
+	WillMessage    []byte
+	Username       string
+	Password       []byte
+}
+
+func (p *Connect) Type() byte { return CONNECT }
+
+// Encode writes CONNECT according to ProtocolLevel. version is ignored.
+func (p *Connect) Encode(w io.Writer, version byte) error {
+	if p.WillQoS > 2 {
+		return fmt.Errorf("%w: will QoS %d", ErrInvalidQoS, p.WillQoS)
+	}
+
+	var flags byte
+	if p.UsernameFlag {
+		flags |= 0x80
+	}
+	if p.PasswordFlag {
+		flags |= 0x40
+	}
+	if p.WillRetain {
+		flags |= 0x20
+	}
+	flags |= p.WillQoS << 3
+	if p.WillFlag {
+		flags |= 0x04
+	}
+	if p.CleanSession {
+		flags |= 0x02
+	}
+
+	e := &encoder{}
+	e.string(p.ProtocolName)
+	e.byte(p.ProtocolLevel)
+	e.byte(flags)
+	e.uint16(p.KeepAlive)
+	if p.ProtocolLevel >= Version5 {
+		e.properties(&p.Properties)
+	}
+
+	// Payload: the fields must appear in this order if they are present
+	e.string(p.ClientID)
+	if p.WillFlag {
+		if p.ProtocolLevel >= Version5 {
+			e.properties(&p.WillProperties)
+		}
+		e.string(p.WillTopic)
+		e.binary(p.WillMessage)
+	}
+	if p.UsernameFlag {
+		e.string(p.Username)
+	}
+	if p.PasswordFlag {
+		e.binary(p.Password)
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	return writePacket(w, CONNECT, 0, e.buf)
+}
+
+// Decode reads CONNECT according to the protocol level in the packet. version
+// is ignored.
+func (p *Connect) Decode(r io.Reader, version byte) error {
+	_, body, err := readBody(r, CONNECT)
+	if err != nil {
+		return err
+	}
+
+	d := newDecoder(CONNECT, body)
+	p.ProtocolName = d.string("protocol name")
+	p.ProtocolLevel = d.byte("protocol level")
+	// The rest of the packet can not be decoded in an unknown protocol
+	if d.err == nil && !isSupportedProtocol(p.ProtocolName, p.ProtocolLevel) {
+		return &UnsupportedProtocolError{ProtocolName: p.ProtocolName, ProtocolLevel: p.ProtocolLevel}
+	}
+	flags := d.byte("connect flags")
+	p.KeepAlive = d.uint16("keep alive")
+	if d.err == nil && flags&0x01 != 0 {
+		return fmt.Errorf("%w: CONNECT reserved flag is set", ErrMalformedPacket)
+	}
+	p.Properties = Properties{}
+	if p.ProtocolLevel >= Version5 {
+		p.Properties = d.properties(CONNECT)
+	}
+
+	p.UsernameFlag = flags&0x80 != 0
+	p.PasswordFlag = flags&0x40 != 0
+	p.WillRetain = flags&0x20 != 0
+	p.WillQoS = (flags >> 3) & 0x03
+	p.WillFlag = flags&0x04 != 0
+	p.CleanSession = flags&0x02 != 0
+
+	p.ClientID = d.string("client identifier")
+	p.WillProperties = Properties{}
+	if p.WillFlag {
+		if p.ProtocolLevel >= Version5 {
+			p.WillProperties = d.properties(willProperties)
+		}
+		p.WillTopic = d.string("will topic")
+		p.WillMessage = d.binary("will message")
+	}
+	if p.UsernameFlag {
+		p.Username = d.string("user name")
+	}
+	if p.PasswordFlag {
+		p.Password = d.binary("password")
+	}
+
+	return d.finish()
+}
+
+// CONNACK return codes of MQTT 3.1.1. MQTT 5.0 uses the Reason Codes instead.
+const (
+	ConnectAccepted                    byte = 0x00
+	ConnectUnacceptableProtocolVersion byte = 0x01
+	ConnectIdentifierRejected          byte = 0x02
+	ConnectServerUnavailable           byte = 0x03
+	ConnectBadUsernameOrPassword       byte = 0x04
+	ConnectNotAuthorized               byte = 0x05
+)
+
+// Connack is the CONNACK packet, sent by the server in response to CONNECT.
+type Connack struct {
+	// SessionPresent is not sent to an MQTT 3.1 client.
+	SessionPresent bool
+	// ReturnCode is the Connect Reason Code in MQTT 5.0.
+	ReturnCode byte
+	// Properties is only present in MQTT 5.0.
+	Properties Properties
+}
+
+func (p *Connack) Type() byte { return CONNACK }
+
+func (p *Connack) Encode(w io.Writer, version byte) error {
+	e := &encoder{}
+	// MQTT 3.1 has no Session Present flag and the byte is reserved
+	e.byte(boolToByte(p.SessionPresent && version >= Version311))
+	e.byte(p.ReturnCode)
+	if version >= Version5 {
+		e.properties(&p.Properties)
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	return writePacket(w, CONNACK, 0, e.buf)
+}
+
+func (p *Connack) Decode(r io.Reader, version byte) error {
+	_, body, err := readBody(r, CONNACK)
+	if err != nil {
+		return err
+	}
+
+	d := newDecoder(CONNACK, body)
+	flags := d.byte("connect acknowledge flags")
+	p.ReturnCode = d.byte("return code")
+	p.Properties = Properties{}
+	if version >= Version5 {
+		p.Properties = d.properties(CONNACK)
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	if flags&0xFE != 0 {
+		return fmt.Errorf("%w: CONNACK reserved flags 0x%02X", ErrMalformedPacket, flags)
+	}
+	p.SessionPresent = flags&0x01 != 0 && version >= Version311
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// Pingreq is the PINGREQ packet, sent by a client to keep the connection alive.
+type Pingreq struct{}
+
+func (p *Pingreq) Type() byte { return PINGREQ }
+
+func (p *Pingreq) Encode(w io.Writer, version byte) error {
+	return writePacket(w, PINGREQ, 0, nil)
+}
+
+func (p *Pingreq) Decode(r io.Reader, version byte) error {
+	return decodeEmpty(r, PINGREQ)
+}
+
+// Pingresp is the PINGRESP packet, the response to PINGREQ.
+type Pingresp struct{}
+
+func (p *Pingresp) Type() byte { return PINGRESP }
+
+func (p *Pingresp) Encode(w io.Writer, version byte) error {
+	return writePacket(w, PINGRESP, 0, nil)
+}
+
+func (p *Pingresp) Decode(r io.Reader, version byte) error {
+	return decodeEmpty(r, PINGRESP)
+}
+
+// Disconnect is the DISCONNECT packet, sent by a client before it closes the
+// connection cleanly. In MQTT 5.0 the server may also send it to tell the
+// reason why the connection is closed.
+type Disconnect struct {
+	// ReasonCode and Properties are only present in MQTT 5.0.
+	ReasonCode byte
+	Properties Properties
+}
+
+func (p *Disconnect) Type() byte { return DISCONNECT }
+
+func (p *Disconnect) Encode(w io.Writer, version byte) error {
+	if version < Version5 {
+		return writePacket(w, DISCONNECT, 0, nil)
+	}
+	return encodeReasonCode(w, DISCONNECT, p.ReasonCode, &p.Properties)
+}
+
+func (p *Disconnect) Decode(r io.Reader, version byte) error {
+	if version < Version5 {
+		return decodeEmpty(r, DISCONNECT)
+	}
+	return decodeReasonCode(r, DISCONNECT, &p.ReasonCode, &p.Properties)
+}
+
+// Auth is the AUTH packet of MQTT 5.0, exchanged for enhanced authentication.
+type Auth struct {
+	ReasonCode byte
+	Properties Properties
+}
+
+func (p *Auth) Type() byte { return AUTH }
+
+func (p *Auth) Encode(w io.Writer, version byte) error {
+	if version < Version5 {
+		return fmt.Errorf("%w: AUTH in protocol level %d", ErrUnknownPacketType, version)
+	}
+	return encodeReasonCode(w, AUTH, p.ReasonCode, &p.Properties)
+}
+
+func (p *Auth) Decode(r io.Reader, version byte) error {
+	// The packet type 15 is reserved before MQTT 5.0
+	if version < Version5 {
+		return fmt.Errorf("%w: AUTH in protocol level %d", ErrUnknownPacketType, version)
+	}
+	return decodeReasonCode(r, AUTH, &p.ReasonCode, &p.Properties)
+}
+
+// encodeReasonCode writes an MQTT 5.0 packet which consists of a Reason Code
+// and properties.
+func encodeReasonCode(w io.Writer, packetType byte, reasonCode byte, properties *Properties) error {
+	e := &encoder{}
+	e.reasonCodeAndProperties(reasonCode, properties)
+	if e.err != nil {
+		return e.err
+	}
+
+	return writePacket(w, packetType, 0, e.buf)
+}
+
+// decodeReasonCode reads an MQTT 5.0 packet which consists of a Reason Code
+// and properties.
+func decodeReasonCode(r io.Reader, packetType byte, reasonCode *byte, properties *Properties) error {
+	_, body, err := readBody(r, packetType)
+	if err != nil {
+		return err
+	}
+
+	d := newDecoder(packetType, body)
+	*reasonCode, *properties = d.reasonCodeAndProperties(packetType)
+	return d.finish()
+}
+
+// decodeEmpty reads a packet which consists only of the fixed header.
+func decodeEmpty(r io.Reader, packetType byte) error {
+	header, err := readFixedHeader(r, packetType)
+	if err != nil {
+		return err
+	}
+	if header.RemainingLength != 0 {
+		return fmt.Errorf("%w: %s with remaining length %d", ErrMalformedPacket, PacketName(packetType), header.RemainingLength)
+	}
+	return nil
+}
@@ -0,0 +1,479 @@
+// Package packets implements encoding and decoding of MQTT control packets.
+package packets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT Control Packet types
+const (
+	CONNECT     byte = 1
+	CONNACK     byte = 2
+	PUBLISH     byte = 3
+	PUBACK      byte = 4
+	PUBREC      byte = 5
+	PUBREL      byte = 6
+	PUBCOMP     byte = 7
+	SUBSCRIBE   byte = 8
+	SUBACK      byte = 9
+	UNSUBSCRIBE byte = 10
+	UNSUBACK    byte = 11
+	PINGREQ     byte = 12
+	PINGRESP    byte = 13
+	DISCONNECT  byte = 14
+	AUTH        byte = 15
+)
+
+// Protocol levels of the MQTT versions
+const (
+	Version31  byte = 3
+	Version311 byte = 4
+	Version5   byte = 5
+)
+
+var packetNames = map[byte]string{
+	CONNECT:     "CONNECT",
+	CONNACK:     "CONNACK",
+	PUBLISH:     "PUBLISH",
+	PUBACK:      "PUBACK",
+	PUBREC:      "PUBREC",
+	PUBREL:      "PUBREL",
+	PUBCOMP:     "PUBCOMP",
+	SUBSCRIBE:   "SUBSCRIBE",
+	SUBACK:      "SUBACK",
+	UNSUBSCRIBE: "UNSUBSCRIBE",
+	UNSUBACK:    "UNSUBACK",
+	PINGREQ:     "PINGREQ",
+	PINGRESP:    "PINGRESP",
+	DISCONNECT:  "DISCONNECT",
+	AUTH:        "AUTH",
+}
+
+// PacketName returns the name of the packet type, e.g. "CONNECT".
+func PacketName(packetType byte) string {
+	if name, ok := packetNames[packetType]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", packetType)
+}
+
+// MaxRemainingLength is the largest value which can be encoded in the
+// Remaining Length field.
+const MaxRemainingLength = 268435455
+
+// maxStringLength is the largest length of UTF-8 encoded strings and binary
+// data which are prefixed with two bytes length.
+const maxStringLength = 65535
+
+var (
+	// ErrUnknownPacketType is returned when the packet type is reserved.
+	ErrUnknownPacketType = errors.New("packets: unknown packet type")
+	// ErrUnexpectedPacketType is returned when Decode reads another packet type.
+	ErrUnexpectedPacketType = errors.New("packets: unexpected packet type")
+	// ErrInvalidFlags is returned when the fixed header flags are invalid for the packet type.
+	ErrInvalidFlags = errors.New("packets: invalid fixed header flags")
+	// ErrMalformedRemainingLength is returned when the Remaining Length is longer than 4 bytes.
+	ErrMalformedRemainingLength = errors.New("packets: malformed remaining length")
+	// ErrRemainingLengthTooLarge is returned when encoding a packet larger than MaxRemainingLength.
+	ErrRemainingLengthTooLarge = errors.New("packets: remaining length too large")
+	// ErrMalformedPacket is returned when the packet is truncated or has invalid fields.
+	ErrMalformedPacket = errors.New("packets: malformed packet")
+	// ErrProtocolViolation is returned when the packet is well-formed but violates the protocol.
+	ErrProtocolViolation = errors.New("packets: protocol violation")
+	// ErrStringTooLong is returned when encoding a string or binary data longer than 65535 bytes.
+	ErrStringTooLong = errors.New("packets: string too long")
+	// ErrInvalidQoS is returned when the QoS is not 0, 1 or 2.
+	ErrInvalidQoS = errors.New("packets: invalid QoS")
+	// ErrPacketTooLarge is returned when a packet is larger than the maximum packet size.
+	ErrPacketTooLarge = errors.New("packets: packet too large")
+)
+
+// Packet is an MQTT Control Packet. The encoding depends on the protocol
+// level negotiated by CONNECT, e.g. properties are only present in MQTT 5.0.
+type Packet interface {
+	// Type returns the MQTT Control Packet type.
+	Type() byte
+	// Encode writes the whole packet including its fixed header to w.
+	Encode(w io.Writer, version byte) error
+	// Decode reads the whole packet including its fixed header from r.
+	Decode(r io.Reader, version byte) error
+}
+
+// New returns an empty packet of the packet type.
+func New(packetType byte) (Packet, error) {
+	switch packetType {
+	case CONNECT:
+		return &Connect{}, nil
+	case CONNACK:
+		return &Connack{}, nil
+	case PUBLISH:
+		return &Publish{}, nil
+	case PUBACK:
+		return &Puback{}, nil
+	case PUBREC:
+		return &Pubrec{}, nil
+	case PUBREL:
+		return &Pubrel{}, nil
+	case PUBCOMP:
+		return &Pubcomp{}, nil
+	case SUBSCRIBE:
+		return &Subscribe{}, nil
+	case SUBACK:
+		return &Suback{}, nil
+	case UNSUBSCRIBE:
+		return &Unsubscribe{}, nil
+	case UNSUBACK:
+		return &Unsuback{}, nil
+	case PINGREQ:
+		return &Pingreq{}, nil
+	case PINGRESP:
+		return &Pingresp{}, nil
+	case DISCONNECT:
+		return &Disconnect{}, nil
+	case AUTH:
+		return &Auth{}, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnknownPacketType, packetType)
+}
+
+// ReadPacket reads the next packet of any type from r. CONNECT is decoded
+// according to its own protocol level whatever the version is.
+func ReadPacket(r io.Reader, version byte) (Packet, error) {
+	return ReadPacketWithLimit(r, version, 0)
+}
+
+// ReadPacketWithLimit is the same as ReadPacket, but returns ErrPacketTooLarge
+// without reading the rest of the packet if the whole packet including the
+// fixed header is larger than maxSize bytes. 0 means no limit.
+func ReadPacketWithLimit(r io.Reader, version byte, maxSize int) (Packet, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return nil, err
+	}
+
+	packet, err := New(first[0] >> 4)
+	if err != nil {
+		return nil, err
+	}
+
+	// The Remaining Length is kept to be read again by Decode
+	var remainingLength bytes.Buffer
+	length, err := readRemainingLength(io.TeeReader(r, &remainingLength))
+	if err != nil {
+		return nil, err
+	}
+	if size := 1 + remainingLength.Len() + length; maxSize > 0 && size > maxSize {
+		return nil, fmt.Errorf("%w: %s of %d bytes", ErrPacketTooLarge, PacketName(first[0]>>4), size)
+	}
+
+	if err := packet.Decode(io.MultiReader(bytes.NewReader(first[:]), &remainingLength, r), version); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// FixedHeader is the fixed header present in all MQTT Control Packets.
+type FixedHeader struct {
+	Type            byte
+	Flags           byte
+	RemainingLength int
+}
+
+// requiredFlags is the fixed header flags for the packet types whose flags are
+// reserved. PUBLISH is not listed because its flags carry DUP, QoS and RETAIN.
+var requiredFlags = map[byte]byte{
+	CONNECT:     0x00,
+	CONNACK:     0x00,
+	PUBACK:      0x00,
+	PUBREC:      0x00,
+	PUBREL:      0x02,
+	PUBCOMP:     0x00,
+	SUBSCRIBE:   0x02,
+	SUBACK:      0x00,
+	UNSUBSCRIBE: 0x02,
+	UNSUBACK:    0x00,
+	PINGREQ:     0x00,
+	PINGRESP:    0x00,
+	DISCONNECT:  0x00,
+	AUTH:        0x00,
+}
+
+// readFixedHeader reads the fixed header and validates it against packetType.
+func readFixedHeader(r io.Reader, packetType byte) (FixedHeader, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return FixedHeader{}, err
+	}
+
+	header := FixedHeader{
+		Type:  first[0] >> 4,
+		Flags: first[0] & 0x0F,
+	}
+	if header.Type != packetType {
+		return header, fmt.Errorf("%w: expected %s but got %s",
+			ErrUnexpectedPacketType, PacketName(packetType), PacketName(header.Type))
+	}
+	if flags, ok := requiredFlags[packetType]; ok && header.Flags != flags {
+		return header, fmt.Errorf("%w: %s with flags 0x%02X", ErrInvalidFlags, PacketName(packetType), header.Flags)
+	}
+
+	remainingLength, err := readRemainingLength(r)
+	if err != nil {
+		return header, err
+	}
+	header.RemainingLength = remainingLength
+
+	return header, nil
+}
+
+// readBody reads the fixed header and the rest of the packet specified by the
+// Remaining Length.
+func readBody(r io.Reader, packetType byte) (FixedHeader, []byte, error) {
+	header, err := readFixedHeader(r, packetType)
+	if err != nil {
+		return header, nil, err
+	}
+
+	body := make([]byte, header.RemainingLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return header, nil, err
+	}
+	return header, body, nil
+}
+
+// writePacket writes the fixed header followed by body.
+func writePacket(w io.Writer, packetType byte, flags byte, body []byte) error {
+	remainingLength, err := encodeRemainingLength(len(body))
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 0, 1+len(remainingLength)+len(body))
+	buf = append(buf, packetType<<4|flags)
+	buf = append(buf, remainingLength...)
+	buf = append(buf, body...)
+
+	_, err = w.Write(buf)
+	return err
+}
+
+// MQTTのFixed HeaderのRemaining Lengthを読み込む
+func readRemainingLength(r io.Reader) (int, error) {
+	var value int
+	var multiplier int = 1
+	var digit [1]byte
+
+	for i := 0; ; i++ {
+		// Remaining Lengthは最大4byte
+		if i == 4 {
+			return 0, ErrMalformedRemainingLength
+		}
+
+		if _, err := io.ReadFull(r, digit[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		// 最下位7bitをvalueとして使い、最上位1bitを継続判定として利用している
+		value += int(digit[0]&127) * multiplier
+		multiplier *= 128
+
+		if digit[0]&128 == 0 {
+			break
+		}
+	}
+
+	return value, nil
+}
+
+func encodeRemainingLength(length int) ([]byte, error) {
+	if length < 0 || length > MaxRemainingLength {
+		return nil, fmt.Errorf("%w: %d", ErrRemainingLengthTooLarge, length)
+	}
+
+	encoded := make([]byte, 0, 4)
+
+	for {
+		digit := length % 128
+		length = length / 128
+
+		if length > 0 {
+			digit = digit | 0x80
+		}
+
+		encoded = append(encoded, byte(digit))
+
+		if length == 0 {
+			break
+		}
+	}
+
+	return encoded, nil
+}
+
+// decoder reads fields from the bytes following the fixed header. Once an
+// error occurs all subsequent reads return zero values, so callers only need
+// to check err at the end.
+type decoder struct {
+	packetType byte
+	buf        []byte
+	err        error
+}
+
+func newDecoder(packetType byte, buf []byte) *decoder {
+	return &decoder{packetType: packetType, buf: buf}
+}
+
+func (d *decoder) fail(field string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s %s is truncated", ErrMalformedPacket, PacketName(d.packetType), field)
+	}
+}
+
+func (d *decoder) byte(field string) byte {
+	if d.err != nil || len(d.buf) < 1 {
+		d.fail(field)
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uint16(field string) uint16 {
+	if d.err != nil || len(d.buf) < 2 {
+		d.fail(field)
+		return 0
+	}
+	v := uint16(d.buf[0])<<8 | uint16(d.buf[1])
+	d.buf = d.buf[2:]
+	return v
+}
+
+func (d *decoder) uint32(field string) uint32 {
+	if d.err != nil || len(d.buf) < 4 {
+		d.fail(field)
+		return 0
+	}
+	v := uint32(d.buf[0])<<24 | uint32(d.buf[1])<<16 | uint32(d.buf[2])<<8 | uint32(d.buf[3])
+	d.buf = d.buf[4:]
+	return v
+}
+
+// varInt reads a Variable Byte Integer, which is encoded in the same way as
+// the Remaining Length.
+func (d *decoder) varInt(field string) int {
+	var value int
+	multiplier := 1
+	for i := 0; i < 4; i++ {
+		digit := d.byte(field)
+		if d.err != nil {
+			return 0
+		}
+		value += int(digit&127) * multiplier
+		multiplier *= 128
+		if digit&128 == 0 {
+			return value
+		}
+	}
+	d.err = fmt.Errorf("%w: %s %s is longer than 4 bytes", ErrMalformedPacket, PacketName(d.packetType), field)
+	return 0
+}
+
+func (d *decoder) binary(field string) []byte {
+	length := int(d.uint16(field))
+	if d.err != nil || len(d.buf) < length {
+		d.fail(field)
+		return nil
+	}
+	v := d.buf[:length:length]
+	d.buf = d.buf[length:]
+	return v
+}
+
+func (d *decoder) string(field string) string {
+	return string(d.binary(field))
+}
+
+// rest returns all remaining bytes.
+func (d *decoder) rest() []byte {
+	v := d.buf
+	d.buf = nil
+	return v
+}
+
+func (d *decoder) remaining() int {
+	return len(d.buf)
+}
+
+// finish returns the first error or an error if unread bytes remain.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = fmt.Errorf("%w: %s has %d unexpected trailing bytes",
+			ErrMalformedPacket, PacketName(d.packetType), len(d.buf))
+	}
+	return d.err
+}
+
+// encoder builds the bytes following the fixed header.
+type encoder struct {
+	buf []byte
+	err error
+}
+
+func (e *encoder) byte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) varInt(v int) {
+	encoded, err := encodeRemainingLength(v)
+	if err != nil {
+		if e.err == nil {
+			e.err = err
+		}
+		return
+	}
+	e.buf = append(e.buf, encoded...)
+}
+
+func (e *encoder) binary(v []byte) {
+	if len(v) > maxStringLength {
+		if e.err == nil {
+			e.err = fmt.Errorf("%w: %d bytes", ErrStringTooLong, len(v))
+		}
+		return
+	}
+	e.uint16(uint16(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) string(v string) {
+	e.binary([]byte(v))
+}
+
+func (e *encoder) raw(v []byte) {
+	e.buf = append(e.buf, v...)
+}
+
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
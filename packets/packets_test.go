@@ -0,0 +1,443 @@
+package packets
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeAndReadPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		version byte // Version311 if zero
+		packet  Packet
+		encoded []byte
+	}{
+		{
+			name: "CONNECT",
+			packet: &Connect{
+				ProtocolName:  "MQTT",
+				ProtocolLevel: 4,
+				UsernameFlag:  true,
+				PasswordFlag:  true,
+				WillRetain:    true,
+				WillQoS:       1,
+				WillFlag:      true,
+				CleanSession:  true,
+				KeepAlive:     60,
+				ClientID:      "id",
+				WillTopic:     "a/b",
+				WillMessage:   []byte("bye"),
+				Username:      "user",
+				Password:      []byte("pass"),
+			},
+			encoded: []byte{
+				0x10, 0x24,
+				0x00, 0x04, 'M', 'Q', 'T', 'T', // Protocol name
+				0x04,       // Protocol level
+				0xEE,       // Connect flags
+				0x00, 0x3C, // Keep alive
+				0x00, 0x02, 'i', 'd', // Client Identifier
+				0x00, 0x03, 'a', '/', 'b', // Will Topic
+				0x00, 0x03, 'b', 'y', 'e', // Will Message
+				0x00, 0x04, 'u', 's', 'e', 'r', // User Name
+				0x00, 0x04, 'p', 'a', 's', 's', // Password
+			},
+		},
+		{
+			name:    "CONNACK",
+			packet:  &Connack{SessionPresent: true, ReturnCode: ConnectAccepted},
+			encoded: []byte{0x20, 0x02, 0x01, 0x00},
+		},
+		{
+			name:    "3.1 CONNACK",
+			version: Version31,
+			packet:  &Connack{ReturnCode: ConnectIdentifierRejected},
+			encoded: []byte{0x20, 0x02, 0x00, 0x02},
+		},
+		{
+			name:    "PUBLISH QoS 0",
+			packet:  &Publish{TopicName: "a/b", Payload: []byte("hello")},
+			encoded: []byte{0x30, 0x0A, 0x00, 0x03, 'a', '/', 'b', 'h', 'e', 'l', 'l', 'o'},
+		},
+		{
+			name:    "PUBLISH QoS 1 with DUP and RETAIN",
+			packet:  &Publish{Dup: true, QoS: 1, Retain: true, TopicName: "a", PacketID: 10, Payload: []byte("x")},
+			encoded: []byte{0x3B, 0x06, 0x00, 0x01, 'a', 0x00, 0x0A, 'x'},
+		},
+		{
+			name:    "PUBACK",
+			packet:  &Puback{PacketID: 0x0102},
+			encoded: []byte{0x40, 0x02, 0x01, 0x02},
+		},
+		{
+			name:    "PUBREC",
+			packet:  &Pubrec{PacketID: 1},
+			encoded: []byte{0x50, 0x02, 0x00, 0x01},
+		},
+		{
+			name:    "PUBREL",
+			packet:  &Pubrel{PacketID: 1},
+			encoded: []byte{0x62, 0x02, 0x00, 0x01},
+		},
+		{
+			name:    "PUBCOMP",
+			packet:  &Pubcomp{PacketID: 1},
+			encoded: []byte{0x70, 0x02, 0x00, 0x01},
+		},
+		{
+			name: "SUBSCRIBE",
+			packet: &Subscribe{PacketID: 1, Subscriptions: []Subscription{
+				{TopicFilter: "a/+", QoS: 1},
+				{TopicFilter: "#", QoS: 0},
+			}},
+			encoded: []byte{0x82, 0x0C, 0x00, 0x01, 0x00, 0x03, 'a', '/', '+', 0x01, 0x00, 0x01, '#', 0x00},
+		},
+		{
+			name:    "SUBACK",
+			packet:  &Suback{PacketID: 1, ReturnCodes: []byte{SubackMaxQoS1, SubackFailure}},
+			encoded: []byte{0x90, 0x04, 0x00, 0x01, 0x01, 0x80},
+		},
+		{
+			name:    "UNSUBSCRIBE",
+			packet:  &Unsubscribe{PacketID: 2, TopicFilters: []string{"a/+", "#"}},
+			encoded: []byte{0xA2, 0x0A, 0x00, 0x02, 0x00, 0x03, 'a', '/', '+', 0x00, 0x01, '#'},
+		},
+		{
+			name:    "UNSUBACK",
+			packet:  &Unsuback{PacketID: 2},
+			encoded: []byte{0xB0, 0x02, 0x00, 0x02},
+		},
+		{
+			name:    "PINGREQ",
+			packet:  &Pingreq{},
+			encoded: []byte{0xC0, 0x00},
+		},
+		{
+			name:    "PINGRESP",
+			packet:  &Pingresp{},
+			encoded: []byte{0xD0, 0x00},
+		},
+		{
+			name:    "DISCONNECT",
+			packet:  &Disconnect{},
+			encoded: []byte{0xE0, 0x00},
+		},
+		{
+			name:    "v5 CONNECT",
+			version: Version5,
+			packet: &Connect{
+				ProtocolName:   "MQTT",
+				ProtocolLevel:  5,
+				WillFlag:       true,
+				CleanSession:   true,
+				KeepAlive:      10,
+				Properties:     Properties{SessionExpiryInterval: Uint32(60), ReceiveMaximum: Uint16(20)},
+				ClientID:       "id",
+				WillProperties: Properties{WillDelayInterval: Uint32(5), ContentType: "t"},
+				WillTopic:      "w",
+				WillMessage:    []byte("x"),
+			},
+			encoded: []byte{
+				0x10, 0x27,
+				0x00, 0x04, 'M', 'Q', 'T', 'T', // Protocol name
+				0x05,       // Protocol level
+				0x06,       // Connect flags
+				0x00, 0x0A, // Keep alive
+				0x08,                         // Property length
+				0x11, 0x00, 0x00, 0x00, 0x3C, // Session Expiry Interval
+				0x21, 0x00, 0x14, // Receive Maximum
+				0x00, 0x02, 'i', 'd', // Client Identifier
+				0x09,                  // Will property length
+				0x03, 0x00, 0x01, 't', // Content Type
+				0x18, 0x00, 0x00, 0x00, 0x05, // Will Delay Interval
+				0x00, 0x01, 'w', // Will Topic
+				0x00, 0x01, 'x', // Will Message
+			},
+		},
+		{
+			name:    "v5 CONNACK",
+			version: Version5,
+			packet: &Connack{ReturnCode: ReasonSuccess, Properties: Properties{
+				AssignedClientIdentifier: "a",
+				UserProperties:           []UserProperty{{Name: "k", Value: "v"}},
+			}},
+			encoded: []byte{0x20, 0x0E, 0x00, 0x00, 0x0B, 0x12, 0x00, 0x01, 'a', 0x26, 0x00, 0x01, 'k', 0x00, 0x01, 'v'},
+		},
+		{
+			name:    "v5 PUBLISH",
+			version: Version5,
+			packet: &Publish{QoS: 1, TopicName: "a", PacketID: 1, Properties: Properties{
+				PayloadFormatIndicator:  Byte(1),
+				SubscriptionIdentifiers: []int{1, 200},
+			}, Payload: []byte("x")},
+			encoded: []byte{0x32, 0x0E, 0x00, 0x01, 'a', 0x00, 0x01, 0x07, 0x01, 0x01, 0x0B, 0x01, 0x0B, 0xC8, 0x01, 'x'},
+		},
+		{
+			name:    "v5 PUBACK with success",
+			version: Version5,
+			packet:  &Puback{PacketID: 1},
+			encoded: []byte{0x40, 0x02, 0x00, 0x01},
+		},
+		{
+			name:    "v5 PUBREC with reason code",
+			version: Version5,
+			packet:  &Pubrec{PacketID: 1, ReasonCode: ReasonNoMatchingSubscribers},
+			encoded: []byte{0x50, 0x03, 0x00, 0x01, 0x10},
+		},
+		{
+			name:    "v5 PUBCOMP with properties",
+			version: Version5,
+			packet:  &Pubcomp{PacketID: 1, ReasonCode: ReasonPacketIdentifierNotFound, Properties: Properties{ReasonString: "r"}},
+			encoded: []byte{0x70, 0x08, 0x00, 0x01, 0x92, 0x04, 0x1F, 0x00, 0x01, 'r'},
+		},
+		{
+			name:    "v5 SUBSCRIBE",
+			version: Version5,
+			packet: &Subscribe{PacketID: 1, Properties: Properties{SubscriptionIdentifiers: []int{3}}, Subscriptions: []Subscription{
+				{TopicFilter: "a", QoS: 2, NoLocal: true, RetainAsPublished: true, RetainHandling: RetainHandlingDoNotSend},
+			}},
+			encoded: []byte{0x82, 0x09, 0x00, 0x01, 0x02, 0x0B, 0x03, 0x00, 0x01, 'a', 0x2E},
+		},
+		{
+			name:    "v5 SUBACK",
+			version: Version5,
+			packet:  &Suback{PacketID: 1, ReturnCodes: []byte{ReasonGrantedQoS1, ReasonTopicFilterInvalid}},
+			encoded: []byte{0x90, 0x05, 0x00, 0x01, 0x00, 0x01, 0x8F},
+		},
+		{
+			name:    "v5 UNSUBSCRIBE",
+			version: Version5,
+			packet:  &Unsubscribe{PacketID: 2, TopicFilters: []string{"a"}},
+			encoded: []byte{0xA2, 0x06, 0x00, 0x02, 0x00, 0x00, 0x01, 'a'},
+		},
+		{
+			name:    "v5 UNSUBACK",
+			version: Version5,
+			packet:  &Unsuback{PacketID: 2, ReasonCodes: []byte{ReasonSuccess, ReasonNoSubscriptionExisted}},
+			encoded: []byte{0xB0, 0x05, 0x00, 0x02, 0x00, 0x00, 0x11},
+		},
+		{
+			name:    "v5 DISCONNECT with normal disconnection",
+			version: Version5,
+			packet:  &Disconnect{},
+			encoded: []byte{0xE0, 0x00},
+		},
+		{
+			name:    "v5 DISCONNECT with properties",
+			version: Version5,
+			packet:  &Disconnect{ReasonCode: ReasonDisconnectWithWillMessage, Properties: Properties{SessionExpiryInterval: Uint32(0)}},
+			encoded: []byte{0xE0, 0x07, 0x04, 0x05, 0x11, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			name:    "v5 AUTH",
+			version: Version5,
+			packet:  &Auth{ReasonCode: ReasonContinueAuthentication, Properties: Properties{AuthenticationMethod: "m"}},
+			encoded: []byte{0xF0, 0x06, 0x18, 0x04, 0x15, 0x00, 0x01, 'm'},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version := tt.version
+			if version == 0 {
+				version = Version311
+			}
+
+			buf := &bytes.Buffer{}
+			assert.NoError(t, tt.packet.Encode(buf, version))
+			assert.Equal(t, tt.encoded, buf.Bytes())
+
+			decoded, err := ReadPacket(bytes.NewReader(tt.encoded), version)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.packet, decoded)
+		})
+	}
+}
+
+func TestReadPacketErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		version byte // Version311 if zero
+		encoded []byte
+		err     error
+	}{
+		{
+			name:    "reserved packet type",
+			encoded: []byte{0xF0, 0x00},
+			err:     ErrUnknownPacketType,
+		},
+		{
+			name:    "invalid SUBSCRIBE flags",
+			encoded: []byte{0x80, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x00},
+			err:     ErrInvalidFlags,
+		},
+		{
+			name:    "PUBLISH QoS 3",
+			encoded: []byte{0x36, 0x05, 0x00, 0x01, 'a', 0x00, 0x01},
+			err:     ErrInvalidQoS,
+		},
+		{
+			name:    "remaining length longer than 4 bytes",
+			encoded: []byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01},
+			err:     ErrMalformedRemainingLength,
+		},
+		{
+			name:    "truncated topic name",
+			encoded: []byte{0x30, 0x03, 0x00, 0x05, 'a'},
+			err:     ErrMalformedPacket,
+		},
+		{
+			name:    "SUBSCRIBE without topic filters",
+			encoded: []byte{0x82, 0x02, 0x00, 0x01},
+			err:     ErrProtocolViolation,
+		},
+		{
+			name:    "SUBSCRIBE with invalid requested QoS",
+			encoded: []byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x03},
+			err:     ErrMalformedPacket,
+		},
+		{
+			name:    "PINGREQ with a payload",
+			encoded: []byte{0xC0, 0x01, 0x00},
+			err:     ErrMalformedPacket,
+		},
+		{
+			name:    "PUBACK with trailing bytes",
+			encoded: []byte{0x40, 0x03, 0x00, 0x01, 0x00},
+			err:     ErrMalformedPacket,
+		},
+		{
+			name:    "CONNECT with the reserved flag",
+			encoded: []byte{0x10, 0x0C, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x03, 0x00, 0x00, 0x00, 0x00},
+			err:     ErrMalformedPacket,
+		},
+		{
+			name:    "SUBSCRIBE with v5 subscription options in 3.1.1",
+			encoded: []byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x04},
+			err:     ErrMalformedPacket,
+		},
+		{
+			name:    "v5 unknown property",
+			version: Version5,
+			encoded: []byte{0x40, 0x05, 0x00, 0x01, 0x00, 0x01, 0x7F},
+			err:     ErrMalformedPacket,
+		},
+		{
+			name:    "v5 property not allowed in the packet",
+			version: Version5,
+			encoded: []byte{0x40, 0x08, 0x00, 0x01, 0x00, 0x04, 0x12, 0x00, 0x01, 'a'},
+			err:     ErrProtocolViolation,
+		},
+		{
+			name:    "v5 duplicated property",
+			version: Version5,
+			encoded: []byte{0x40, 0x0C, 0x00, 0x01, 0x00, 0x08, 0x1F, 0x00, 0x01, 'a', 0x1F, 0x00, 0x01, 'b'},
+			err:     ErrProtocolViolation,
+		},
+		{
+			name:    "v5 Receive Maximum 0",
+			version: Version5,
+			encoded: []byte{0x10, 0x10, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x02, 0x00, 0x00, 0x03, 0x21, 0x00, 0x00, 0x00, 0x00},
+			err:     ErrProtocolViolation,
+		},
+		{
+			name:    "v5 SUBSCRIBE with reserved subscription options",
+			version: Version5,
+			encoded: []byte{0x82, 0x07, 0x00, 0x01, 0x00, 0x00, 0x01, 'a', 0x40},
+			err:     ErrMalformedPacket,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version := tt.version
+			if version == 0 {
+				version = Version311
+			}
+			_, err := ReadPacket(bytes.NewReader(tt.encoded), version)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+
+	t.Run("unsupported protocol", func(t *testing.T) {
+		for _, protocol := range []struct {
+			name  string
+			level byte
+		}{{"MQTT", 3}, {"MQTT", 6}, {"MQIsdp", 4}, {"HTTP", 4}} {
+			encoded := []byte{0x10, byte(2 + len(protocol.name) + 1)}
+			encoded = append(encoded, 0x00, byte(len(protocol.name)))
+			encoded = append(encoded, protocol.name...)
+			encoded = append(encoded, protocol.level)
+
+			_, err := ReadPacket(bytes.NewReader(encoded), Version311)
+			var unsupported *UnsupportedProtocolError
+			if assert.ErrorAs(t, err, &unsupported) {
+				assert.Equal(t, &UnsupportedProtocolError{ProtocolName: protocol.name, ProtocolLevel: protocol.level}, unsupported)
+			}
+		}
+	})
+
+	t.Run("body shorter than remaining length", func(t *testing.T) {
+		_, err := ReadPacket(bytes.NewReader([]byte{0x40, 0x02, 0x00}), Version311)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("decoding another packet type", func(t *testing.T) {
+		err := (&Puback{}).Decode(bytes.NewReader([]byte{0x50, 0x02, 0x00, 0x01}), Version311)
+		assert.ErrorIs(t, err, ErrUnexpectedPacketType)
+	})
+}
+
+func TestReadPacketWithLimit(t *testing.T) {
+	// PUBLISH of 8 bytes in total
+	encoded := []byte{0x30, 0x06, 0x00, 0x01, 'a', 'h', 'i', '!'}
+
+	packet, err := ReadPacketWithLimit(bytes.NewReader(encoded), Version311, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, &Publish{TopicName: "a", Payload: []byte("hi!")}, packet)
+
+	_, err = ReadPacketWithLimit(bytes.NewReader(encoded), Version311, 7)
+	assert.ErrorIs(t, err, ErrPacketTooLarge)
+
+	// The body is not read when the Remaining Length exceeds the limit
+	r := bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F})
+	_, err = ReadPacketWithLimit(r, Version311, 1024)
+	assert.ErrorIs(t, err, ErrPacketTooLarge)
+	assert.Zero(t, r.Len())
+}
+
+func TestEncodeErrors(t *testing.T) {
+	t.Run("PUBLISH QoS 3", func(t *testing.T) {
+		err := (&Publish{QoS: 3, TopicName: "a"}).Encode(io.Discard, Version311)
+		assert.ErrorIs(t, err, ErrInvalidQoS)
+	})
+
+	t.Run("too long topic name", func(t *testing.T) {
+		err := (&Publish{TopicName: string(make([]byte, 65536))}).Encode(io.Discard, Version311)
+		assert.ErrorIs(t, err, ErrStringTooLong)
+	})
+}
+
+func TestConnackMQTT31(t *testing.T) {
+	// MQTT 3.1 has no Session Present flag
+	buf := &bytes.Buffer{}
+	assert.NoError(t, (&Connack{SessionPresent: true}).Encode(buf, Version31))
+	assert.Equal(t, []byte{0x20, 0x02, 0x00, 0x00}, buf.Bytes())
+}
+
+func TestRemainingLength(t *testing.T) {
+	for _, length := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, MaxRemainingLength} {
+		encoded, err := encodeRemainingLength(length)
+		assert.NoError(t, err)
+
+		decoded, err := readRemainingLength(bytes.NewReader(encoded))
+		assert.NoError(t, err)
+		assert.Equal(t, length, decoded)
+	}
+
+	_, err := encodeRemainingLength(MaxRemainingLength + 1)
+	assert.ErrorIs(t, err, ErrRemainingLengthTooLarge)
+}
@@ -0,0 +1,422 @@
+package packets
+
+import (
+	"fmt"
+)
+
+// Property identifiers of MQTT 5.0
+const (
+	PropPayloadFormatIndicator          byte = 0x01
+	PropMessageExpiryInterval           byte = 0x02
+	PropContentType                     byte = 0x03
+	PropResponseTopic                   byte = 0x08
+	PropCorrelationData                 byte = 0x09
+	PropSubscriptionIdentifier          byte = 0x0B
+	PropSessionExpiryInterval           byte = 0x11
+	PropAssignedClientIdentifier        byte = 0x12
+	PropServerKeepAlive                 byte = 0x13
+	PropAuthenticationMethod            byte = 0x15
+	PropAuthenticationData              byte = 0x16
+	PropRequestProblemInformation       byte = 0x17
+	PropWillDelayInterval               byte = 0x18
+	PropRequestResponseInformation      byte = 0x19
+	PropResponseInformation             byte = 0x1A
+	PropServerReference                 byte = 0x1C
+	PropReasonString                    byte = 0x1F
+	PropReceiveMaximum                  byte = 0x21
+	PropTopicAliasMaximum               byte = 0x22
+	PropTopicAlias                      byte = 0x23
+	PropMaximumQoS                      byte = 0x24
+	PropRetainAvailable                 byte = 0x25
+	PropUserProperty                    byte = 0x26
+	PropMaximumPacketSize               byte = 0x27
+	PropWildcardSubscriptionAvailable   byte = 0x28
+	PropSubscriptionIdentifierAvailable byte = 0x29
+	PropSharedSubscriptionAvailable     byte = 0x2A
+)
+
+// willProperties is used in place of a packet type for the Will Properties in
+// the CONNECT payload. 0 is not used by any packet type.
+const willProperties byte = 0
+
+// propertyDefinition describes a property and the packets it may appear in.
+type propertyDefinition struct {
+	name    string
+	packets []byte
+}
+
+var propertyDefinitions = map[byte]propertyDefinition{
+	PropPayloadFormatIndicator:          {"Payload Format Indicator", []byte{PUBLISH, willProperties}},
+	PropMessageExpiryInterval:           {"Message Expiry Interval", []byte{PUBLISH, willProperties}},
+	PropContentType:                     {"Content Type", []byte{PUBLISH, willProperties}},
+	PropResponseTopic:                   {"Response Topic", []byte{PUBLISH, willProperties}},
+	PropCorrelationData:                 {"Correlation Data", []byte{PUBLISH, willProperties}},
+	PropSubscriptionIdentifier:          {"Subscription Identifier", []byte{PUBLISH, SUBSCRIBE}},
+	PropSessionExpiryInterval:           {"Session Expiry Interval", []byte{CONNECT, CONNACK, DISCONNECT}},
+	PropAssignedClientIdentifier:        {"Assigned Client Identifier", []byte{CONNACK}},
+	PropServerKeepAlive:                 {"Server Keep Alive", []byte{CONNACK}},
+	PropAuthenticationMethod:            {"Authentication Method", []byte{CONNECT, CONNACK, AUTH}},
+	PropAuthenticationData:              {"Authentication Data", []byte{CONNECT, CONNACK, AUTH}},
+	PropRequestProblemInformation:       {"Request Problem Information", []byte{CONNECT}},
+	PropWillDelayInterval:               {"Will Delay Interval", []byte{willProperties}},
+	PropRequestResponseInformation:      {"Request Response Information", []byte{CONNECT}},
+	PropResponseInformation:             {"Response Information", []byte{CONNACK}},
+	PropServerReference:                 {"Server Reference", []byte{CONNACK, DISCONNECT}},
+	PropReasonString:                    {"Reason String", []byte{CONNACK, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBACK, UNSUBACK, DISCONNECT, AUTH}},
+	PropReceiveMaximum:                  {"Receive Maximum", []byte{CONNECT, CONNACK}},
+	PropTopicAliasMaximum:               {"Topic Alias Maximum", []byte{CONNECT, CONNACK}},
+	PropTopicAlias:                      {"Topic Alias", []byte{PUBLISH}},
+	PropMaximumQoS:                      {"Maximum QoS", []byte{CONNACK}},
+	PropRetainAvailable:                 {"Retain Available", []byte{CONNACK}},
+	PropUserProperty:                    {"User Property", []byte{CONNECT, CONNACK, PUBLISH, willProperties, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBSCRIBE, SUBACK, UNSUBSCRIBE, UNSUBACK, DISCONNECT, AUTH}},
+	PropMaximumPacketSize:               {"Maximum Packet Size", []byte{CONNECT, CONNACK}},
+	PropWildcardSubscriptionAvailable:   {"Wildcard Subscription Available", []byte{CONNACK}},
+	PropSubscriptionIdentifierAvailable: {"Subscription Identifier Available", []byte{CONNACK}},
+	PropSharedSubscriptionAvailable:     {"Shared Subscription Available", []byte{CONNACK}},
+}
+
+func (def propertyDefinition) allowedIn(packetType byte) bool {
+	for _, t := range def.packets {
+		if t == packetType {
+			return true
+		}
+	}
+	return false
+}
+
+// UserProperty is a name-value pair of the User Property.
+type UserProperty struct {
+	Name  string
+	Value string
+}
+
+// Properties is the set of properties of an MQTT 5.0 packet. Nil pointers and
+// empty strings, binaries and slices mean that the property is absent.
+type Properties struct {
+	PayloadFormatIndicator          *byte
+	MessageExpiryInterval           *uint32
+	ContentType                     string
+	ResponseTopic                   string
+	CorrelationData                 []byte
+	SubscriptionIdentifiers         []int
+	SessionExpiryInterval           *uint32
+	AssignedClientIdentifier        string
+	ServerKeepAlive                 *uint16
+	AuthenticationMethod            string
+	AuthenticationData              []byte
+	RequestProblemInformation       *byte
+	WillDelayInterval               *uint32
+	RequestResponseInformation      *byte
+	ResponseInformation             string
+	ServerReference                 string
+	ReasonString                    string
+	ReceiveMaximum                  *uint16
+	TopicAliasMaximum               *uint16
+	TopicAlias                      *uint16
+	MaximumQoS                      *byte
+	RetainAvailable                 *byte
+	UserProperties                  []UserProperty
+	MaximumPacketSize               *uint32
+	WildcardSubscriptionAvailable   *byte
+	SubscriptionIdentifierAvailable *byte
+	SharedSubscriptionAvailable     *byte
+}
+
+// Byte, Uint16 and Uint32 return a pointer to v, for setting the optional
+// numeric properties.
+func Byte(v byte) *byte       { return &v }
+func Uint16(v uint16) *uint16 { return &v }
+func Uint32(v uint32) *uint32 { return &v }
+
+// properties writes the Property Length followed by the properties.
+func (e *encoder) properties(p *Properties) {
+	pe := &encoder{}
+	if p.PayloadFormatIndicator != nil {
+		pe.byte(PropPayloadFormatIndicator)
+		pe.byte(*p.PayloadFormatIndicator)
+	}
+	if p.MessageExpiryInterval != nil {
+		pe.byte(PropMessageExpiryInterval)
+		pe.uint32(*p.MessageExpiryInterval)
+	}
+	if p.ContentType != "" {
+		pe.byte(PropContentType)
+		pe.string(p.ContentType)
+	}
+	if p.ResponseTopic != "" {
+		pe.byte(PropResponseTopic)
+		pe.string(p.ResponseTopic)
+	}
+	if len(p.CorrelationData) > 0 {
+		pe.byte(PropCorrelationData)
+		pe.binary(p.CorrelationData)
+	}
+	for _, id := range p.SubscriptionIdentifiers {
+		pe.byte(PropSubscriptionIdentifier)
+		pe.varInt(id)
+	}
+	if p.SessionExpiryInterval != nil {
+		pe.byte(PropSessionExpiryInterval)
+		pe.uint32(*p.SessionExpiryInterval)
+	}
+	if p.AssignedClientIdentifier != "" {
+		pe.byte(PropAssignedClientIdentifier)
+		pe.string(p.AssignedClientIdentifier)
+	}
+	if p.ServerKeepAlive != nil {
+		pe.byte(PropServerKeepAlive)
+		pe.uint16(*p.ServerKeepAlive)
+	}
+	if p.AuthenticationMethod != "" {
+		pe.byte(PropAuthenticationMethod)
+		pe.string(p.AuthenticationMethod)
+	}
+	if len(p.AuthenticationData) > 0 {
+		pe.byte(PropAuthenticationData)
+		pe.binary(p.AuthenticationData)
+	}
+	if p.RequestProblemInformation != nil {
+		pe.byte(PropRequestProblemInformation)
+		pe.byte(*p.RequestProblemInformation)
+	}
+	if p.WillDelayInterval != nil {
+		pe.byte(PropWillDelayInterval)
+		pe.uint32(*p.WillDelayInterval)
+	}
+	if p.RequestResponseInformation != nil {
+		pe.byte(PropRequestResponseInformation)
+		pe.byte(*p.RequestResponseInformation)
+	}
+	if p.ResponseInformation != "" {
+		pe.byte(PropResponseInformation)
+		pe.string(p.ResponseInformation)
+	}
+	if p.ServerReference != "" {
+		pe.byte(PropServerReference)
+		pe.string(p.ServerReference)
+	}
+	if p.ReasonString != "" {
+		pe.byte(PropReasonString)
+		pe.string(p.ReasonString)
+	}
+	if p.ReceiveMaximum != nil {
+		pe.byte(PropReceiveMaximum)
+		pe.uint16(*p.ReceiveMaximum)
+	}
+	if p.TopicAliasMaximum != nil {
+		pe.byte(PropTopicAliasMaximum)
+		pe.uint16(*p.TopicAliasMaximum)
+	}
+	if p.TopicAlias != nil {
+		pe.byte(PropTopicAlias)
+		pe.uint16(*p.TopicAlias)
+	}
+	if p.MaximumQoS != nil {
+		pe.byte(PropMaximumQoS)
+		pe.byte(*p.MaximumQoS)
+	}
+	if p.RetainAvailable != nil {
+		pe.byte(PropRetainAvailable)
+		pe.byte(*p.RetainAvailable)
+	}
+	for _, up := range p.UserProperties {
+		pe.byte(PropUserProperty)
+		pe.string(up.Name)
+		pe.string(up.Value)
+	}
+	if p.MaximumPacketSize != nil {
+		pe.byte(PropMaximumPacketSize)
+		pe.uint32(*p.MaximumPacketSize)
+	}
+	if p.WildcardSubscriptionAvailable != nil {
+		pe.byte(PropWildcardSubscriptionAvailable)
+		pe.byte(*p.WildcardSubscriptionAvailable)
+	}
+	if p.SubscriptionIdentifierAvailable != nil {
+		pe.byte(PropSubscriptionIdentifierAvailable)
+		pe.byte(*p.SubscriptionIdentifierAvailable)
+	}
+	if p.SharedSubscriptionAvailable != nil {
+		pe.byte(PropSharedSubscriptionAvailable)
+		pe.byte(*p.SharedSubscriptionAvailable)
+	}
+
+	if pe.err != nil {
+		if e.err == nil {
+			e.err = pe.err
+		}
+		return
+	}
+	e.varInt(len(pe.buf))
+	e.raw(pe.buf)
+}
+
+// properties reads the Property Length followed by the properties and
+// validates that they may appear in the packet type.
+func (d *decoder) properties(packetType byte) Properties {
+	var p Properties
+
+	length := d.varInt("property length")
+	if d.err != nil || len(d.buf) < length {
+		d.fail("properties")
+		return p
+	}
+	pd := newDecoder(d.packetType, d.buf[:length])
+	d.buf = d.buf[length:]
+
+	context := PacketName(packetType)
+	if packetType == willProperties {
+		context = "Will"
+	}
+
+	seen := make(map[byte]bool)
+	for pd.err == nil && pd.remaining() > 0 {
+		id := pd.byte("property identifier")
+		def, ok := propertyDefinitions[id]
+		if !ok {
+			d.err = fmt.Errorf("%w: %s has unknown property 0x%02X", ErrMalformedPacket, context, id)
+			return p
+		}
+		if !def.allowedIn(packetType) {
+			d.err = fmt.Errorf("%w: %s must not have %s", ErrProtocolViolation, context, def.name)
+			return p
+		}
+		// Only User Property and Subscription Identifier in PUBLISH may appear
+		// more than once
+		multiple := id == PropUserProperty || (id == PropSubscriptionIdentifier && packetType == PUBLISH)
+		if seen[id] && !multiple {
+			d.err = fmt.Errorf("%w: %s has %s more than once", ErrProtocolViolation, context, def.name)
+			return p
+		}
+		seen[id] = true
+
+		switch id {
+		case PropPayloadFormatIndicator:
+			p.PayloadFormatIndicator = pd.flag(def.name)
+		case PropMessageExpiryInterval:
+			p.MessageExpiryInterval = Uint32(pd.uint32(def.name))
+		case PropContentType:
+			p.ContentType = pd.string(def.name)
+		case PropResponseTopic:
+			p.ResponseTopic = pd.string(def.name)
+		case PropCorrelationData:
+			p.CorrelationData = pd.binary(def.name)
+		case PropSubscriptionIdentifier:
+			p.SubscriptionIdentifiers = append(p.SubscriptionIdentifiers, pd.nonZeroVarInt(def.name))
+		case PropSessionExpiryInterval:
+			p.SessionExpiryInterval = Uint32(pd.uint32(def.name))
+		case PropAssignedClientIdentifier:
+			p.AssignedClientIdentifier = pd.string(def.name)
+		case PropServerKeepAlive:
+			p.ServerKeepAlive = Uint16(pd.uint16(def.name))
+		case PropAuthenticationMethod:
+			p.AuthenticationMethod = pd.string(def.name)
+		case PropAuthenticationData:
+			p.AuthenticationData = pd.binary(def.name)
+		case PropRequestProblemInformation:
+			p.RequestProblemInformation = pd.flag(def.name)
+		case PropWillDelayInterval:
+			p.WillDelayInterval = Uint32(pd.uint32(def.name))
+		case PropRequestResponseInformation:
+			p.RequestResponseInformation = pd.flag(def.name)
+		case PropResponseInformation:
+			p.ResponseInformation = pd.string(def.name)
+		case PropServerReference:
+			p.ServerReference = pd.string(def.name)
+		case PropReasonString:
+			p.ReasonString = pd.string(def.name)
+		case PropReceiveMaximum:
+			p.ReceiveMaximum = pd.nonZeroUint16(def.name)
+		case PropTopicAliasMaximum:
+			p.TopicAliasMaximum = Uint16(pd.uint16(def.name))
+		case PropTopicAlias:
+			p.TopicAlias = pd.nonZeroUint16(def.name)
+		case PropMaximumQoS:
+			p.MaximumQoS = pd.flag(def.name)
+		case PropRetainAvailable:
+			p.RetainAvailable = pd.flag(def.name)
+		case PropUserProperty:
+			name := pd.string(def.name)
+			value := pd.string(def.name)
+			p.UserProperties = append(p.UserProperties, UserProperty{Name: name, Value: value})
+		case PropMaximumPacketSize:
+			size := pd.uint32(def.name)
+			if pd.err == nil && size == 0 {
+				pd.err = fmt.Errorf("%w: %s is 0", ErrProtocolViolation, def.name)
+			}
+			p.MaximumPacketSize = Uint32(size)
+		case PropWildcardSubscriptionAvailable:
+			p.WildcardSubscriptionAvailable = pd.flag(def.name)
+		case PropSubscriptionIdentifierAvailable:
+			p.SubscriptionIdentifierAvailable = pd.flag(def.name)
+		case PropSharedSubscriptionAvailable:
+			p.SharedSubscriptionAvailable = pd.flag(def.name)
+		}
+	}
+	if pd.err != nil {
+		d.err = pd.err
+	}
+	return p
+}
+
+// reasonCodeAndProperties writes the Reason Code followed by the properties at
+// the end of a packet. Both are omitted if the Reason Code is Success and there
+// are no properties, and the properties are omitted if there are none.
+func (e *encoder) reasonCodeAndProperties(reasonCode byte, properties *Properties) {
+	pe := &encoder{}
+	pe.properties(properties)
+	if pe.err != nil {
+		if e.err == nil {
+			e.err = pe.err
+		}
+		return
+	}
+
+	// The Property Length 0 is encoded in one byte
+	hasProperties := len(pe.buf) > 1
+	if reasonCode != ReasonSuccess || hasProperties {
+		e.byte(reasonCode)
+	}
+	if hasProperties {
+		e.raw(pe.buf)
+	}
+}
+
+// reasonCodeAndProperties reads the Reason Code and the properties at the end
+// of a packet, which default to Success and no properties if absent.
+func (d *decoder) reasonCodeAndProperties(packetType byte) (byte, Properties) {
+	reasonCode := ReasonSuccess
+	var properties Properties
+	if d.remaining() > 0 {
+		reasonCode = d.byte("reason code")
+	}
+	if d.remaining() > 0 {
+		properties = d.properties(packetType)
+	}
+	return reasonCode, properties
+}
+
+// flag reads a byte property whose value must be 0 or 1.
+func (d *decoder) flag(field string) *byte {
+	v := d.byte(field)
+	if d.err == nil && v > 1 {
+		d.err = fmt.Errorf("%w: %s is %d", ErrProtocolViolation, field, v)
+	}
+	return &v
+}
+
+func (d *decoder) nonZeroUint16(field string) *uint16 {
+	v := d.uint16(field)
+	if d.err == nil && v == 0 {
+		d.err = fmt.Errorf("%w: %s is 0", ErrProtocolViolation, field)
+	}
+	return &v
+}
+
+func (d *decoder) nonZeroVarInt(field string) int {
+	v := d.varInt(field)
+	if d.err == nil && v == 0 {
+		d.err = fmt.Errorf("%w: %s is 0", ErrProtocolViolation, field)
+	}
+	return v
+}
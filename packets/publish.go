@@ -0,0 +1,184 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// Publish is the PUBLISH packet, which transports an application message.
+type Publish struct {
+	Dup    bool
+	QoS    byte
+	Retain bool
+
+	TopicName string
+	// PacketID is only present when QoS is 1 or 2.
+	PacketID uint16
+	// Properties is only present in MQTT 5.0.
+	Properties Properties
+
+	Payload []byte
+}
+
+func (p *Publish) Type() byte { return PUBLISH }
+
+func (p *Publish) Encode(w io.Writer, version byte) error {
+	if p.QoS > 2 {
+		return fmt.Errorf("%w: %d", ErrInvalidQoS, p.QoS)
+	}
+
+	e := &encoder{}
+	e.string(p.TopicName)
+	if p.QoS > 0 {
+		e.uint16(p.PacketID)
+	}
+	if version >= Version5 {
+		e.properties(&p.Properties)
+	}
+	e.raw(p.Payload)
+	if e.err != nil {
+		return e.err
+	}
+
+	return writePacket(w, PUBLISH, p.flags(), e.buf)
+}
+
+func (p *Publish) flags() byte {
+	flags := p.QoS << 1
+	if p.Dup {
+		flags |= 0x08
+	}
+	if p.Retain {
+		flags |= 0x01
+	}
+	return flags
+}
+
+func (p *Publish) Decode(r io.Reader, version byte) error {
+	header, body, err := readBody(r, PUBLISH)
+	if err != nil {
+		return err
+	}
+
+	p.Dup = header.Flags&0x08 != 0
+	p.QoS = (header.Flags >> 1) & 0x03
+	p.Retain = header.Flags&0x01 != 0
+	if p.QoS > 2 {
+		return fmt.Errorf("%w: PUBLISH QoS %d", ErrInvalidQoS, p.QoS)
+	}
+
+	d := newDecoder(PUBLISH, body)
+	p.TopicName = d.string("topic name")
+	if p.QoS > 0 {
+		p.PacketID = d.uint16("packet identifier")
+	}
+	p.Properties = Properties{}
+	if version >= Version5 {
+		p.Properties = d.properties(PUBLISH)
+	}
+	p.Payload = d.rest()
+
+	return d.finish()
+}
+
+// Puback is the PUBACK packet, the response to a QoS 1 PUBLISH.
+type Puback struct {
+	PacketID uint16
+	// ReasonCode and Properties are only present in MQTT 5.0.
+	ReasonCode byte
+	Properties Properties
+}
+
+func (p *Puback) Type() byte { return PUBACK }
+
+func (p *Puback) Encode(w io.Writer, version byte) error {
+	return encodeAck(w, PUBACK, version, p.PacketID, p.ReasonCode, &p.Properties)
+}
+
+func (p *Puback) Decode(r io.Reader, version byte) error {
+	return decodeAck(r, PUBACK, version, &p.PacketID, &p.ReasonCode, &p.Properties)
+}
+
+// Pubrec is the PUBREC packet, the response to a QoS 2 PUBLISH.
+type Pubrec struct {
+	PacketID uint16
+	// ReasonCode and Properties are only present in MQTT 5.0.
+	ReasonCode byte
+	Properties Properties
+}
+
+func (p *Pubrec) Type() byte { return PUBREC }
+
+func (p *Pubrec) Encode(w io.Writer, version byte) error {
+	return encodeAck(w, PUBREC, version, p.PacketID, p.ReasonCode, &p.Properties)
+}
+
+func (p *Pubrec) Decode(r io.Reader, version byte) error {
+	return decodeAck(r, PUBREC, version, &p.PacketID, &p.ReasonCode, &p.Properties)
+}
+
+// Pubrel is the PUBREL packet, the response to PUBREC.
+type Pubrel struct {
+	PacketID uint16
+	// ReasonCode and Properties are only present in MQTT 5.0.
+	ReasonCode byte
+	Properties Properties
+}
+
+func (p *Pubrel) Type() byte { return PUBREL }
+
+func (p *Pubrel) Encode(w io.Writer, version byte) error {
+	return encodeAck(w, PUBREL, version, p.PacketID, p.ReasonCode, &p.Properties)
+}
+
+func (p *Pubrel) Decode(r io.Reader, version byte) error {
+	return decodeAck(r, PUBREL, version, &p.PacketID, &p.ReasonCode, &p.Properties)
+}
+
+// Pubcomp is the PUBCOMP packet, the response to PUBREL.
+type Pubcomp struct {
+	PacketID uint16
+	// ReasonCode and Properties are only present in MQTT 5.0.
+	ReasonCode byte
+	Properties Properties
+}
+
+func (p *Pubcomp) Type() byte { return PUBCOMP }
+
+func (p *Pubcomp) Encode(w io.Writer, version byte) error {
+	return encodeAck(w, PUBCOMP, version, p.PacketID, p.ReasonCode, &p.Properties)
+}
+
+func (p *Pubcomp) Decode(r io.Reader, version byte) error {
+	return decodeAck(r, PUBCOMP, version, &p.PacketID, &p.ReasonCode, &p.Properties)
+}
+
+// encodeAck writes PUBACK, PUBREC, PUBREL or PUBCOMP.
+func encodeAck(w io.Writer, packetType byte, version byte, packetID uint16, reasonCode byte, properties *Properties) error {
+	e := &encoder{}
+	e.uint16(packetID)
+	if version >= Version5 {
+		e.reasonCodeAndProperties(reasonCode, properties)
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	return writePacket(w, packetType, requiredFlags[packetType], e.buf)
+}
+
+// decodeAck reads PUBACK, PUBREC, PUBREL or PUBCOMP.
+func decodeAck(r io.Reader, packetType byte, version byte, packetID *uint16, reasonCode *byte, properties *Properties) error {
+	_, body, err := readBody(r, packetType)
+	if err != nil {
+		return err
+	}
+
+	d := newDecoder(packetType, body)
+	*packetID = d.uint16("packet identifier")
+	*reasonCode, *properties = ReasonSuccess, Properties{}
+	if version >= Version5 {
+		*reasonCode, *properties = d.reasonCodeAndProperties(packetType)
+	}
+	return d.finish()
+}
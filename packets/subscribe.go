@@ -0,0 +1,265 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// Subscription is a pair of a Topic Filter and its requested QoS in SUBSCRIBE.
+type Subscription struct {
+	TopicFilter string
+	QoS         byte
+
+	// The subscription options below are only present in MQTT 5.0.
+
+	// NoLocal means that messages must not be forwarded to the client which
+	// published them.
+	NoLocal bool
+	// RetainAsPublished means that the RETAIN flag of forwarded messages is
+	// kept as published.
+	RetainAsPublished bool
+	// RetainHandling is whether retained messages are sent when the
+	// subscription is established. See the RetainHandling constants.
+	RetainHandling byte
+}
+
+// Retain Handling options of MQTT 5.0
+const (
+	// RetainHandlingSend sends retained messages at the time of the subscribe.
+	RetainHandlingSend byte = 0
+	// RetainHandlingSendIfNew sends retained messages only if the
+	// subscription does not exist yet.
+	RetainHandlingSendIfNew byte = 1
+	// RetainHandlingDoNotSend does not send retained messages.
+	RetainHandlingDoNotSend byte = 2
+)
+
+// Subscribe is the SUBSCRIBE packet, sent by a client to create subscriptions.
+type Subscribe struct {
+	PacketID uint16
+	// Properties is only present in MQTT 5.0.
+	Properties    Properties
+	Subscriptions []Subscription
+}
+
+func (p *Subscribe) Type() byte { return SUBSCRIBE }
+
+func (p *Subscribe) Encode(w io.Writer, version byte) error {
+	e := &encoder{}
+	e.uint16(p.PacketID)
+	if version >= Version5 {
+		e.properties(&p.Properties)
+	}
+	for _, sub := range p.Subscriptions {
+		if sub.QoS > 2 {
+			return fmt.Errorf("%w: %d", ErrInvalidQoS, sub.QoS)
+		}
+		options := sub.QoS
+		if version >= Version5 {
+			if sub.NoLocal {
+				options |= 0x04
+			}
+			if sub.RetainAsPublished {
+				options |= 0x08
+			}
+			options |= sub.RetainHandling << 4
+		}
+		e.string(sub.TopicFilter)
+		e.byte(options)
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	return writePacket(w, SUBSCRIBE, requiredFlags[SUBSCRIBE], e.buf)
+}
+
+func (p *Subscribe) Decode(r io.Reader, version byte) error {
+	_, body, err := readBody(r, SUBSCRIBE)
+	if err != nil {
+		return err
+	}
+
+	d := newDecoder(SUBSCRIBE, body)
+	p.PacketID = d.uint16("packet identifier")
+	p.Properties = Properties{}
+	if version >= Version5 {
+		p.Properties = d.properties(SUBSCRIBE)
+	}
+	p.Subscriptions = nil
+	for d.err == nil && d.remaining() > 0 {
+		filter := d.string("topic filter")
+		options := d.byte("subscription options")
+		if d.err != nil {
+			break
+		}
+
+		// The bits which are not used by the protocol version are reserved
+		reserved := byte(0xFC)
+		if version >= Version5 {
+			reserved = 0xC0
+		}
+		sub := Subscription{
+			TopicFilter:       filter,
+			QoS:               options & 0x03,
+			NoLocal:           options&0x04 != 0,
+			RetainAsPublished: options&0x08 != 0,
+			RetainHandling:    (options >> 4) & 0x03,
+		}
+		if options&reserved != 0 || sub.QoS > 2 || sub.RetainHandling > 2 {
+			return fmt.Errorf("%w: SUBSCRIBE subscription options 0x%02X", ErrMalformedPacket, options)
+		}
+		p.Subscriptions = append(p.Subscriptions, sub)
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	if len(p.Subscriptions) == 0 {
+		return fmt.Errorf("%w: SUBSCRIBE has no topic filters", ErrProtocolViolation)
+	}
+
+	return nil
+}
+
+// SUBACK return codes of MQTT 3.1.1. MQTT 5.0 uses the Reason Codes instead.
+const (
+	SubackMaxQoS0 byte = 0x00
+	SubackMaxQoS1 byte = 0x01
+	SubackMaxQoS2 byte = 0x02
+	SubackFailure byte = 0x80
+)
+
+// Suback is the SUBACK packet, the response to SUBSCRIBE.
+type Suback struct {
+	PacketID uint16
+	// Properties is only present in MQTT 5.0.
+	Properties Properties
+	// ReturnCodes are the Reason Codes in MQTT 5.0.
+	ReturnCodes []byte
+}
+
+func (p *Suback) Type() byte { return SUBACK }
+
+func (p *Suback) Encode(w io.Writer, version byte) error {
+	e := &encoder{}
+	e.uint16(p.PacketID)
+	if version >= Version5 {
+		e.properties(&p.Properties)
+	}
+	e.raw(p.ReturnCodes)
+	if e.err != nil {
+		return e.err
+	}
+
+	return writePacket(w, SUBACK, 0, e.buf)
+}
+
+func (p *Suback) Decode(r io.Reader, version byte) error {
+	_, body, err := readBody(r, SUBACK)
+	if err != nil {
+		return err
+	}
+
+	d := newDecoder(SUBACK, body)
+	p.PacketID = d.uint16("packet identifier")
+	p.Properties = Properties{}
+	if version >= Version5 {
+		p.Properties = d.properties(SUBACK)
+	}
+	p.ReturnCodes = d.rest()
+	return d.finish()
+}
+
+// Unsubscribe is the UNSUBSCRIBE packet, sent by a client to remove subscriptions.
+type Unsubscribe struct {
+	PacketID uint16
+	// Properties is only present in MQTT 5.0.
+	Properties   Properties
+	TopicFilters []string
+}
+
+func (p *Unsubscribe) Type() byte { return UNSUBSCRIBE }
+
+func (p *Unsubscribe) Encode(w io.Writer, version byte) error {
+	e := &encoder{}
+	e.uint16(p.PacketID)
+	if version >= Version5 {
+		e.properties(&p.Properties)
+	}
+	for _, filter := range p.TopicFilters {
+		e.string(filter)
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	return writePacket(w, UNSUBSCRIBE, requiredFlags[UNSUBSCRIBE], e.buf)
+}
+
+func (p *Unsubscribe) Decode(r io.Reader, version byte) error {
+	_, body, err := readBody(r, UNSUBSCRIBE)
+	if err != nil {
+		return err
+	}
+
+	d := newDecoder(UNSUBSCRIBE, body)
+	p.PacketID = d.uint16("packet identifier")
+	p.Properties = Properties{}
+	if version >= Version5 {
+		p.Properties = d.properties(UNSUBSCRIBE)
+	}
+	p.TopicFilters = nil
+	for d.err == nil && d.remaining() > 0 {
+		p.TopicFilters = append(p.TopicFilters, d.string("topic filter"))
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	if len(p.TopicFilters) == 0 {
+		return fmt.Errorf("%w: UNSUBSCRIBE has no topic filters", ErrProtocolViolation)
+	}
+
+	return nil
+}
+
+// Unsuback is the UNSUBACK packet, the response to UNSUBSCRIBE.
+type Unsuback struct {
+	PacketID uint16
+	// Properties and ReasonCodes are only present in MQTT 5.0. ReasonCodes
+	// has one Reason Code for each Topic Filter in UNSUBSCRIBE.
+	Properties  Properties
+	ReasonCodes []byte
+}
+
+func (p *Unsuback) Type() byte { return UNSUBACK }
+
+func (p *Unsuback) Encode(w io.Writer, version byte) error {
+	e := &encoder{}
+	e.uint16(p.PacketID)
+	if version >= Version5 {
+		e.properties(&p.Properties)
+		e.raw(p.ReasonCodes)
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	return writePacket(w, UNSUBACK, 0, e.buf)
+}
+
+func (p *Unsuback) Decode(r io.Reader, version byte) error {
+	_, body, err := readBody(r, UNSUBACK)
+	if err != nil {
+		return err
+	}
+
+	d := newDecoder(UNSUBACK, body)
+	p.PacketID = d.uint16("packet identifier")
+	p.Properties = Properties{}
+	p.ReasonCodes = nil
+	if version >= Version5 {
+		p.Properties = d.properties(UNSUBACK)
+		p.ReasonCodes = d.rest()
+	}
+	return d.finish()
+}
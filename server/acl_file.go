@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ACLFile is a Hook which allows the clients to publish and subscribe only to
+// the topics granted in the ACL file. The file is a subset of the ACL file of
+// Mosquitto:
+//
+//	# Granted to every client
+//	topic read public/#
+//	# Granted to the clients connected with the User Name "alice"
+//	user alice
+//	topic readwrite sensors/alice/#
+//	# Granted to every client, with %u replaced by the User Name and %c by the
+//	# Client Identifier
+//	pattern write devices/%c/status
+//
+// The access is read, write or readwrite, which is the default. The topic
+// lines before the first user line apply to every client. Empty lines and
+// lines starting with "#" are ignored. Anything not granted is denied.
+type ACLFile struct {
+	HookBase
+
+	// common are the rules for every client, and users are the rules for the
+	// user names
+	common   []aclRule
+	users    map[string][]aclRule
+	patterns []aclRule
+}
+
+// aclRule grants the access to the topics matching the filter.
+type aclRule struct {
+	filter string
+	read   bool
+	write  bool
+}
+
+// LoadACLFile reads the ACL file at the path.
+func LoadACLFile(path string) (*ACLFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &ACLFile{users: make(map[string][]aclRule)}
+	// user is the user of the lines read, or nil before the first user line
+	var user *string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyword, rest, _ := strings.Cut(line, " ")
+		rest = strings.TrimSpace(rest)
+		switch keyword {
+		case "user":
+			if rest == "" {
+				return nil, fmt.Errorf("%s:%d: expected user <username>", path, lineNumber)
+			}
+			user = &rest
+		case "topic", "pattern":
+			rule, err := parseACLRule(rest)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+			}
+			switch {
+			case keyword == "pattern":
+				f.patterns = append(f.patterns, rule)
+			case user == nil:
+				f.common = append(f.common, rule)
+			default:
+				f.users[*user] = append(f.users[*user], rule)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown keyword %q", path, lineNumber, keyword)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseACLRule parses "[read|write|readwrite] <topic filter>".
+func parseACLRule(s string) (aclRule, error) {
+	rule := aclRule{read: true, write: true}
+	if access, filter, ok := strings.Cut(s, " "); ok {
+		switch access {
+		case "read":
+			rule.write = false
+		case "write":
+			rule.read = false
+		case "readwrite":
+		default:
+			return aclRule{}, fmt.Errorf("unknown access %q", access)
+		}
+		s = strings.TrimSpace(filter)
+	}
+	if err := validateTopicFilter(s, 0); err != nil {
+		return aclRule{}, fmt.Errorf("invalid topic filter %q: %w", s, err)
+	}
+	rule.filter = s
+	return rule, nil
+}
+
+// OnACLCheck allows the topic if a rule for the client grants the access. A
+// topic filter to subscribe to must be covered by the filter of the rule as a
+// whole, so "sensors/#" allows "sensors/+/temperature" but "sensors/+" does
+// not allow "sensors/#".
+func (f *ACLFile) OnACLCheck(client *Client, topic string, write bool) bool {
+	if !write {
+		// The share name does not matter to the access
+		_, topic, _ = parseSharedFilter(topic)
+	}
+	allows := func(rule aclRule, filter string) bool {
+		return (write && rule.write || !write && rule.read) && aclFilterCovers(filter, topic)
+	}
+
+	username := client.Username()
+	for _, rule := range f.common {
+		if allows(rule, rule.filter) {
+			return true
+		}
+	}
+	if username != "" {
+		for _, rule := range f.users[username] {
+			if allows(rule, rule.filter) {
+				return true
+			}
+		}
+	}
+	for _, rule := range f.patterns {
+		filter, ok := expandACLPattern(rule.filter, username, string(client.ID))
+		if ok && allows(rule, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandACLPattern replaces %u in the filter by the user name and %c by the
+// Client Identifier. It returns false if they are needed but empty, or
+// contain characters which would change the levels of the filter.
+func expandACLPattern(filter string, username string, clientID string) (string, bool) {
+	for _, r := range []struct {
+		placeholder string
+		value       string
+	}{{"%u", username}, {"%c", clientID}} {
+		if !strings.Contains(filter, r.placeholder) {
+			continue
+		}
+		if r.value == "" || strings.ContainsAny(r.value, "/+#") {
+			return "", false
+		}
+		filter = strings.ReplaceAll(filter, r.placeholder, r.value)
+	}
+	return filter, true
+}
+
+// aclFilterCovers reports whether every topic name matched by the topic
+// filter topic is matched by the filter too. A topic name is covered if the
+// filter matches it. The wildcards follow the rules of TopicTree.match.
+func aclFilterCovers(filter string, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+	for i, part := range filterParts {
+		// Wildcards at the first level do not cover topics starting with "$"
+		if i == 0 && (part == "+" || part == "#") && strings.HasPrefix(topicParts[0], "$") {
+			return false
+		}
+		// "#" covers the rest, so "a/#" covers "a" too
+		if part == "#" {
+			return true
+		}
+		if i == len(topicParts) {
+			return false
+		}
+		switch topicParts[i] {
+		case "#":
+			return false
+		case "+":
+			if part != "+" {
+				return false
+			}
+		default:
+			if part != "+" && part != topicParts[i] {
+				return false
+			}
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+# everyone
+topic read public/#
+
+user alice
+topic readwrite sensors/alice/#
+topic write alerts
+
+user bob
+topic read sensors/+/temperature
+
+pattern write devices/%c/%u
+`), 0o600))
+
+	f, err := LoadACLFile(path)
+	assert.NoError(t, err)
+
+	alice := &Client{ID: "client1", username: "alice"}
+	bob := &Client{ID: "client2", username: "bob"}
+	anonymous := &Client{ID: "client3"}
+	tests := []struct {
+		client   *Client
+		topic    string
+		write    bool
+		expected bool
+	}{
+		{client: anonymous, topic: "public/news", write: false, expected: true},
+		{client: anonymous, topic: "public/#", write: false, expected: true},
+		{client: anonymous, topic: "public/news", write: true, expected: false},
+		{client: alice, topic: "public/news", write: false, expected: true},
+		{client: alice, topic: "sensors/alice", write: true, expected: true},
+		{client: alice, topic: "sensors/alice/temperature", write: true, expected: true},
+		{client: alice, topic: "sensors/+/temperature", write: false, expected: false},
+		{client: alice, topic: "$share/g/sensors/alice/#", write: false, expected: true},
+		{client: alice, topic: "alerts", write: true, expected: true},
+		{client: alice, topic: "alerts", write: false, expected: false},
+		{client: bob, topic: "sensors/alice/temperature", write: false, expected: true},
+		{client: bob, topic: "sensors/+/temperature", write: false, expected: true},
+		{client: bob, topic: "sensors/#", write: false, expected: false},
+		{client: bob, topic: "sensors/alice/temperature", write: true, expected: false},
+		{client: bob, topic: "devices/client2/bob", write: true, expected: true},
+		{client: bob, topic: "devices/client1/alice", write: true, expected: false},
+		// %u needs a User Name
+		{client: anonymous, topic: "devices/client3/", write: true, expected: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, f.OnACLCheck(tt.client, tt.topic, tt.write), "%s %s write=%v", tt.client.username, tt.topic, tt.write)
+	}
+
+	t.Run("reports invalid lines", func(t *testing.T) {
+		for _, content := range []string{"user\n", "topic\n", "topic delete a/b\n", "topic a/#/b\n", "group admins\n"} {
+			assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+			_, err := LoadACLFile(path)
+			assert.Error(t, err, content)
+		}
+	})
+}
+
+func TestACLFileHook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl")
+	assert.NoError(t, os.WriteFile(path, []byte("user alice\ntopic read a/#\n"), 0o600))
+	f, err := LoadACLFile(path)
+	assert.NoError(t, err)
+	handler, err := NewHandlerWithOptions(Options{Hooks: []Hook{f}})
+	assert.NoError(t, err)
+
+	// The topics are authorized by the User Name of the latest CONNECT, even
+	// if the session is resumed
+	subscribe := &packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "a/b"}}}
+	for _, tt := range []struct {
+		username   string
+		returnCode byte
+	}{
+		{username: "alice", returnCode: 0},
+		{username: "bob", returnCode: packets.ReasonNotAuthorized},
+	} {
+		received := runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "client1", UsernameFlag: true, Username: tt.username,
+				Properties: packets.Properties{SessionExpiryInterval: packets.Uint32(10)}},
+			subscribe,
+			&packets.Disconnect{},
+		)
+		assert.Equal(t, &packets.Suback{PacketID: 1, ReturnCodes: []byte{tt.returnCode}}, received[1], tt.username)
+	}
+}
+
+func TestACLFilterCovers(t *testing.T) {
+	tests := []struct {
+		filter   string
+		topic    string
+		expected bool
+	}{
+		{filter: "a/b", topic: "a/b", expected: true},
+		{filter: "a/b", topic: "a/c", expected: false},
+		{filter: "a/b", topic: "a/b/c", expected: false},
+		{filter: "a/+", topic: "a/b", expected: true},
+		{filter: "a/+", topic: "a/+", expected: true},
+		{filter: "a/+", topic: "a/#", expected: false},
+		{filter: "a/b", topic: "a/+", expected: false},
+		{filter: "a/#", topic: "a", expected: true},
+		{filter: "a/#", topic: "a/+/c", expected: true},
+		{filter: "a/#", topic: "a/#", expected: true},
+		{filter: "#", topic: "$SYS/uptime", expected: false},
+		{filter: "+/uptime", topic: "$SYS/uptime", expected: false},
+		{filter: "$SYS/#", topic: "$SYS/uptime", expected: true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, aclFilterCovers(tt.filter, tt.topic), "%s covers %s", tt.filter, tt.topic)
+	}
+}
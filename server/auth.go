@@ -0,0 +1,50 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+)
+
+// Authenticator checks the credentials in CONNECT. username and password are
+// empty if the client does not send them.
+type Authenticator interface {
+	// Authenticate returns nil if the client may connect. Otherwise it
+	// returns ErrBadUsernameOrPassword, ErrNotAuthorized, or any other error
+	// if the credentials could not be checked.
+	Authenticate(clientID string, username string, password []byte) error
+}
+
+var (
+	// ErrBadUsernameOrPassword rejects the client with CONNACK Bad User Name
+	// or Password.
+	ErrBadUsernameOrPassword = errors.New("bad user name or password")
+	// ErrNotAuthorized rejects the client with CONNACK Not Authorized.
+	ErrNotAuthorized = errors.New("not authorized")
+)
+
+// Authenticators tries the authenticators in order, and a client is
+// authenticated by the first one which accepts it. A client unknown to all of
+// them is rejected with ErrBadUsernameOrPassword.
+type Authenticators []Authenticator
+
+func (as Authenticators) Authenticate(clientID string, username string, password []byte) error {
+	for _, a := range as {
+		err := a.Authenticate(clientID, username, password)
+		if err == nil || !errors.Is(err, ErrBadUsernameOrPassword) {
+			return err
+		}
+	}
+	return ErrBadUsernameOrPassword
+}
+
+// StaticUsers authenticates the clients by the user names and the passwords
+// in the map.
+type StaticUsers map[string]string
+
+func (u StaticUsers) Authenticate(clientID string, username string, password []byte) error {
+	expected, ok := u[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), password) != 1 {
+		return ErrBadUsernameOrPassword
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
+)
+
+type ClientID string
+
+// Client holds the state of a client identified by ClientID. It outlives the
+// network connection so that unacknowledged messages can be retransmitted
+// when the client reconnects.
+type Client struct {
+	ID ClientID
+
+	mu           sync.Mutex
+	lastPacketID uint16
+	// inflight holds the outgoing QoS 1 and QoS 2 messages which are not
+	// acknowledged yet, and inflightOrder keeps their packet identifiers in the
+	// order they were sent.
+	inflight      map[uint16]*InflightMessage
+	inflightOrder []uint16
+	// queue holds the QoS 1 and QoS 2 messages which can not be sent yet
+	// because the client is offline or its inflight window is full, in the
+	// order they were published.
+	queue []QueuedMessage
+	// incomingQoS2 holds the QoS 2 messages received from the client which are
+	// waiting for PUBREL.
+	incomingQoS2 map[uint16]*packets.Publish
+	// timers run the session expiry and the delayed Will Message while the
+	// client is offline.
+	timers []*time.Timer
+	// receiveMaximum is the Receive Maximum of the current connection, or 0 if
+	// the client does not limit the inflight messages.
+	receiveMaximum int
+	// username is the User Name of the latest CONNECT.
+	username string
+}
+
+// InflightMessage is an outgoing message waiting for acknowledgement.
+type InflightMessage struct {
+	Publish *packets.Publish
+	// SharedGroup is the shared subscription the message was delivered
+	// through, or empty if it was delivered through a normal subscription.
+	SharedGroup string
+	// Released is true once PUBREC has been received for a QoS 2 message and
+	// PUBCOMP is the only acknowledgement left.
+	Released bool
+}
+
+// QueuedMessage is a message queued for the offline client.
+type QueuedMessage struct {
+	Publish *packets.Publish
+	// SharedGroup is the same as the one of InflightMessage.
+	SharedGroup string
+	// ExpiresAt is when the Message Expiry Interval of the message passes, or
+	// the zero time if it does not expire.
+	ExpiresAt time.Time
+}
+
+var errPacketIDExhausted = errors.New("all packet identifiers are in use")
+
+// NextPacketID returns a packet identifier which is not used by any inflight
+// message of the client.
+func (c *Client) NextPacketID() (uint16, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.nextPacketID()
+}
+
+func (c *Client) nextPacketID() (uint16, error) {
+	for i := 0; i < 65535; i++ {
+		c.lastPacketID++
+		// 0 is not a valid packet identifier
+		if c.lastPacketID == 0 {
+			c.lastPacketID = 1
+		}
+		if _, used := c.inflight[c.lastPacketID]; !used {
+			return c.lastPacketID, nil
+		}
+	}
+	return 0, errPacketIDExhausted
+}
+
+// AddInflight stores an outgoing message until it is acknowledged.
+// sharedGroup is the shared subscription the message is delivered through, or
+// empty.
+func (c *Client) AddInflight(publish *packets.Publish, sharedGroup string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.addInflight(publish, sharedGroup)
+}
+
+func (c *Client) addInflight(publish *packets.Publish, sharedGroup string) {
+	if c.inflight == nil {
+		c.inflight = make(map[uint16]*InflightMessage)
+	}
+	c.inflight[publish.PacketID] = &InflightMessage{Publish: publish, SharedGroup: sharedGroup}
+	c.inflightOrder = append(c.inflightOrder, publish.PacketID)
+}
+
+// AckInflight removes and returns the QoS 1 inflight message acknowledged by
+// PUBACK. It returns nil if there is no such message.
+func (c *Client) AckInflight(packetID uint16) *packets.Publish {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	message, ok := c.inflight[packetID]
+	if !ok || message.Publish.QoS != 1 {
+		return nil
+	}
+	c.removeInflight(packetID)
+	return message.Publish
+}
+
+// ReleaseInflight marks the QoS 2 inflight message acknowledged by PUBREC as
+// released. It returns false if there is no such message.
+func (c *Client) ReleaseInflight(packetID uint16) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	message, ok := c.inflight[packetID]
+	if !ok || message.Publish.QoS != 2 {
+		return false
+	}
+	message.Released = true
+	return true
+}
+
+// CompleteInflight removes and returns the released QoS 2 inflight message
+// acknowledged by PUBCOMP. It returns nil if there is no such message.
+func (c *Client) CompleteInflight(packetID uint16) *packets.Publish {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	message, ok := c.inflight[packetID]
+	if !ok || !message.Released {
+		return nil
+	}
+	c.removeInflight(packetID)
+	return message.Publish
+}
+
+// RemoveInflight removes the inflight message whatever its state is. It
+// returns false if there is no such message.
+func (c *Client) RemoveInflight(packetID uint16) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.inflight[packetID]; !ok {
+		return false
+	}
+	c.removeInflight(packetID)
+	return true
+}
+
+// InflightCount returns the number of the unacknowledged messages.
+func (c *Client) InflightCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.inflight)
+}
+
+// Inflight returns the unacknowledged messages in the order they were sent.
+func (c *Client) Inflight() []InflightMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	messages := make([]InflightMessage, 0, len(c.inflightOrder))
+	for _, id := range c.inflightOrder {
+		messages = append(messages, *c.inflight[id])
+	}
+	return messages
+}
+
+// RejectInflight removes the QoS 2 inflight message which the client rejected
+// with a PUBREC failure Reason Code. It returns false if there is no such
+// message.
+func (c *Client) RejectInflight(packetID uint16) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	message, ok := c.inflight[packetID]
+	if !ok || message.Publish.QoS != 2 || message.Released {
+		return false
+	}
+	c.removeInflight(packetID)
+	return true
+}
+
+func (c *Client) removeInflight(packetID uint16) {
+	delete(c.inflight, packetID)
+	for i, id := range c.inflightOrder {
+		if id == packetID {
+			c.inflightOrder = append(c.inflightOrder[:i], c.inflightOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// StoreIncomingQoS2 stores a QoS 2 message received from the client with the
+// packet identifier until PUBREL arrives. It returns false if a message with
+// the same packet identifier is already stored, which means the PUBLISH is a
+// duplicate.
+func (c *Client) StoreIncomingQoS2(packetID uint16, publish *packets.Publish) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.incomingQoS2[packetID]; exists {
+		return false
+	}
+	if c.incomingQoS2 == nil {
+		c.incomingQoS2 = make(map[uint16]*packets.Publish)
+	}
+	c.incomingQoS2[packetID] = publish
+	return true
+}
+
+// ReleaseIncomingQoS2 removes and returns the QoS 2 message released by
+// PUBREL. It returns nil if the message has already been released.
+func (c *Client) ReleaseIncomingQoS2(packetID uint16) *packets.Publish {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	publish := c.incomingQoS2[packetID]
+	delete(c.incomingQoS2, packetID)
+	return publish
+}
+
+// Enqueue queues a message until it can be sent. sharedGroup is the same as
+// the one of AddInflight. It returns false if the queue already holds
+// maxQueued messages which have not expired. maxQueued 0 or less means no limit.
+func (c *Client) Enqueue(publish *packets.Publish, sharedGroup string, maxQueued int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if maxQueued > 0 && len(c.queue) >= maxQueued {
+		c.dropExpired(now)
+		if len(c.queue) >= maxQueued {
+			return false
+		}
+	}
+	c.queue = append(c.queue, QueuedMessage{
+		Publish:     publish,
+		SharedGroup: sharedGroup,
+		ExpiresAt:   messageExpiry(publish, now),
+	})
+	return true
+}
+
+// dropExpired discards the queued messages whose Message Expiry Interval has
+// passed.
+func (c *Client) dropExpired(now time.Time) {
+	queue := c.queue[:0]
+	for _, message := range c.queue {
+		if message.ExpiresAt.IsZero() || message.ExpiresAt.After(now) {
+			queue = append(queue, message)
+		}
+	}
+	c.queue = queue
+}
+
+// DequeueInflight moves the queued messages to inflight as long as fewer than
+// maxInflight messages are inflight, and returns them in the order they were
+// queued. maxInflight 0 means no limit. The messages are given packet
+// identifiers and the time left until they expire, so they are ready to be
+// sent. The expired messages are discarded.
+func (c *Client) DequeueInflight(maxInflight int) []*packets.Publish {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	dequeued := make([]*packets.Publish, 0)
+	for len(c.queue) > 0 && (maxInflight == 0 || len(c.inflight) < maxInflight) {
+		message := c.queue[0]
+		publish, ok := withRemainingExpiry(message.Publish, message.ExpiresAt, now)
+		if !ok {
+			c.queue = c.queue[1:]
+			continue
+		}
+		packetID, err := c.nextPacketID()
+		if err != nil {
+			break
+		}
+		c.queue = c.queue[1:]
+		publish.PacketID = packetID
+		c.addInflight(publish, message.SharedGroup)
+		dequeued = append(dequeued, publish)
+	}
+	return dequeued
+}
+
+// Queued returns the queued messages in the order they were queued.
+func (c *Client) Queued() []QueuedMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]QueuedMessage{}, c.queue...)
+}
+
+// RemoveQueued removes the queued message. It returns false if the message is
+// no longer queued.
+func (c *Client) RemoveQueued(publish *packets.Publish) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, message := range c.queue {
+		if message.Publish == publish {
+			c.queue = append(c.queue[:i:i], c.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// PendingCount returns the number of the messages which are inflight or
+// queued.
+func (c *Client) PendingCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.inflight) + len(c.queue)
+}
+
+// SetReceiveMaximum sets the Receive Maximum of the connection the client is
+// connected with. 0 means no limit.
+func (c *Client) SetReceiveMaximum(receiveMaximum int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.receiveMaximum = receiveMaximum
+}
+
+// ReceiveMaximum returns the Receive Maximum set by SetReceiveMaximum.
+func (c *Client) ReceiveMaximum() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.receiveMaximum
+}
+
+// Username returns the User Name the client connected with, or empty if it
+// did not send one.
+func (c *Client) Username() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.username
+}
+
+func (c *Client) setUsername(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.username = username
+}
+
+// Schedule runs f after d unless CancelScheduled is called before that.
+func (c *Client) Schedule(d time.Duration, f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timers = append(c.timers, time.AfterFunc(d, f))
+}
+
+// CancelScheduled stops the functions scheduled by Schedule, which is done
+// when the client reconnects.
+func (c *Client) CancelScheduled() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, timer := range c.timers {
+		timer.Stop()
+	}
+	c.timers = nil
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"sync"
+)
+
+type ClientManager struct {
+	clients map[ClientID]*Connection
+	// sessions holds the state of every client which has ever connected
+	sessions map[ClientID]*Client
+	mu       sync.Mutex
+}
+
+func NewClientManager() *ClientManager {
+	return &ClientManager{
+		clients:  make(map[ClientID]*Connection),
+		sessions: make(map[ClientID]*Client),
+	}
+}
+
+// LoadSession returns the client state for the id if it exists.
+func (cm *ClientManager) LoadSession(id ClientID) (*Client, bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	client, ok := cm.sessions[id]
+	return client, ok
+}
+
+// StoreSession makes the client state the session of its id. It returns the
+// state which is replaced, or nil if there is none or it is the same.
+func (cm *ClientManager) StoreSession(client *Client) (replaced *Client) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	replaced = cm.sessions[client.ID]
+	cm.sessions[client.ID] = client
+	if replaced == client {
+		return nil
+	}
+	return replaced
+}
+
+// Add registers the connection as the current connection of the client. If
+// the client is already connected, the existing connection is atomically
+// replaced and returned as taken so that the caller can close it.
+func (cm *ClientManager) Add(client *Client, connection *Connection) (taken *Connection) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	taken = cm.clients[client.ID]
+	cm.clients[client.ID] = connection
+	return taken
+}
+
+// Remove removes the connection of the client. It returns false if the
+// connection is no longer the current one because another connection has
+// taken it over.
+func (cm *ClientManager) Remove(client *Client, connection *Connection) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.clients[client.ID] != connection {
+		return false
+	}
+	delete(cm.clients, client.ID)
+	return true
+}
+
+// DeleteSession discards the state of the client.
+func (cm *ClientManager) DeleteSession(client *Client) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.sessions[client.ID] == client {
+		delete(cm.sessions, client.ID)
+	}
+}
+
+// DeleteSessionIfOffline discards the state of the client unless the client
+// is connected. It returns true if the state was discarded.
+func (cm *ClientManager) DeleteSessionIfOffline(client *Client) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if _, online := cm.clients[client.ID]; online || cm.sessions[client.ID] != client {
+		return false
+	}
+	delete(cm.sessions, client.ID)
+	return true
+}
+
+// Sessions returns the states of all the clients, online or offline.
+func (cm *ClientManager) Sessions() []*Client {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	clients := make([]*Client, 0, len(cm.sessions))
+	for _, client := range cm.sessions {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Get returns the handle to send packets to the client, or nil if the client
+// is offline.
+func (cm *ClientManager) Get(client *Client) Sender {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	connection, ok := cm.clients[client.ID]
+	if !ok {
+		return nil
+	}
+	return connection
+}
+
+func (cm *ClientManager) List() []ClientID {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	clientIDs := make([]ClientID, 0)
+	for client := range cm.clients {
+		clientIDs = append(clientIDs, client)
+	}
+
+	return clientIDs
+}
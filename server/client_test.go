@@ -0,0 +1,140 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientNextPacketID(t *testing.T) {
+	t.Run("skips 0 and the identifiers of inflight messages", func(t *testing.T) {
+		client := &Client{ID: "client1", lastPacketID: 65534}
+		client.AddInflight(&packets.Publish{QoS: 1, PacketID: 1}, "")
+
+		id, err := client.NextPacketID()
+		assert.NoError(t, err)
+		assert.Equal(t, uint16(65535), id)
+
+		id, err = client.NextPacketID()
+		assert.NoError(t, err)
+		assert.Equal(t, uint16(2), id)
+	})
+
+	t.Run("returns an error when all identifiers are in use", func(t *testing.T) {
+		client := &Client{ID: "client1"}
+		for i := 1; i <= 65535; i++ {
+			client.AddInflight(&packets.Publish{QoS: 1, PacketID: uint16(i)}, "")
+		}
+
+		_, err := client.NextPacketID()
+		assert.ErrorIs(t, err, errPacketIDExhausted)
+	})
+}
+
+func TestClientInflight(t *testing.T) {
+	client := &Client{ID: "client1"}
+	client.AddInflight(&packets.Publish{QoS: 1, PacketID: 1}, "")
+	client.AddInflight(&packets.Publish{QoS: 1, PacketID: 2}, "")
+	client.AddInflight(&packets.Publish{QoS: 1, PacketID: 3}, "")
+
+	assert.NotNil(t, client.AckInflight(2))
+	assert.Nil(t, client.AckInflight(2))
+
+	// The remaining messages keep the order they were sent
+	inflight := client.Inflight()
+	assert.Len(t, inflight, 2)
+	assert.Equal(t, uint16(1), inflight[0].Publish.PacketID)
+	assert.Equal(t, uint16(3), inflight[1].Publish.PacketID)
+}
+
+func TestClientInflightQoS2(t *testing.T) {
+	client := &Client{ID: "client1"}
+	client.AddInflight(&packets.Publish{QoS: 2, PacketID: 1}, "")
+
+	// PUBACK and PUBCOMP are not valid before PUBREC
+	assert.Nil(t, client.AckInflight(1))
+	assert.Nil(t, client.CompleteInflight(1))
+
+	assert.True(t, client.ReleaseInflight(1))
+	assert.Equal(t, []InflightMessage{{Publish: &packets.Publish{QoS: 2, PacketID: 1}, Released: true}}, client.Inflight())
+
+	assert.NotNil(t, client.CompleteInflight(1))
+	assert.Empty(t, client.Inflight())
+
+	// PUBREC with a failure Reason Code ends the flow before it is released
+	client.AddInflight(&packets.Publish{QoS: 2, PacketID: 2}, "")
+	assert.True(t, client.RejectInflight(2))
+	assert.Empty(t, client.Inflight())
+	assert.False(t, client.RejectInflight(2))
+}
+
+func TestClientIncomingQoS2(t *testing.T) {
+	client := &Client{ID: "client1"}
+	publish := &packets.Publish{QoS: 2, PacketID: 1, TopicName: "a"}
+
+	assert.True(t, client.StoreIncomingQoS2(1, publish))
+	assert.False(t, client.StoreIncomingQoS2(1, publish), "Expected a duplicate to be detected")
+
+	assert.Equal(t, publish, client.ReleaseIncomingQoS2(1))
+	assert.Nil(t, client.ReleaseIncomingQoS2(1))
+}
+
+func TestClientQueue(t *testing.T) {
+	t.Run("rejects messages when the queue is full", func(t *testing.T) {
+		client := &Client{ID: "client1"}
+		for i := 0; i < 3; i++ {
+			assert.True(t, client.Enqueue(&packets.Publish{QoS: 1, TopicName: "a"}, "", 3))
+		}
+		assert.False(t, client.Enqueue(&packets.Publish{QoS: 1, TopicName: "a"}, "", 3), "Expected the full queue to reject the message")
+
+		assert.Len(t, client.DequeueInflight(0), 3)
+		assert.Empty(t, client.DequeueInflight(0))
+	})
+
+	t.Run("does not limit the queue with -1", func(t *testing.T) {
+		client := &Client{ID: "client1"}
+		for i := 0; i < 3; i++ {
+			assert.True(t, client.Enqueue(&packets.Publish{QoS: 1, TopicName: "a"}, "", -1))
+		}
+		assert.Len(t, client.Queued(), 3)
+	})
+
+	t.Run("dequeues messages within the inflight window", func(t *testing.T) {
+		client := &Client{ID: "client1"}
+		client.AddInflight(&packets.Publish{QoS: 1, PacketID: 1, TopicName: "a"}, "")
+		for _, topic := range []string{"b", "c", "d"} {
+			assert.True(t, client.Enqueue(&packets.Publish{QoS: 1, TopicName: topic}, "", 0))
+		}
+
+		assert.Equal(t, []*packets.Publish{{QoS: 1, PacketID: 2, TopicName: "b"}}, client.DequeueInflight(2))
+		assert.Empty(t, client.DequeueInflight(2))
+		assert.Equal(t, 2, client.InflightCount())
+
+		assert.NotNil(t, client.AckInflight(1))
+		assert.NotNil(t, client.AckInflight(2))
+		assert.Equal(t, []*packets.Publish{
+			{QoS: 1, PacketID: 3, TopicName: "c"},
+			{QoS: 1, PacketID: 4, TopicName: "d"},
+		}, client.DequeueInflight(2))
+	})
+
+	t.Run("discards expired messages", func(t *testing.T) {
+		client := &Client{ID: "client1"}
+		for _, topic := range []string{"a", "b", "c"} {
+			assert.True(t, client.Enqueue(&packets.Publish{QoS: 1, TopicName: topic, Properties: packets.Properties{MessageExpiryInterval: packets.Uint32(60)}}, "", 3))
+		}
+		client.queue[0].ExpiresAt = time.Now().Add(-time.Second)
+		// The expired message makes room for a new one
+		assert.True(t, client.Enqueue(&packets.Publish{QoS: 1, TopicName: "d"}, "", 3))
+		client.queue[0].ExpiresAt = time.Now().Add(-time.Second)
+		client.queue[1].ExpiresAt = time.Now().Add(30 * time.Second)
+
+		// The Message Expiry Interval is counted down to the time left
+		assert.Equal(t, []*packets.Publish{
+			{QoS: 1, PacketID: 1, TopicName: "c", Properties: packets.Properties{MessageExpiryInterval: packets.Uint32(30)}},
+			{QoS: 1, PacketID: 2, TopicName: "d"},
+		}, client.DequeueInflight(0))
+	})
+}
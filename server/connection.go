@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
+)
+
+// Sender sends packets to a client. It is safe for concurrent use, so any
+// goroutine can send messages to the client through it.
+type Sender interface {
+	// Send queues the packet to be written to the client.
+	Send(packet packets.Packet) error
+	// Version returns the protocol level negotiated by CONNECT.
+	Version() byte
+}
+
+// SlowConsumerPolicy decides what happens when a message is sent to a client
+// whose outbound queue is full.
+type SlowConsumerPolicy string
+
+const (
+	// SlowConsumerDropOldest drops the oldest message in the queue to make
+	// room for the new one.
+	SlowConsumerDropOldest SlowConsumerPolicy = "drop-oldest"
+	// SlowConsumerDropNewest drops the new message.
+	SlowConsumerDropNewest SlowConsumerPolicy = "drop-newest"
+	// SlowConsumerDisconnect closes the connection. The session of the client
+	// is kept as on any abnormal close.
+	SlowConsumerDisconnect SlowConsumerPolicy = "disconnect"
+)
+
+// Valid reports whether the policy is one of the known policies.
+func (p SlowConsumerPolicy) Valid() bool {
+	switch p {
+	case SlowConsumerDropOldest, SlowConsumerDropNewest, SlowConsumerDisconnect:
+		return true
+	}
+	return false
+}
+
+var (
+	// errConnectionClosed is returned when sending to a closed connection.
+	errConnectionClosed = errors.New("connection is closed")
+	// errOutboundQueueFull is returned when the new message is dropped
+	// because the outbound queue is full.
+	errOutboundQueueFull = errors.New("outbound queue is full")
+	// errSlowConsumer is returned when the connection is closed because the
+	// outbound queue is full.
+	errSlowConsumer = errors.New("connection closed because the outbound queue is full")
+)
+
+// writeTimeout is how long the writer waits for the client to accept the
+// queued packets before the connection is closed.
+const writeTimeout = 30 * time.Second
+
+// Connection is a network connection of a client. Packets are read by the
+// goroutine handling the connection. Packets to be sent are encoded and queued
+// by Send, and written by a writer goroutine which the connection owns, so that
+// a slow client does not block the goroutines sending messages to it.
+type Connection struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	// maxReceivePacketSize is the maximum size of packets accepted from the
+	// client, or 0 for no limit.
+	maxReceivePacketSize int
+
+	mu sync.Mutex
+	// version is the protocol level requested by CONNECT. Packets are encoded
+	// and decoded according to it.
+	version byte
+	// maxSendPacketSize is the maximum size of packets the client accepts,
+	// or 0 for no limit.
+	maxSendPacketSize int
+	// cond is signalled when packets are queued, written or the connection
+	// is closed.
+	cond *sync.Cond
+	// queue holds the encoded packets waiting for the writer.
+	queue []outboundPacket
+	// queuedMessages is the number of PUBLISH packets in the queue.
+	queuedMessages int
+	// maxQueuedMessages is the maximum number of PUBLISH packets in the
+	// queue, or 0 or less for no limit. The other packets are responses to the
+	// client, so they are always queued.
+	maxQueuedMessages  int
+	slowConsumerPolicy SlowConsumerPolicy
+	// onDrop is called with the messages dropped from the queue.
+	onDrop func(publish *packets.Publish)
+	// writing is true while the writer is writing packets taken from the
+	// queue.
+	writing bool
+	// closing is true once Close is called. No more packets are accepted,
+	// and the writer closes the network connection after the queue drains.
+	closing bool
+	// done is closed when the writer exits.
+	done chan struct{}
+}
+
+// outboundPacket is a packet encoded and waiting for the writer.
+type outboundPacket struct {
+	data []byte
+	// publish is set for PUBLISH packets, which may be dropped.
+	publish *packets.Publish
+}
+
+// NewConnection returns a Connection over the network connection and starts
+// its writer goroutine.
+func NewConnection(conn net.Conn) *Connection {
+	c := &Connection{
+		conn:               conn,
+		reader:             bufio.NewReader(conn),
+		writer:             bufio.NewWriter(conn),
+		slowConsumerPolicy: SlowConsumerDisconnect,
+		done:               make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.writeLoop()
+	return c
+}
+
+// SetVersion sets the protocol level negotiated by CONNECT.
+func (c *Connection) SetVersion(version byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.version = version
+}
+
+// Version returns the protocol level negotiated by CONNECT.
+func (c *Connection) Version() byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.version
+}
+
+// SetMaxReceivePacketSize sets the maximum size of packets accepted from the
+// client. 0 means no limit.
+func (c *Connection) SetMaxReceivePacketSize(size int) {
+	c.maxReceivePacketSize = size
+}
+
+// SetMaxSendPacketSize sets the maximum size of packets the client accepts,
+// which an MQTT 5.0 client tells with Maximum Packet Size. 0 means no limit.
+func (c *Connection) SetMaxSendPacketSize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxSendPacketSize = size
+}
+
+// SetOutboundQueue sets the maximum number of messages waiting to be written
+// to the client, and what happens when a message is sent while the queue is
+// full. maxQueuedMessages 0 or less means no limit. onDrop is called with the messages
+// dropped by the policy.
+func (c *Connection) SetOutboundQueue(maxQueuedMessages int, policy SlowConsumerPolicy, onDrop func(publish *packets.Publish)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxQueuedMessages = maxQueuedMessages
+	c.slowConsumerPolicy = policy
+	c.onDrop = onDrop
+}
+
+// Receive reads the next packet from the connection. It returns
+// packets.ErrPacketTooLarge before reading a packet larger than the maximum
+// receive packet size.
+func (c *Connection) Receive() (packets.Packet, error) {
+	return packets.ReadPacketWithLimit(c.reader, c.Version(), c.maxReceivePacketSize)
+}
+
+// Send encodes the packet and queues it for the writer. It returns
+// packets.ErrPacketTooLarge without queueing anything if the packet is larger
+// than the maximum send packet size. If the queue is full of messages, the
+// slow consumer policy applies.
+func (c *Connection) Send(packet packets.Packet) error {
+	c.mu.Lock()
+	version, maxSendPacketSize := c.version, c.maxSendPacketSize
+	c.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := packet.Encode(&buf, version); err != nil {
+		return err
+	}
+	if maxSendPacketSize > 0 && buf.Len() > maxSendPacketSize {
+		return fmt.Errorf("%w: %s of %d bytes", packets.ErrPacketTooLarge, packets.PacketName(packet.Type()), buf.Len())
+	}
+	publish, _ := packet.(*packets.Publish)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return errConnectionClosed
+	}
+
+	if publish != nil && c.maxQueuedMessages > 0 && c.queuedMessages >= c.maxQueuedMessages {
+		switch c.slowConsumerPolicy {
+		case SlowConsumerDropNewest:
+			c.drop(publish)
+			return errOutboundQueueFull
+		case SlowConsumerDropOldest:
+			c.dropOldest()
+		default:
+			c.abort()
+			return errSlowConsumer
+		}
+	}
+
+	c.queue = append(c.queue, outboundPacket{data: buf.Bytes(), publish: publish})
+	if publish != nil {
+		c.queuedMessages++
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// dropOldest removes the oldest message from the queue. The caller must hold
+// the lock.
+func (c *Connection) dropOldest() {
+	for i, queued := range c.queue {
+		if queued.publish == nil {
+			continue
+		}
+		c.queue = append(c.queue[:i], c.queue[i+1:]...)
+		c.queuedMessages--
+		c.drop(queued.publish)
+		return
+	}
+}
+
+// drop tells that the message is dropped. The caller must hold the lock.
+func (c *Connection) drop(publish *packets.Publish) {
+	if c.onDrop != nil {
+		c.onDrop(publish)
+	}
+}
+
+// abort discards the queue and closes the network connection immediately.
+// The caller must hold the lock.
+func (c *Connection) abort() {
+	c.closing = true
+	c.queue = nil
+	c.queuedMessages = 0
+	c.cond.Broadcast()
+	c.conn.Close()
+}
+
+// writeLoop writes the queued packets to the network connection until the
+// connection is closed.
+func (c *Connection) writeLoop() {
+	defer close(c.done)
+
+	for {
+		c.mu.Lock()
+		for len(c.queue) == 0 && !c.closing {
+			c.cond.Wait()
+		}
+		if len(c.queue) == 0 {
+			// Close was called and all the packets have been written
+			c.mu.Unlock()
+			c.conn.Close()
+			return
+		}
+		batch := c.queue
+		c.queue = nil
+		c.queuedMessages = 0
+		c.writing = true
+		c.mu.Unlock()
+
+		err := c.write(batch)
+
+		c.mu.Lock()
+		c.writing = false
+		if err != nil {
+			c.abort()
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+
+		if err != nil {
+			log.Println("Error writing packets:", err)
+			return
+		}
+	}
+}
+
+// write writes the packets and flushes them at once.
+func (c *Connection) write(batch []outboundPacket) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	for _, packet := range batch {
+		if _, err := c.writer.Write(packet.data); err != nil {
+			return err
+		}
+	}
+	return c.writer.Flush()
+}
+
+// waitIdle blocks until the writer has written all the queued packets or the
+// connection is closed.
+func (c *Connection) waitIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.queue) > 0 || c.writing {
+		c.cond.Wait()
+	}
+}
+
+// Close stops accepting packets and closes the network connection after the
+// queued packets are written. The goroutine handling the connection notices it
+// as a read error and tears down the connection.
+func (c *Connection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closing = true
+	c.cond.Broadcast()
+	return nil
+}
+
+// Wait blocks until the writer has exited after Close.
+func (c *Connection) Wait() {
+	<-c.done
+}
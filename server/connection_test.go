@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingConn is a testConn whose writes block until release is closed.
+// writing is closed when the first write starts.
+type blockingConn struct {
+	testConn
+	writing chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func newBlockingConn() *blockingConn {
+	return &blockingConn{
+		testConn: testConn{reader: &bytes.Buffer{}},
+		writing:  make(chan struct{}),
+		release:  make(chan struct{}),
+	}
+}
+
+func (c *blockingConn) Write(b []byte) (int, error) {
+	c.once.Do(func() { close(c.writing) })
+	<-c.release
+	return c.testConn.Write(b)
+}
+
+func TestConnectionSend(t *testing.T) {
+	t.Run("writes packets sent concurrently without interleaving", func(t *testing.T) {
+		conn := &testConn{reader: &bytes.Buffer{}}
+		connection := NewConnection(conn)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					payload := []byte(fmt.Sprintf("%d-%d", i, j))
+					assert.NoError(t, connection.Send(&packets.Publish{TopicName: "a/b", Payload: payload}))
+				}
+			}(i)
+		}
+		wg.Wait()
+		connection.Close()
+		connection.Wait()
+
+		count := 0
+		for conn.written.Len() > 0 {
+			_, err := packets.ReadPacket(&conn.written, packets.Version311)
+			assert.NoError(t, err)
+			count++
+		}
+		assert.Equal(t, 1000, count)
+	})
+
+	t.Run("writes the queued packets before closing", func(t *testing.T) {
+		conn := &testConn{reader: &bytes.Buffer{}}
+		connection := NewConnection(conn)
+
+		assert.NoError(t, connection.Send(&packets.Pingresp{}))
+		connection.Close()
+		assert.ErrorIs(t, connection.Send(&packets.Pingresp{}), errConnectionClosed)
+		connection.Wait()
+
+		assert.Equal(t, []byte{0xD0, 0x00}, conn.written.Bytes())
+	})
+}
+
+func TestConnectionSlowConsumer(t *testing.T) {
+	publish := func(payload string) *packets.Publish {
+		return &packets.Publish{TopicName: "a", Payload: []byte(payload)}
+	}
+
+	// fill sends the message "0", which the writer blocks on, and then the
+	// messages "1" and "2" which fill the queue of 2 messages
+	fill := func(t *testing.T, policy SlowConsumerPolicy) (*Connection, *blockingConn, *[]string) {
+		conn := newBlockingConn()
+		connection := NewConnection(conn)
+		dropped := make([]string, 0)
+		connection.SetOutboundQueue(2, policy, func(publish *packets.Publish) {
+			dropped = append(dropped, string(publish.Payload))
+		})
+
+		assert.NoError(t, connection.Send(publish("0")))
+		<-conn.writing
+		assert.NoError(t, connection.Send(publish("1")))
+		assert.NoError(t, connection.Send(publish("2")))
+		// Packets other than PUBLISH are not limited
+		assert.NoError(t, connection.Send(&packets.Pingresp{}))
+		return connection, conn, &dropped
+	}
+
+	// written returns the payloads of the messages written to the connection
+	written := func(t *testing.T, connection *Connection, conn *blockingConn) []string {
+		close(conn.release)
+		connection.Close()
+		connection.Wait()
+
+		payloads := make([]string, 0)
+		for conn.written.Len() > 0 {
+			packet, err := packets.ReadPacket(&conn.written, packets.Version311)
+			assert.NoError(t, err)
+			if publish, ok := packet.(*packets.Publish); ok {
+				payloads = append(payloads, string(publish.Payload))
+			}
+		}
+		return payloads
+	}
+
+	t.Run("drop-newest drops the new message", func(t *testing.T) {
+		connection, conn, dropped := fill(t, SlowConsumerDropNewest)
+
+		assert.ErrorIs(t, connection.Send(publish("3")), errOutboundQueueFull)
+		assert.Equal(t, []string{"3"}, *dropped)
+		assert.Equal(t, []string{"0", "1", "2"}, written(t, connection, conn))
+	})
+
+	t.Run("drop-oldest drops the oldest queued message", func(t *testing.T) {
+		connection, conn, dropped := fill(t, SlowConsumerDropOldest)
+
+		assert.NoError(t, connection.Send(publish("3")))
+		assert.Equal(t, []string{"1"}, *dropped)
+		assert.Equal(t, []string{"0", "2", "3"}, written(t, connection, conn))
+	})
+
+	t.Run("disconnect closes the connection", func(t *testing.T) {
+		connection, conn, dropped := fill(t, SlowConsumerDisconnect)
+
+		assert.ErrorIs(t, connection.Send(publish("3")), errSlowConsumer)
+		assert.ErrorIs(t, connection.Send(publish("4")), errConnectionClosed)
+		assert.Empty(t, *dropped)
+		// Only the message which was being written reaches the client
+		assert.Equal(t, []string{"0"}, written(t, connection, conn))
+	})
+}
@@ -0,0 +1,1300 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
+)
+
+type Handler struct {
+	options        Options
+	topicTree      *TopicTree
+	retainStore    *RetainStore
+	clientManager  *ClientManager
+	sharedBalancer *sharedBalancer
+	hooks          hooks
+	stats          stats
+	logger         logger
+	// connections holds the open network connections, which are closed on
+	// shutdown
+	connections  map[*Connection]struct{}
+	shuttingDown bool
+	mu           sync.Mutex
+}
+
+// NewHandler returns a Handler with the default options.
+func NewHandler() *Handler {
+	handler, err := NewHandlerWithOptions(Options{})
+	if err != nil {
+		// The default options are always valid
+		panic(err)
+	}
+	return handler
+}
+
+// NewHandlerWithOptions returns a Handler configured by the options. It
+// returns an error if the options are invalid.
+func NewHandlerWithOptions(options Options) (*Handler, error) {
+	options = options.withDefaults()
+	if options.MaxConnections < 0 {
+		return nil, fmt.Errorf("max connections must not be negative: %d", options.MaxConnections)
+	}
+	if options.MaxTopicDepth < 0 {
+		return nil, fmt.Errorf("max topic depth must not be negative: %d", options.MaxTopicDepth)
+	}
+	if options.MaxPacketSize < 0 || options.MaxPacketSize > maxPacketSizeLimit {
+		return nil, fmt.Errorf("max packet size must be between 1 and %d: %d", maxPacketSizeLimit, options.MaxPacketSize)
+	}
+	if options.MaxInflight < 0 {
+		return nil, fmt.Errorf("max inflight must not be negative: %d", options.MaxInflight)
+	}
+	if options.MaxQueuedMessages < -1 {
+		return nil, fmt.Errorf("max queued messages must be -1 for no limit or more: %d", options.MaxQueuedMessages)
+	}
+	if options.MaxOutboundQueue < -1 {
+		return nil, fmt.Errorf("max outbound queue must be -1 for no limit or more: %d", options.MaxOutboundQueue)
+	}
+	for i, hook := range options.Hooks {
+		if hook == nil {
+			return nil, fmt.Errorf("hook %d is nil", i)
+		}
+	}
+	if !options.SlowConsumerPolicy.Valid() {
+		return nil, fmt.Errorf("unknown slow consumer policy %q", options.SlowConsumerPolicy)
+	}
+	if !options.LogLevel.Valid() {
+		return nil, fmt.Errorf("unknown log level %q", options.LogLevel)
+	}
+
+	sharedBalancer, err := newSharedBalancer(options.SharedSubscriptionStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Handler{
+		options:        options,
+		topicTree:      NewTopicTree(),
+		retainStore:    NewRetainStore(),
+		clientManager:  NewClientManager(),
+		sharedBalancer: sharedBalancer,
+		hooks:          hooks(options.Hooks),
+		logger:         logger{level: options.LogLevel},
+		connections:    make(map[*Connection]struct{}),
+	}, nil
+}
+
+// connectTimeout is how long the server waits for CONNECT after a network
+// connection is established.
+const connectTimeout = 10 * time.Second
+
+func (h *Handler) Handle(conn net.Conn) {
+	// A panic caused by one connection must not crash the whole broker
+	defer func() {
+		if r := recover(); r != nil {
+			h.logger.errorf("Recovered from panic while handling connection from %s: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+		}
+	}()
+
+	connection := NewConnection(conn)
+	connection.SetMaxReceivePacketSize(h.options.MaxPacketSize)
+	// The packets queued until the end, e.g. DISCONNECT, are written before
+	// the network connection is closed
+	defer func() {
+		connection.Close()
+		connection.Wait()
+	}()
+	if !h.addConnection(connection) {
+		h.logger.infof("Rejecting connection because the server is shutting down\n")
+		return
+	}
+	defer h.removeConnection(connection)
+
+	// First packet must be CONNECT
+	conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	packet, err := connection.Receive()
+	if err != nil {
+		if errors.Is(err, packets.ErrPacketTooLarge) {
+			// The protocol version is unknown until CONNECT is decoded, so
+			// the connection is just closed
+			h.stats.inboundPacketsTooLarge.Add(1)
+		}
+		var unsupported *packets.UnsupportedProtocolError
+		if errors.As(err, &unsupported) {
+			h.logger.infof("Rejecting connection: %v\n", err)
+			// CONNACK is encoded in the requested protocol level, so that a
+			// client of a newer version can read it
+			connection.SetVersion(unsupported.ProtocolLevel)
+			h.rejectConnect(connection, packets.ConnectUnacceptableProtocolVersion, packets.ReasonUnsupportedProtocolVersion)
+			return
+		}
+		h.logger.infof("Error reading packet: %v\n", err)
+		return
+	}
+	connect, ok := packet.(*packets.Connect)
+	if !ok {
+		h.logger.infof("First packet must be CONNECT\n")
+		return
+	}
+	client := h.handleConnect(connection, connect)
+	if client == nil {
+		return
+	}
+
+	disconnect := h.serve(connection, client, keepAliveTimeout(connect.KeepAlive))
+	h.handleClose(connection, client, connect, disconnect)
+}
+
+func (h *Handler) addConnection(connection *Connection) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.shuttingDown {
+		return false
+	}
+	h.connections[connection] = struct{}{}
+	return true
+}
+
+func (h *Handler) removeConnection(connection *Connection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.connections, connection)
+}
+
+// schedule runs f after d unless the client reconnects before that. Nothing is
+// scheduled once the server is shutting down.
+func (h *Handler) schedule(client *Client, d time.Duration, f func()) {
+	// The lock is held while scheduling, so that closeConnections cancels
+	// everything scheduled before it
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.shuttingDown {
+		return
+	}
+	client.Schedule(d, f)
+}
+
+// acceptsConnection returns false if more connections than MaxConnections are
+// open, including the one being connected.
+func (h *Handler) acceptsConnection() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.options.MaxConnections == 0 || len(h.connections) <= h.options.MaxConnections
+}
+
+// closeConnections closes all the open connections, telling MQTT 5.0 clients
+// that the server is shutting down. New connections are rejected afterwards.
+// The goroutines handling the connections notice it as a read error and tear
+// down the connections. The session expiry and the delayed Will Messages of
+// the offline clients are cancelled, and no more are scheduled.
+func (h *Handler) closeConnections() {
+	h.mu.Lock()
+	h.shuttingDown = true
+	connections := make([]*Connection, 0, len(h.connections))
+	for connection := range h.connections {
+		connections = append(connections, connection)
+	}
+	h.mu.Unlock()
+
+	for _, client := range h.clientManager.Sessions() {
+		client.CancelScheduled()
+	}
+
+	for _, connection := range connections {
+		h.disconnect(connection, packets.ReasonServerShuttingDown)
+		connection.Close()
+	}
+}
+
+// keepAliveTimeout returns how long the server waits for the next packet. The
+// connection is closed if nothing is received within one and a half times the
+// Keep Alive. 0 means that the keep alive mechanism is turned off.
+func keepAliveTimeout(keepAlive uint16) time.Duration {
+	return time.Duration(keepAlive) * time.Second * 3 / 2
+}
+
+// serve processes the packets following CONNECT until the connection is
+// closed. It returns the DISCONNECT packet if the client closed the connection
+// with DISCONNECT, or nil if the connection was closed abnormally.
+func (h *Handler) serve(connection *Connection, client *Client, timeout time.Duration) (received *packets.Disconnect) {
+	// A panic while processing a packet only closes the connection of the
+	// client, and the session is handled as on an abnormal close
+	defer func() {
+		if r := recover(); r != nil {
+			h.logger.errorf("Recovered from panic while serving client %s: %v\n%s", client.ID, r, debug.Stack())
+			h.disconnect(connection, packets.ReasonImplementationSpecificError)
+			received = nil
+		}
+	}()
+
+	for {
+		var deadline time.Time
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+		connection.conn.SetReadDeadline(deadline)
+
+		packet, err := connection.Receive()
+		if err != nil {
+			switch {
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				h.logger.infof("Keep alive of client %s expired\n", client.ID)
+				h.disconnect(connection, packets.ReasonKeepAliveTimeout)
+			case errors.Is(err, io.EOF):
+				h.logger.infof("Client %s closed the connection\n", client.ID)
+			default:
+				h.logger.infof("Error reading packet from client %s: %v\n", client.ID, err)
+				if errors.Is(err, packets.ErrPacketTooLarge) {
+					h.stats.inboundPacketsTooLarge.Add(1)
+				}
+				if reasonCode, ok := readErrorReasonCode(err); ok {
+					h.disconnect(connection, reasonCode)
+				}
+			}
+			return nil
+		}
+
+		h.logger.debugf("Packet Type: %s\n", packets.PacketName(packet.Type()))
+
+		switch packet := packet.(type) {
+		case *packets.Connect:
+			err = newProtocolError(packets.ReasonProtocolError, "received CONNECT twice")
+		case *packets.Publish:
+			err = h.handlePublish(connection, client, packet)
+		case *packets.Puback:
+			err = h.handlePuback(client, packet)
+		case *packets.Pubrec:
+			err = h.handlePubrec(connection, client, packet)
+		case *packets.Pubrel:
+			err = h.handlePubrel(connection, client, packet)
+		case *packets.Pubcomp:
+			err = h.handlePubcomp(client, packet)
+		case *packets.Subscribe:
+			err = h.handleSubscribe(connection, client, packet)
+		case *packets.Unsubscribe:
+			err = h.handleUnsubscribe(connection, client, packet)
+		case *packets.Pingreq:
+			err = h.handlePingreq(connection)
+		case *packets.Disconnect:
+			h.logger.debugf("Received DISCONNECT from client %s\n", client.ID)
+			return packet
+		case *packets.Auth:
+			// Enhanced authentication is not supported, so AUTH is never expected
+			err = newProtocolError(packets.ReasonProtocolError, "received unexpected AUTH")
+		default:
+			// The packets sent only by the server
+			err = newProtocolError(packets.ReasonProtocolError, "received unexpected %s", packets.PacketName(packet.Type()))
+		}
+
+		if err != nil {
+			h.logger.infof("Closing the connection of client %s: %v\n", client.ID, err)
+			var protocolErr *protocolError
+			if errors.As(err, &protocolErr) {
+				h.disconnect(connection, protocolErr.reasonCode)
+			}
+			return nil
+		}
+	}
+}
+
+// protocolError is returned by the packet handlers when the client violates the
+// protocol. The connection is closed, and an MQTT 5.0 client is told the
+// Reason Code with DISCONNECT.
+type protocolError struct {
+	reasonCode byte
+	message    string
+}
+
+func newProtocolError(reasonCode byte, format string, args ...any) *protocolError {
+	return &protocolError{reasonCode: reasonCode, message: fmt.Sprintf(format, args...)}
+}
+
+func (e *protocolError) Error() string {
+	return fmt.Sprintf("%s (reason code: 0x%02X)", e.message, e.reasonCode)
+}
+
+// readErrorReasonCode returns the MQTT 5.0 Reason Code for the error reading a
+// packet. ok is false if the error is not caused by the content of the packet,
+// e.g. the network connection is broken.
+func readErrorReasonCode(err error) (reasonCode byte, ok bool) {
+	switch {
+	case errors.Is(err, packets.ErrPacketTooLarge):
+		return packets.ReasonPacketTooLarge, true
+	case errors.Is(err, packets.ErrProtocolViolation):
+		return packets.ReasonProtocolError, true
+	case errors.Is(err, packets.ErrMalformedPacket),
+		errors.Is(err, packets.ErrMalformedRemainingLength),
+		errors.Is(err, packets.ErrInvalidFlags),
+		errors.Is(err, packets.ErrInvalidQoS),
+		errors.Is(err, packets.ErrUnknownPacketType):
+		return packets.ReasonMalformedPacket, true
+	}
+	return 0, false
+}
+
+// topicReasonCode returns the MQTT 5.0 Reason Code for the topic validation
+// error. A topic which is not well-formed UTF-8 makes the packet malformed, and
+// the other errors are reported with reasonCode.
+func topicReasonCode(err error, reasonCode byte) byte {
+	if errors.Is(err, errTopicMalformed) {
+		return packets.ReasonMalformedPacket
+	}
+	return reasonCode
+}
+
+// disconnect tells an MQTT 5.0 client the reason why the server closes the
+// connection. Nothing is sent to older clients because they have no DISCONNECT
+// from the server. The caller closes the connection.
+func (h *Handler) disconnect(connection Sender, reasonCode byte) {
+	if connection.Version() < packets.Version5 {
+		return
+	}
+	err := connection.Send(&packets.Disconnect{ReasonCode: reasonCode})
+	if err != nil {
+		h.logger.errorf("Error sending DISCONNECT: %v\n", err)
+	}
+}
+
+// handleClose tears down the state of the client after its connection is
+// closed. disconnect is the DISCONNECT packet sent by the client, or nil if the
+// connection was closed abnormally.
+func (h *Handler) handleClose(connection *Connection, client *Client, connect *packets.Connect, disconnect *packets.Disconnect) {
+	if disconnect != nil {
+		h.logger.infof("Client %s disconnected\n", client.ID)
+	} else {
+		h.logger.infof("Connection of client %s closed abnormally\n", client.ID)
+	}
+	h.hooks.OnDisconnect(client, disconnect)
+
+	if !h.clientManager.Remove(client, connection) {
+		// The session continues on the new connection, so neither the
+		// session nor the will message is handled here
+		h.logger.infof("Connection of client %s was taken over\n", client.ID)
+		return
+	}
+
+	// The other members of the shared subscriptions take over the messages
+	// which the client has not received
+	h.redistributeShared(client)
+
+	// An MQTT 5.0 client may change the Session Expiry Interval on DISCONNECT,
+	// except from 0
+	expiry := sessionExpiryInterval(connect)
+	if disconnect != nil && disconnect.Properties.SessionExpiryInterval != nil {
+		if expiry == 0 && *disconnect.Properties.SessionExpiryInterval != 0 {
+			h.logger.infof("Ignored the Session Expiry Interval on DISCONNECT from client %s\n", client.ID)
+		} else {
+			expiry = *disconnect.Properties.SessionExpiryInterval
+		}
+	}
+
+	switch expiry {
+	case 0:
+		// The session ends with the connection, so its subscriptions and
+		// inflight messages are discarded
+		h.topicTree.RemoveClient(client)
+		h.clientManager.DeleteSession(client)
+		h.hooks.OnSessionExpired(client)
+	case sessionNeverExpires:
+		// The subscriptions are parked in the topic tree. QoS 1 and 2
+		// messages published while the client is offline are queued and sent
+		// when it reconnects.
+	default:
+		// The same as above, but the session is discarded if the client does
+		// not reconnect within the Session Expiry Interval
+		h.schedule(client, seconds(expiry), func() { h.expireSession(client) })
+	}
+
+	// The Will Message is discarded when the client disconnects with
+	// DISCONNECT, unless an MQTT 5.0 client asks to publish it
+	will := willMessage(connect)
+	if will == nil || (disconnect != nil && disconnect.ReasonCode != packets.ReasonDisconnectWithWillMessage) {
+		return
+	}
+	// The Will Message is delayed by the Will Delay Interval, but it is
+	// published when the session ends at the latest
+	delay := willDelayInterval(connect)
+	if delay > expiry {
+		delay = expiry
+	}
+	if delay == 0 {
+		h.publishWill(client, will)
+		return
+	}
+	h.schedule(client, seconds(delay), func() { h.publishWill(client, will) })
+}
+
+// redistributeShared delivers the messages sent through shared subscriptions
+// which the disconnected client has not acknowledged, or which are still
+// queued for it, to another online member of the same group. QoS 2 messages
+// already sent stay with the client, because their delivery must be completed
+// by the same client and never be repeated by another.
+func (h *Handler) redistributeShared(client *Client) {
+	for _, message := range client.Inflight() {
+		if message.SharedGroup == "" || message.Publish.QoS == 2 {
+			continue
+		}
+		member, ok := h.onlineSharedMember(message.SharedGroup, client)
+		if !ok {
+			continue
+		}
+		if !client.RemoveInflight(message.Publish.PacketID) {
+			continue
+		}
+		h.logger.debugf("Redistributing a message of %s from client %s to client %s\n",
+			message.SharedGroup, client.ID, member.Client.ID)
+		h.deliver(member, message.Publish, message.Publish.Retain, message.SharedGroup)
+	}
+
+	// The queued messages are also taken over, keeping the time left until
+	// they expire
+	now := time.Now()
+	for _, message := range client.Queued() {
+		if message.SharedGroup == "" {
+			continue
+		}
+		member, ok := h.onlineSharedMember(message.SharedGroup, client)
+		if !ok {
+			continue
+		}
+		if !client.RemoveQueued(message.Publish) {
+			continue
+		}
+		publish, ok := withRemainingExpiry(message.Publish, message.ExpiresAt, now)
+		if !ok {
+			continue
+		}
+		h.logger.debugf("Redistributing a queued message of %s from client %s to client %s\n",
+			message.SharedGroup, client.ID, member.Client.ID)
+		h.deliver(member, publish, publish.Retain, message.SharedGroup)
+	}
+}
+
+// onlineSharedMember returns an online member of the shared subscription group
+// other than the excluded client.
+func (h *Handler) onlineSharedMember(filter string, excluded *Client) (Subscriber, bool) {
+	online := make([]Subscriber, 0)
+	for _, member := range h.topicTree.GetSharedGroup(filter) {
+		if member.Client != excluded && h.clientManager.Get(member.Client) != nil {
+			online = append(online, member)
+		}
+	}
+	if len(online) == 0 {
+		return Subscriber{}, false
+	}
+	return h.sharedBalancer.pick(filter, online, nil), true
+}
+
+// expireSession discards the session of the client whose Session Expiry
+// Interval has passed while it is offline.
+func (h *Handler) expireSession(client *Client) {
+	if !h.clientManager.DeleteSessionIfOffline(client) {
+		return
+	}
+	h.logger.infof("Session of client %s expired\n", client.ID)
+	h.topicTree.RemoveClient(client)
+	h.hooks.OnSessionExpired(client)
+}
+
+func (h *Handler) publishWill(client *Client, will *packets.Publish) {
+	will, err := h.hooks.OnPublish(client, will)
+	if err != nil {
+		h.logger.infof("Will message of client %s rejected by the hooks: %v\n", client.ID, err)
+		return
+	}
+	h.logger.infof("Publishing will message of client %s to %s\n", client.ID, will.TopicName)
+	h.publishToSubscribers(nil, will)
+}
+
+// sessionNeverExpires is the Session Expiry Interval which means that the
+// session does not expire.
+const sessionNeverExpires = math.MaxUint32
+
+// sessionExpiryInterval returns the Session Expiry Interval in seconds
+// requested by CONNECT. Before MQTT 5.0, the session ends with the connection
+// if Clean Session is set, and never expires otherwise.
+func sessionExpiryInterval(connect *packets.Connect) uint32 {
+	if connect.ProtocolLevel < packets.Version5 {
+		if connect.CleanSession {
+			return 0
+		}
+		return sessionNeverExpires
+	}
+	if connect.Properties.SessionExpiryInterval == nil {
+		return 0
+	}
+	return *connect.Properties.SessionExpiryInterval
+}
+
+// willDelayInterval returns the Will Delay Interval in seconds, which is only
+// present in MQTT 5.0.
+func willDelayInterval(connect *packets.Connect) uint32 {
+	if connect.WillProperties.WillDelayInterval == nil {
+		return 0
+	}
+	return *connect.WillProperties.WillDelayInterval
+}
+
+func seconds(s uint32) time.Duration {
+	return time.Duration(s) * time.Second
+}
+
+// receiveMaximum returns the number of QoS 1 and QoS 2 messages the client is
+// willing to process at once, or 0 if it does not tell. An MQTT 5.0 client
+// which omits Receive Maximum accepts 65535 messages.
+func receiveMaximum(connect *packets.Connect) int {
+	if connect.ProtocolLevel < packets.Version5 {
+		return 0
+	}
+	if connect.Properties.ReceiveMaximum == nil {
+		return math.MaxUint16
+	}
+	return int(*connect.Properties.ReceiveMaximum)
+}
+
+// messageExpiry returns when the message received at now expires by its
+// Message Expiry Interval, or the zero time if it does not expire.
+func messageExpiry(publish *packets.Publish, now time.Time) time.Time {
+	if publish.Properties.MessageExpiryInterval == nil {
+		return time.Time{}
+	}
+	return now.Add(seconds(*publish.Properties.MessageExpiryInterval))
+}
+
+// withRemainingExpiry returns the message to be forwarded at now, whose Message
+// Expiry Interval is counted down to the time left until expiresAt. It returns
+// false if the message has expired.
+func withRemainingExpiry(publish *packets.Publish, expiresAt time.Time, now time.Time) (*packets.Publish, bool) {
+	if expiresAt.IsZero() {
+		return publish, true
+	}
+	remaining := expiresAt.Sub(now)
+	if remaining <= 0 {
+		return nil, false
+	}
+	forwarded := *publish
+	// Rounded up, so that the interval does not reach 0 before it expires
+	forwarded.Properties.MessageExpiryInterval = packets.Uint32(uint32((remaining + time.Second - 1) / time.Second))
+	return &forwarded, true
+}
+
+// willMessage returns the Will Message stored in CONNECT, or nil if the Will
+// Flag is not set.
+func willMessage(connect *packets.Connect) *packets.Publish {
+	if !connect.WillFlag {
+		return nil
+	}
+	properties := connect.WillProperties
+	return &packets.Publish{
+		QoS:       connect.WillQoS,
+		Retain:    connect.WillRetain,
+		TopicName: connect.WillTopic,
+		Payload:   connect.WillMessage,
+		// The Will Properties except Will Delay Interval are sent with the
+		// Will Message
+		Properties: packets.Properties{
+			PayloadFormatIndicator: properties.PayloadFormatIndicator,
+			MessageExpiryInterval:  properties.MessageExpiryInterval,
+			ContentType:            properties.ContentType,
+			ResponseTopic:          properties.ResponseTopic,
+			CorrelationData:        properties.CorrelationData,
+			UserProperties:         properties.UserProperties,
+		},
+	}
+}
+
+// handleConnect handles the CONNECT packet and returns the connected client.
+// It returns nil if the connection can not be established.
+func (h *Handler) handleConnect(connection *Connection, connect *packets.Connect) *Client {
+	h.logger.infof(
+		"Received CONNECT (protocol: %s, level: %d, client id: %q, clean session: %v, keep alive: %d)\n",
+		connect.ProtocolName, connect.ProtocolLevel, connect.ClientID, connect.CleanSession, connect.KeepAlive,
+	)
+
+	// The following packets are encoded in the protocol version of the client
+	connection.SetVersion(connect.ProtocolLevel)
+	// An MQTT 5.0 client may limit the size of the packets it receives
+	if connect.Properties.MaximumPacketSize != nil {
+		connection.SetMaxSendPacketSize(int(*connect.Properties.MaximumPacketSize))
+	}
+
+	clientID := ClientID(connect.ClientID)
+	if !utf8.ValidString(connect.ClientID) {
+		h.logger.infof("Rejecting Client Identifier %q which is not valid UTF-8\n", connect.ClientID)
+		h.rejectConnect(connection, packets.ConnectIdentifierRejected, packets.ReasonClientIdentifierNotValid)
+		return nil
+	}
+
+	// MQTT 3.1 requires a Client Identifier of 1 to 23 characters, and
+	// there is no assignment by the server
+	if connect.ProtocolLevel == packets.Version31 &&
+		(clientID == "" || utf8.RuneCountInString(connect.ClientID) > maxClientIDLengthMQTT31) {
+		h.logger.infof("Rejecting Client Identifier %q of MQTT 3.1\n", connect.ClientID)
+		h.rejectConnect(connection, packets.ConnectIdentifierRejected, packets.ReasonClientIdentifierNotValid)
+		return nil
+	}
+
+	if !h.acceptsConnection() {
+		h.logger.infof("Rejecting connection because there are too many connections\n")
+		h.rejectConnect(connection, packets.ConnectServerUnavailable, packets.ReasonServerBusy)
+		return nil
+	}
+
+	// A zero length Client Identifier means that the server must assign a unique one
+	if clientID == "" {
+		// Before MQTT 5.0, such a client can not resume a session because it
+		// is not identified again
+		if connect.ProtocolLevel < packets.Version5 && !connect.CleanSession {
+			h.logger.infof("Rejecting zero length Client Identifier without Clean Session\n")
+			h.rejectConnect(connection, packets.ConnectIdentifierRejected, packets.ReasonClientIdentifierNotValid)
+			return nil
+		}
+		assigned, err := h.assignClientID()
+		if err != nil {
+			h.logger.errorf("Error assigning client id: %v\n", err)
+			h.rejectConnect(connection, packets.ConnectServerUnavailable, packets.ReasonServerUnavailable)
+			return nil
+		}
+		clientID = assigned
+		h.logger.infof("Assigned client id %s\n", clientID)
+	}
+
+	// If the Will Flag is not set, Will QoS and Will Retain must be 0
+	if !connect.WillFlag && (connect.WillQoS != 0 || connect.WillRetain) {
+		h.logger.infof("Will QoS and Will Retain must be 0 if the Will Flag is not set\n")
+		return nil
+	}
+	if connect.WillQoS > 2 {
+		h.logger.infof("Invalid Will QoS: %d\n", connect.WillQoS)
+		return nil
+	}
+	if connect.WillFlag {
+		if err := validateTopicName(connect.WillTopic, h.options.MaxTopicDepth); err != nil {
+			h.logger.infof("Invalid Will Topic %q: %v\n", connect.WillTopic, err)
+			// Only an MQTT 5.0 client is told the reason, and the others
+			// are just disconnected
+			if connection.Version() >= packets.Version5 {
+				h.rejectConnect(connection, 0, topicReasonCode(err, packets.ReasonTopicNameInvalid))
+			}
+			return nil
+		}
+	}
+
+	// Enhanced authentication of MQTT 5.0 is not supported
+	if connect.Properties.AuthenticationMethod != "" {
+		h.logger.infof("Unsupported authentication method: %s\n", connect.Properties.AuthenticationMethod)
+		h.rejectConnect(connection, packets.ConnectNotAuthorized, packets.ReasonBadAuthenticationMethod)
+		return nil
+	}
+
+	if h.options.Authenticator != nil {
+		err := h.options.Authenticator.Authenticate(string(clientID), connect.Username, connect.Password)
+		if err != nil {
+			h.logger.infof("Rejecting client %s (user name: %q): %v\n", clientID, connect.Username, err)
+			switch {
+			case errors.Is(err, ErrBadUsernameOrPassword):
+				h.rejectConnect(connection, packets.ConnectBadUsernameOrPassword, packets.ReasonBadUserNameOrPassword)
+			case errors.Is(err, ErrNotAuthorized):
+				h.rejectConnect(connection, packets.ConnectNotAuthorized, packets.ReasonNotAuthorized)
+			default:
+				// The credentials could not be checked
+				h.rejectConnect(connection, packets.ConnectServerUnavailable, packets.ReasonServerUnavailable)
+			}
+			return nil
+		}
+	}
+	if !h.hooks.OnConnectAuthenticate(connect) {
+		h.logger.infof("Rejecting client %s refused by the hooks\n", clientID)
+		h.rejectConnect(connection, packets.ConnectBadUsernameOrPassword, packets.ReasonBadUserNameOrPassword)
+		return nil
+	}
+
+	// With Clean Session, a new session starts. Otherwise the previous session
+	// is resumed if it exists. No session is changed until CONNACK is sent,
+	// so that a connection failing before that leaves them as they were.
+	client, sessionPresent := h.clientManager.LoadSession(clientID)
+	if !sessionPresent || connect.CleanSession {
+		client, sessionPresent = &Client{ID: clientID}, false
+	}
+	// The hooks may authorize the Will Topic by the User Name, so it is set
+	// before the check, and put back if the connection fails before CONNACK
+	previousUsername := client.Username()
+	client.setUsername(connect.Username)
+
+	// The Will Message is checked as if it were published by the client
+	if connect.WillFlag && !h.hooks.OnACLCheck(client, connect.WillTopic, true) {
+		h.logger.infof("Rejecting client %s not allowed to publish the Will Message to %s\n", clientID, connect.WillTopic)
+		client.setUsername(previousUsername)
+		h.rejectConnect(connection, packets.ConnectNotAuthorized, packets.ReasonNotAuthorized)
+		return nil
+	}
+
+	// The messages to the client wait in the outbound queue of the
+	// connection until they are written
+	connection.SetOutboundQueue(h.options.MaxOutboundQueue, h.options.SlowConsumerPolicy, func(publish *packets.Publish) {
+		h.dropQueued(client, publish)
+	})
+
+	// Send the connack
+	connack := &packets.Connack{SessionPresent: sessionPresent, ReturnCode: packets.ConnectAccepted}
+	// An MQTT 5.0 client is told the maximum size of the packets it can send
+	connack.Properties.MaximumPacketSize = packets.Uint32(uint32(h.options.MaxPacketSize))
+	if ClientID(connect.ClientID) != clientID {
+		// An MQTT 5.0 client is told the assigned Client Identifier
+		connack.Properties.AssignedClientIdentifier = string(clientID)
+	}
+	err := connection.Send(connack)
+	if err != nil {
+		h.logger.infof("Error sending CONNACK: %v\n", err)
+		client.setUsername(previousUsername)
+		return nil
+	}
+	h.logger.debugf("Sent CONNACK packet (session present: %v)\n", sessionPresent)
+
+	// The new session replaces the previous one, whose subscriptions are
+	// discarded. Its expiry and delayed Will Message are cancelled too,
+	// because the client has connected again.
+	if previous := h.clientManager.StoreSession(client); previous != nil {
+		previous.CancelScheduled()
+		h.topicTree.RemoveClient(previous)
+		h.hooks.OnSessionExpired(previous)
+	}
+	// The session expiry and the delayed Will Message are cancelled because
+	// the client is back
+	client.CancelScheduled()
+	client.SetReceiveMaximum(receiveMaximum(connect))
+
+	// Store the client in the client manager. If the client is already
+	// connected, the existing connection is disconnected and its session is
+	// taken over by the new connection.
+	if taken := h.clientManager.Add(client, connection); taken != nil {
+		h.logger.infof("Disconnecting the existing connection of client %s\n", clientID)
+		h.disconnect(taken, packets.ReasonSessionTakenOver)
+		taken.Close()
+	}
+	h.hooks.OnConnect(client, connect)
+
+	// Retransmit the messages which were not acknowledged before the client
+	// reconnected. Released QoS 2 messages only need PUBREL to be resent.
+	for _, message := range client.Inflight() {
+		var retransmission packets.Packet
+		if message.Released {
+			retransmission = &packets.Pubrel{PacketID: message.Publish.PacketID}
+		} else {
+			publish := *message.Publish
+			publish.Dup = true
+			retransmission = &publish
+		}
+		h.logger.debugf("Retransmitting %s (packet id: %d) to client %s\n",
+			packets.PacketName(retransmission.Type()), message.Publish.PacketID, client.ID)
+		err := connection.Send(retransmission)
+		if errors.Is(err, packets.ErrPacketTooLarge) {
+			// The client may have lowered its Maximum Packet Size
+			h.dropTooLarge(client, message.Publish, err)
+			continue
+		}
+		if err != nil {
+			// The broken connection is detected and closed by the next read
+			h.logger.errorf("Error retransmitting inflight message: %v\n", err)
+			return client
+		}
+	}
+
+	// Resume the delivery of the messages queued while the client was offline
+	h.sendQueued(connection, client)
+
+	return client
+}
+
+// maxClientIDLengthMQTT31 is the maximum length of the Client Identifier in
+// MQTT 3.1.
+const maxClientIDLengthMQTT31 = 23
+
+// rejectConnect refuses the connection with CONNACK. returnCode is sent to a
+// client before MQTT 5.0 and reasonCode to an MQTT 5.0 client. The caller
+// closes the connection.
+func (h *Handler) rejectConnect(connection *Connection, returnCode byte, reasonCode byte) {
+	code := returnCode
+	if connection.Version() >= packets.Version5 {
+		code = reasonCode
+	}
+	err := connection.Send(&packets.Connack{ReturnCode: code})
+	if err != nil {
+		h.logger.infof("Error sending CONNACK: %v\n", err)
+	}
+}
+
+// assignClientID returns a unique client id for a client which connects with
+// a zero length Client Identifier.
+// The id is random, so that a client can not take over the session of another
+// client by choosing its assigned id in advance.
+func (h *Handler) assignClientID() (ClientID, error) {
+	for {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		id := ClientID("auto-" + hex.EncodeToString(random))
+		if _, exists := h.clientManager.LoadSession(id); !exists {
+			return id, nil
+		}
+	}
+}
+
+// handlePublish handles the PUBLISH packet
+func (h *Handler) handlePublish(connection *Connection, client *Client, publish *packets.Publish) error {
+	// The payload is not logged because it may contain sensitive data
+	h.logger.debugf("Received PUBLISH (topic: %s, QoS: %d, payload: %d bytes)\n", publish.TopicName, publish.QoS, len(publish.Payload))
+
+	// Topic Aliases are not allowed because the Topic Alias Maximum of the
+	// server is 0
+	if publish.Properties.TopicAlias != nil {
+		return newProtocolError(packets.ReasonTopicAliasInvalid, "received PUBLISH with a Topic Alias")
+	}
+	if err := validateTopicName(publish.TopicName, h.options.MaxTopicDepth); err != nil {
+		return newProtocolError(topicReasonCode(err, packets.ReasonTopicNameInvalid),
+			"received PUBLISH with invalid topic name %q: %v", publish.TopicName, err)
+	}
+
+	if !h.hooks.OnACLCheck(client, publish.TopicName, true) {
+		h.logger.infof("Client %s is not authorized to publish to %s\n", client.ID, publish.TopicName)
+		return h.rejectPublish(connection, publish, packets.ReasonNotAuthorized)
+	}
+	// The message returned by the hooks is delivered, while the client is
+	// acknowledged by the QoS and the packet identifier of its PUBLISH
+	message, err := h.hooks.OnPublish(client, publish)
+	if err != nil {
+		h.logger.infof("Rejected PUBLISH from client %s: %v\n", client.ID, err)
+		return h.rejectPublish(connection, publish, packets.ReasonImplementationSpecificError)
+	}
+
+	switch publish.QoS {
+	case 0:
+		// when QoS == 0, no response is required
+		h.publishToSubscribers(client, message)
+	case 1:
+		puback := &packets.Puback{PacketID: publish.PacketID}
+		if h.publishToSubscribers(client, message) == 0 {
+			// Only an MQTT 5.0 client is told that nobody received the message
+			puback.ReasonCode = packets.ReasonNoMatchingSubscribers
+		}
+		if err := connection.Send(puback); err != nil {
+			return fmt.Errorf("sending PUBACK: %w", err)
+		}
+	case 2:
+		// The message is delivered when PUBREL arrives so that a retransmitted
+		// PUBLISH is not delivered twice
+		if !client.StoreIncomingQoS2(publish.PacketID, message) {
+			h.logger.debugf("Received duplicate QoS 2 PUBLISH (packet id: %d)\n", publish.PacketID)
+		}
+		if err := connection.Send(&packets.Pubrec{PacketID: publish.PacketID}); err != nil {
+			return fmt.Errorf("sending PUBREC: %w", err)
+		}
+	}
+	return nil
+}
+
+// rejectPublish acknowledges the message which is not delivered. Only an MQTT
+// 5.0 client is told the reasonCode, and QoS 0 messages are dropped silently.
+func (h *Handler) rejectPublish(connection *Connection, publish *packets.Publish, reasonCode byte) error {
+	switch publish.QoS {
+	case 1:
+		if err := connection.Send(&packets.Puback{PacketID: publish.PacketID, ReasonCode: reasonCode}); err != nil {
+			return fmt.Errorf("sending PUBACK: %w", err)
+		}
+	case 2:
+		// PUBREC with a failure Reason Code ends the QoS 2 flow. A client
+		// before MQTT 5.0 sends PUBREL, which is answered as an unknown
+		// message.
+		if err := connection.Send(&packets.Pubrec{PacketID: publish.PacketID, ReasonCode: reasonCode}); err != nil {
+			return fmt.Errorf("sending PUBREC: %w", err)
+		}
+	}
+	return nil
+}
+
+// publishToSubscribers delivers the message published by the client to every
+// client subscribing to the topic, and returns the number of the subscribers.
+// from is nil for the Will Message. If the RETAIN flag is set, the message is
+// also stored as the retained message of the topic.
+func (h *Handler) publishToSubscribers(from *Client, publish *packets.Publish) int {
+	if publish.Retain {
+		h.retainStore.Set(publish)
+	}
+
+	subscribers := h.topicTree.Get(publish.TopicName)
+	h.logger.debugf("Found %d subscribers of %s\n", len(subscribers), publish.TopicName)
+	for _, subscriber := range subscribers {
+		// No Local subscriptions do not receive the messages of their own
+		if subscriber.NoLocal && subscriber.Client == from {
+			continue
+		}
+		// The RETAIN flag is cleared when delivering to established
+		// subscriptions, unless Retain As Published is set
+		retain := publish.Retain && subscriber.RetainAsPublished
+		h.deliver(subscriber, publish, retain, "")
+	}
+
+	// Each shared subscription group receives the message once, through one
+	// of its members
+	groups := h.topicTree.GetShared(publish.TopicName)
+	for _, group := range groups {
+		member := h.pickSharedMember(group, from)
+		retain := publish.Retain && member.RetainAsPublished
+		h.deliver(member, publish, retain, group.Filter)
+	}
+
+	return len(subscribers) + len(groups)
+}
+
+// pickSharedMember picks the member of the shared subscription group which
+// receives the message. Online members are preferred, so that the message is
+// queued for an offline member only if the whole group is offline.
+func (h *Handler) pickSharedMember(group SharedGroup, from *Client) Subscriber {
+	online := make([]Subscriber, 0, len(group.Members))
+	for _, member := range group.Members {
+		if h.clientManager.Get(member.Client) != nil {
+			online = append(online, member)
+		}
+	}
+	if len(online) == 0 {
+		return h.sharedBalancer.pick(group.Filter, group.Members, from)
+	}
+	return h.sharedBalancer.pick(group.Filter, online, from)
+}
+
+// deliver sends the message to the subscriber at the minimum of the QoS of the
+// message and the QoS granted to the subscription. If the client is offline,
+// QoS 1 and 2 messages are queued until it reconnects. sharedGroup is the
+// shared subscription the message is delivered through, or empty.
+func (h *Handler) deliver(subscriber Subscriber, publish *packets.Publish, retain bool, sharedGroup string) {
+	client := subscriber.Client
+	qos := publish.QoS
+	if subscriber.QoS < qos {
+		qos = subscriber.QoS
+	}
+
+	outgoing := &packets.Publish{
+		QoS:        qos,
+		Retain:     retain,
+		TopicName:  publish.TopicName,
+		Properties: publish.Properties,
+		Payload:    publish.Payload,
+	}
+	// Topic Alias is specific to the network connection, so it is not
+	// forwarded. The Subscription Identifiers are the ones of the matching
+	// subscriptions.
+	outgoing.Properties.TopicAlias = nil
+	outgoing.Properties.SubscriptionIdentifiers = subscriber.SubscriptionIdentifiers
+
+	// QoS 0 messages are not stored for offline clients
+	if qos == 0 {
+		if connection := h.clientManager.Get(client); connection != nil {
+			h.writePublish(connection, client, outgoing)
+		}
+		return
+	}
+
+	// QoS 1 and 2 messages always go through the queue, so that they are sent
+	// after the messages queued earlier, e.g. while the client was offline or
+	// its inflight window was full
+	if !client.Enqueue(outgoing, sharedGroup, h.options.MaxQueuedMessages) {
+		h.logger.infof("Dropped a message to client %s because its queue is full\n", client.ID)
+		return
+	}
+	// The client may have reconnected and sent the queued messages before
+	// the message was queued, so the connection is looked up afterwards
+	if connection := h.clientManager.Get(client); connection != nil {
+		h.sendQueued(connection, client)
+	}
+}
+
+// sendQueued sends the queued messages in the order they were queued, as many
+// as the inflight window allows.
+func (h *Handler) sendQueued(connection Sender, client *Client) {
+	for _, publish := range client.DequeueInflight(h.inflightWindow(client)) {
+		h.writePublish(connection, client, publish)
+	}
+}
+
+// sendQueuedToCurrent sends the queued messages which an acknowledgement has
+// made room for. They are sent to the current connection of the client, which
+// is not the acknowledging one if the session has been taken over.
+func (h *Handler) sendQueuedToCurrent(client *Client) {
+	if connection := h.clientManager.Get(client); connection != nil {
+		h.sendQueued(connection, client)
+	}
+}
+
+// inflightWindow returns how many QoS 1 and QoS 2 messages can be inflight to
+// the client, or 0 if there is no limit. It is the smaller of MaxInflight and
+// the Receive Maximum of the client.
+func (h *Handler) inflightWindow(client *Client) int {
+	window := h.options.MaxInflight
+	if receiveMaximum := client.ReceiveMaximum(); receiveMaximum > 0 && (window == 0 || receiveMaximum < window) {
+		window = receiveMaximum
+	}
+	return window
+}
+
+// writePublish writes the message, which is already inflight if its QoS is 1
+// or 2, to the client.
+func (h *Handler) writePublish(connection Sender, client *Client, publish *packets.Publish) {
+	h.logger.debugf("Sending message to client %s\n", client.ID)
+	err := connection.Send(publish)
+	if errors.Is(err, packets.ErrPacketTooLarge) {
+		// The message is discarded as if it had been delivered, because the
+		// client can never receive it
+		h.dropTooLarge(client, publish, err)
+		return
+	}
+	if errors.Is(err, errSlowConsumer) {
+		// The message stays inflight and is retransmitted when the client
+		// reconnects
+		h.logger.infof("Disconnected slow client %s\n", client.ID)
+		h.stats.slowConsumerDisconnects.Add(1)
+		return
+	}
+	if err != nil {
+		h.logger.errorf("Error sending PUBLISH to client %s: %v\n", client.ID, err)
+		return
+	}
+	// QoS 1 and 2 messages are delivered when they are acknowledged
+	if publish.QoS == 0 {
+		h.hooks.OnMessageDelivered(client, publish)
+	}
+}
+
+// dropQueued discards the message dropped from the outbound queue of the client
+// by the slow consumer policy.
+func (h *Handler) dropQueued(client *Client, publish *packets.Publish) {
+	h.logger.infof("Dropped a message to client %s because its outbound queue is full\n", client.ID)
+	h.stats.outboundMessagesDropped.Add(1)
+	if publish.QoS > 0 {
+		client.RemoveInflight(publish.PacketID)
+	}
+}
+
+// dropTooLarge discards the message larger than the Maximum Packet Size of the
+// client.
+func (h *Handler) dropTooLarge(client *Client, publish *packets.Publish, err error) {
+	h.logger.infof("Dropped a message to client %s: %v\n", client.ID, err)
+	h.stats.outboundPacketsTooLarge.Add(1)
+	if publish.QoS > 0 {
+		client.RemoveInflight(publish.PacketID)
+	}
+}
+
+// handlePuback handles the PUBACK packet, which acknowledges a QoS 1 message
+// sent to the client
+func (h *Handler) handlePuback(client *Client, puback *packets.Puback) error {
+	publish := client.AckInflight(puback.PacketID)
+	if publish == nil {
+		h.logger.infof("Received PUBACK for unknown packet id %d from client %s\n", puback.PacketID, client.ID)
+		return nil
+	}
+	h.hooks.OnMessageDelivered(client, publish)
+	h.sendQueuedToCurrent(client)
+	return nil
+}
+
+// handlePubrel handles the PUBREL packet, which releases a QoS 2 message
+// received from the client
+func (h *Handler) handlePubrel(connection *Connection, client *Client, pubrel *packets.Pubrel) error {
+	pubcomp := &packets.Pubcomp{PacketID: pubrel.PacketID}
+	if publish := client.ReleaseIncomingQoS2(pubrel.PacketID); publish != nil {
+		h.publishToSubscribers(client, publish)
+	} else {
+		// Only an MQTT 5.0 client is told that the message is unknown
+		pubcomp.ReasonCode = packets.ReasonPacketIdentifierNotFound
+	}
+
+	// PUBCOMP is sent even if the message has already been released, because
+	// the client may not have received the previous PUBCOMP
+	if err := connection.Send(pubcomp); err != nil {
+		return fmt.Errorf("sending PUBCOMP: %w", err)
+	}
+	return nil
+}
+
+// handlePubrec handles the PUBREC packet, which acknowledges a QoS 2 message
+// sent to the client
+func (h *Handler) handlePubrec(connection *Connection, client *Client, pubrec *packets.Pubrec) error {
+	// An MQTT 5.0 client may reject the message with a failure Reason Code,
+	// which ends the QoS 2 flow without PUBREL
+	if pubrec.ReasonCode >= packets.ReasonUnspecifiedError {
+		if !client.RejectInflight(pubrec.PacketID) {
+			h.logger.infof("Received PUBREC for unknown packet id %d from client %s\n", pubrec.PacketID, client.ID)
+			return nil
+		}
+		h.sendQueuedToCurrent(client)
+		return nil
+	}
+
+	if !client.ReleaseInflight(pubrec.PacketID) {
+		h.logger.infof("Received PUBREC for unknown packet id %d from client %s\n", pubrec.PacketID, client.ID)
+		return nil
+	}
+
+	if err := connection.Send(&packets.Pubrel{PacketID: pubrec.PacketID}); err != nil {
+		return fmt.Errorf("sending PUBREL: %w", err)
+	}
+	return nil
+}
+
+// handlePubcomp handles the PUBCOMP packet, which completes a QoS 2 message
+// sent to the client
+func (h *Handler) handlePubcomp(client *Client, pubcomp *packets.Pubcomp) error {
+	publish := client.CompleteInflight(pubcomp.PacketID)
+	if publish == nil {
+		h.logger.infof("Received PUBCOMP for unknown packet id %d from client %s\n", pubcomp.PacketID, client.ID)
+		return nil
+	}
+	h.hooks.OnMessageDelivered(client, publish)
+	h.sendQueuedToCurrent(client)
+	return nil
+}
+
+// handleSubscribe handles the SUBSCRIBE packet
+func (h *Handler) handleSubscribe(connection *Connection, client *Client, subscribe *packets.Subscribe) error {
+	failure := packets.SubackFailure
+	if connection.Version() >= packets.Version5 {
+		failure = packets.ReasonTopicFilterInvalid
+	}
+
+	// The Subscription Identifier of MQTT 5.0 is associated with all the
+	// subscriptions in the packet
+	var subscriptionIdentifiers []int
+	if len(subscribe.Properties.SubscriptionIdentifiers) > 0 {
+		subscriptionIdentifiers = subscribe.Properties.SubscriptionIdentifiers[:1]
+	}
+
+	// The return codes are in the same order as the topic filters
+	returnCodes := make([]byte, 0, len(subscribe.Subscriptions))
+	sendRetained := make([]bool, 0, len(subscribe.Subscriptions))
+	for _, subscription := range subscribe.Subscriptions {
+		h.logger.debugf("Topic: %s, Requested QoS: %d\n", subscription.TopicFilter, subscription.QoS)
+
+		if err := validateTopicFilter(subscription.TopicFilter, h.options.MaxTopicDepth); err != nil {
+			// A topic filter which is not well-formed UTF-8 makes the packet
+			// malformed. MQTT 3.1 has no failure return code either. In both
+			// cases the connection is closed.
+			if errors.Is(err, errTopicMalformed) || connection.Version() == packets.Version31 {
+				return newProtocolError(packets.ReasonMalformedPacket, "received invalid topic filter %q: %v", subscription.TopicFilter, err)
+			}
+			h.logger.infof("Rejected invalid topic filter %q: %v\n", subscription.TopicFilter, err)
+			returnCodes = append(returnCodes, failure)
+			sendRetained = append(sendRetained, false)
+			continue
+		}
+
+		if !h.hooks.OnACLCheck(client, subscription.TopicFilter, false) {
+			h.logger.infof("Client %s is not authorized to subscribe to %s\n", client.ID, subscription.TopicFilter)
+			if connection.Version() >= packets.Version5 {
+				returnCodes = append(returnCodes, packets.ReasonNotAuthorized)
+			} else {
+				returnCodes = append(returnCodes, failure)
+			}
+			sendRetained = append(sendRetained, false)
+			continue
+		}
+
+		// No Local on a shared subscription is a Protocol Error
+		_, _, isShared := parseSharedFilter(subscription.TopicFilter)
+		if isShared && subscription.NoLocal {
+			h.logger.infof("Rejected No Local on shared subscription %q\n", subscription.TopicFilter)
+			returnCodes = append(returnCodes, failure)
+			sendRetained = append(sendRetained, false)
+			continue
+		}
+
+		// All QoS levels are supported, so the requested QoS is granted
+		grantedQoS := subscription.QoS
+		isNew := h.topicTree.Add(subscription.TopicFilter, Subscriber{
+			Client:                  client,
+			QoS:                     grantedQoS,
+			NoLocal:                 subscription.NoLocal,
+			RetainAsPublished:       subscription.RetainAsPublished,
+			SubscriptionIdentifiers: subscriptionIdentifiers,
+		})
+		returnCodes = append(returnCodes, grantedQoS)
+
+		switch {
+		case isShared:
+			// Retained messages are not sent for shared subscriptions
+			sendRetained = append(sendRetained, false)
+		case subscription.RetainHandling == packets.RetainHandlingSend:
+			sendRetained = append(sendRetained, true)
+		case subscription.RetainHandling == packets.RetainHandlingSendIfNew:
+			sendRetained = append(sendRetained, isNew)
+		default:
+			sendRetained = append(sendRetained, false)
+		}
+	}
+
+	// Send the SUBACK with the granted QoS or the failure as the return codes
+	suback := &packets.Suback{PacketID: subscribe.PacketID, ReturnCodes: returnCodes}
+	if err := connection.Send(suback); err != nil {
+		return fmt.Errorf("sending SUBACK: %w", err)
+	}
+	h.hooks.OnSubscribe(client, subscribe, suback)
+
+	// Send the retained messages matching the new subscriptions
+	for i, subscription := range subscribe.Subscriptions {
+		if !sendRetained[i] {
+			continue
+		}
+		for _, retained := range h.retainStore.Get(subscription.TopicFilter) {
+			h.deliver(Subscriber{
+				Client:                  client,
+				QoS:                     returnCodes[i],
+				SubscriptionIdentifiers: subscriptionIdentifiers,
+			}, retained, true, "")
+		}
+	}
+	return nil
+}
+
+// handleUnsubscribe handles the UNSUBSCRIBE packet
+func (h *Handler) handleUnsubscribe(connection *Connection, client *Client, unsubscribe *packets.Unsubscribe) error {
+	reasonCodes := make([]byte, 0, len(unsubscribe.TopicFilters))
+	for _, filter := range unsubscribe.TopicFilters {
+		if h.topicTree.Remove(filter, client) {
+			h.logger.debugf("Client %s unsubscribed from %s\n", client.ID, filter)
+			reasonCodes = append(reasonCodes, packets.ReasonSuccess)
+		} else {
+			reasonCodes = append(reasonCodes, packets.ReasonNoSubscriptionExisted)
+		}
+	}
+
+	// UNSUBACK is sent even if the client did not subscribe to the filters.
+	// The Reason Codes are only sent to an MQTT 5.0 client.
+	if err := connection.Send(&packets.Unsuback{PacketID: unsubscribe.PacketID, ReasonCodes: reasonCodes}); err != nil {
+		return fmt.Errorf("sending UNSUBACK: %w", err)
+	}
+	h.hooks.OnUnsubscribe(client, unsubscribe)
+	return nil
+}
+
+func (h *Handler) handlePingreq(connection *Connection) error {
+	h.logger.debugf("Received PINGREQ\n")
+
+	if err := connection.Send(&packets.Pingresp{}); err != nil {
+		return fmt.Errorf("sending PINGRESP: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,1525 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleConnect(t *testing.T) {
+	t.Run("registers the client with the Client Identifier", func(t *testing.T) {
+		handler := NewHandler()
+
+		connection, buf := newTestConnection()
+
+		client := handler.handleConnect(connection, &packets.Connect{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: 4,
+			CleanSession:  true,
+			KeepAlive:     10,
+			ClientID:      "client1",
+		})
+
+		// Check if the CONNACK packet was written to the connection
+		expectedConnack := []byte{0x20, 0x02, 0x00, 0x00}
+		assert.Equal(t, expectedConnack, buf.Bytes(), "Expected CONNACK to be written to the connection")
+
+		// Check if the client was added to the client manager
+		assert.Equal(t, ClientID("client1"), client.ID)
+		assert.Equal(t, []ClientID{"client1"}, handler.clientManager.List())
+		assert.NotEmpty(t, handler.clientManager.Get(&Client{ID: "client1"}))
+	})
+
+	t.Run("assigns a Client Identifier if it is empty", func(t *testing.T) {
+		handler := NewHandler()
+
+		connection, buf := newTestConnection()
+
+		client := handler.handleConnect(connection, &packets.Connect{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: 4,
+			CleanSession:  true,
+			KeepAlive:     10,
+		})
+
+		assert.Equal(t, []byte{0x20, 0x02, 0x00, 0x00}, buf.Bytes())
+		assert.NotEmpty(t, client.ID)
+		assert.Equal(t, []ClientID{client.ID}, handler.clientManager.List())
+	})
+
+	t.Run("rejects unsupported protocol versions", func(t *testing.T) {
+		for _, tt := range []struct {
+			name  string
+			level byte
+			code  byte
+		}{
+			{"MQTT", 3, packets.ConnectUnacceptableProtocolVersion},
+			{"MQIsdp", 4, packets.ConnectUnacceptableProtocolVersion},
+			{"MQTT", 6, packets.ReasonUnsupportedProtocolVersion},
+		} {
+			handler := NewHandler()
+			received := runHandle(t, handler,
+				&packets.Connect{ProtocolName: tt.name, ProtocolLevel: tt.level, CleanSession: true, ClientID: "client1"},
+				&packets.Pingreq{},
+			)
+			// The connection is closed without processing the following packets
+			assert.Equal(t, []packets.Packet{&packets.Connack{ReturnCode: tt.code}}, received, "%s level %d", tt.name, tt.level)
+			assert.Empty(t, handler.clientManager.List())
+		}
+	})
+
+	t.Run("rejects a zero length Client Identifier without Clean Session", func(t *testing.T) {
+		handler := NewHandler()
+		received := runHandle(t, handler, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: false})
+		assert.Equal(t, []packets.Packet{&packets.Connack{ReturnCode: packets.ConnectIdentifierRejected}}, received)
+		assert.Empty(t, handler.clientManager.List())
+
+		// MQTT 5.0 allows it and assigns a Client Identifier
+		received = runHandle(t, handler, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, CleanSession: false})
+		assert.Len(t, received, 1)
+		assert.NotEmpty(t, received[0].(*packets.Connack).Properties.AssignedClientIdentifier)
+	})
+
+	t.Run("rejects a Client Identifier which is not valid UTF-8", func(t *testing.T) {
+		handler := NewHandler()
+		received := runHandle(t, handler, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, CleanSession: true, ClientID: "\xff"})
+		assert.Equal(t, []packets.Packet{&packets.Connack{ReturnCode: packets.ReasonClientIdentifierNotValid}}, received)
+	})
+
+	t.Run("closes the connection on the reserved flag", func(t *testing.T) {
+		handler := NewHandler()
+		conn := &testConn{reader: bytes.NewReader([]byte{0x10, 0x0C, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x03, 0x00, 0x00, 0x00, 0x00})}
+		handler.Handle(conn)
+		assert.Empty(t, conn.written.Bytes())
+		assert.Empty(t, handler.clientManager.List())
+	})
+}
+
+func TestHandlePingreq(t *testing.T) {
+	handler := NewHandler()
+
+	connection, buf := newTestConnection()
+
+	handler.handlePingreq(connection)
+
+	// Check if the PINGRESP packet was written to the connection
+	expectedPingresp := []byte{0xD0, 0x00}
+	assert.Equal(t, expectedPingresp, buf.Bytes(), "Expected PINGRESP to be written to the connection")
+}
+
+func TestHandlePublishQoS1(t *testing.T) {
+	handler := NewHandler()
+
+	subscriberConn, subscriberBuf := newTestConnection()
+	subscriber := handler.handleConnect(subscriberConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "subscriber"})
+	handler.handleSubscribe(subscriberConn, subscriber, &packets.Subscribe{
+		PacketID:      1,
+		Subscriptions: []packets.Subscription{{TopicFilter: "a/b", QoS: 1}},
+	})
+	subscriberBuf.Reset()
+
+	publisherConn, publisherBuf := newTestConnection()
+	publisher := handler.handleConnect(publisherConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "publisher"})
+	publisherBuf.Reset()
+
+	handler.handlePublish(publisherConn, publisher, &packets.Publish{QoS: 1, TopicName: "a/b", PacketID: 10, Payload: []byte("hello")})
+
+	// The publisher receives PUBACK with the same packet identifier
+	assert.Equal(t, []byte{0x40, 0x02, 0x00, 0x0A}, publisherBuf.Bytes())
+
+	// The subscriber receives the message at QoS 1 with its own packet identifier
+	received, err := packets.ReadPacket(subscriberBuf, packets.Version311)
+	assert.NoError(t, err)
+	assert.Equal(t, &packets.Publish{QoS: 1, TopicName: "a/b", PacketID: 1, Payload: []byte("hello")}, received)
+	assert.Len(t, subscriber.Inflight(), 1)
+
+	t.Run("retransmits unacknowledged messages with DUP on reconnect", func(t *testing.T) {
+		reconnectConn, reconnectBuf := newTestConnection()
+		handler.handleConnect(reconnectConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "subscriber"})
+
+		_, err := packets.ReadPacket(reconnectBuf, packets.Version311) // CONNACK
+		assert.NoError(t, err)
+		received, err := packets.ReadPacket(reconnectBuf, packets.Version311)
+		assert.NoError(t, err)
+		assert.Equal(t, &packets.Publish{Dup: true, QoS: 1, TopicName: "a/b", PacketID: 1, Payload: []byte("hello")}, received)
+	})
+
+	t.Run("PUBACK removes the inflight message", func(t *testing.T) {
+		handler.handlePuback(subscriber, &packets.Puback{PacketID: 1})
+		assert.Empty(t, subscriber.Inflight())
+	})
+}
+
+func TestHandlePublishDowngradesQoS(t *testing.T) {
+	handler := NewHandler()
+
+	subscriberConn, subscriberBuf := newTestConnection()
+	subscriber := handler.handleConnect(subscriberConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "subscriber"})
+	handler.handleSubscribe(subscriberConn, subscriber, &packets.Subscribe{
+		PacketID:      1,
+		Subscriptions: []packets.Subscription{{TopicFilter: "a/+", QoS: 0}},
+	})
+	subscriberBuf.Reset()
+
+	publisher := &Client{ID: "publisher"}
+	publisherConn, _ := newTestConnection()
+	handler.handlePublish(publisherConn, publisher, &packets.Publish{QoS: 1, TopicName: "a/b", PacketID: 10, Payload: []byte("hello")})
+
+	// The message is delivered at the granted QoS 0
+	received, err := packets.ReadPacket(subscriberBuf, packets.Version311)
+	assert.NoError(t, err)
+	assert.Equal(t, &packets.Publish{TopicName: "a/b", Payload: []byte("hello")}, received)
+	assert.Empty(t, subscriber.Inflight())
+}
+
+func TestHandlePublishQoS2(t *testing.T) {
+	handler := NewHandler()
+
+	subscriberConn, subscriberBuf := newTestConnection()
+	subscriber := handler.handleConnect(subscriberConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "subscriber"})
+	handler.handleSubscribe(subscriberConn, subscriber, &packets.Subscribe{
+		PacketID:      1,
+		Subscriptions: []packets.Subscription{{TopicFilter: "billing", QoS: 2}},
+	})
+	subscriberBuf.Reset()
+
+	publisherConn, publisherBuf := newTestConnection()
+	publisher := handler.handleConnect(publisherConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "publisher"})
+	publisherBuf.Reset()
+
+	t.Run("inbound: delivers the message only once on PUBREL", func(t *testing.T) {
+		publish := &packets.Publish{QoS: 2, TopicName: "billing", PacketID: 7, Payload: []byte("charge")}
+		handler.handlePublish(publisherConn, publisher, publish)
+
+		// A retransmitted PUBLISH must not be delivered twice
+		duplicate := *publish
+		duplicate.Dup = true
+		handler.handlePublish(publisherConn, publisher, &duplicate)
+
+		assert.Equal(t, []byte{0x50, 0x02, 0x00, 0x07, 0x50, 0x02, 0x00, 0x07}, publisherBuf.Bytes(), "Expected PUBREC for each PUBLISH")
+		assert.Empty(t, subscriberBuf.Bytes(), "Expected no delivery before PUBREL")
+		publisherBuf.Reset()
+
+		handler.handlePubrel(publisherConn, publisher, &packets.Pubrel{PacketID: 7})
+		handler.handlePubrel(publisherConn, publisher, &packets.Pubrel{PacketID: 7})
+
+		assert.Equal(t, []byte{0x70, 0x02, 0x00, 0x07, 0x70, 0x02, 0x00, 0x07}, publisherBuf.Bytes(), "Expected PUBCOMP for each PUBREL")
+		received, err := packets.ReadPacket(subscriberBuf, packets.Version311)
+		assert.NoError(t, err)
+		assert.Equal(t, &packets.Publish{QoS: 2, TopicName: "billing", PacketID: 1, Payload: []byte("charge")}, received)
+		assert.Empty(t, subscriberBuf.Bytes(), "Expected the message to be delivered only once")
+	})
+
+	t.Run("outbound: PUBREC is answered with PUBREL", func(t *testing.T) {
+		handler.handlePubrec(subscriberConn, subscriber, &packets.Pubrec{PacketID: 1})
+
+		received, err := packets.ReadPacket(subscriberBuf, packets.Version311)
+		assert.NoError(t, err)
+		assert.Equal(t, &packets.Pubrel{PacketID: 1}, received)
+	})
+
+	t.Run("outbound: PUBREL is retransmitted on reconnect", func(t *testing.T) {
+		reconnectConn, reconnectBuf := newTestConnection()
+		handler.handleConnect(reconnectConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "subscriber"})
+
+		_, err := packets.ReadPacket(reconnectBuf, packets.Version311) // CONNACK
+		assert.NoError(t, err)
+		received, err := packets.ReadPacket(reconnectBuf, packets.Version311)
+		assert.NoError(t, err)
+		assert.Equal(t, &packets.Pubrel{PacketID: 1}, received)
+	})
+
+	t.Run("outbound: PUBCOMP completes the message", func(t *testing.T) {
+		handler.handlePubcomp(subscriber, &packets.Pubcomp{PacketID: 1})
+		assert.Empty(t, subscriber.Inflight())
+	})
+}
+
+func TestHandlePublishRetain(t *testing.T) {
+	handler := NewHandler()
+	publisher := &Client{ID: "publisher"}
+	publisherConn, _ := newTestConnection()
+
+	handler.handlePublish(publisherConn, publisher, &packets.Publish{Retain: true, TopicName: "sensor/1/temperature", Payload: []byte("22")})
+	handler.handlePublish(publisherConn, publisher, &packets.Publish{Retain: true, QoS: 1, PacketID: 1, TopicName: "sensor/2/temperature", Payload: []byte("23")})
+	handler.handlePublish(publisherConn, publisher, &packets.Publish{TopicName: "sensor/3/temperature", Payload: []byte("24")})
+
+	t.Run("new subscriptions receive the retained messages with RETAIN", func(t *testing.T) {
+		connection, buf := newTestConnection()
+		subscriber := handler.handleConnect(connection, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "dashboard"})
+		handler.handleSubscribe(connection, subscriber, &packets.Subscribe{
+			PacketID:      1,
+			Subscriptions: []packets.Subscription{{TopicFilter: "sensor/+/temperature", QoS: 1}},
+		})
+
+		_, err := packets.ReadPacket(buf, packets.Version311) // CONNACK
+		assert.NoError(t, err)
+		_, err = packets.ReadPacket(buf, packets.Version311) // SUBACK
+		assert.NoError(t, err)
+
+		received := make([]packets.Packet, 0)
+		for buf.Len() > 0 {
+			packet, err := packets.ReadPacket(buf, packets.Version311)
+			assert.NoError(t, err)
+			received = append(received, packet)
+		}
+		assert.ElementsMatch(t, []packets.Packet{
+			&packets.Publish{Retain: true, TopicName: "sensor/1/temperature", Payload: []byte("22")},
+			&packets.Publish{Retain: true, QoS: 1, PacketID: 1, TopicName: "sensor/2/temperature", Payload: []byte("23")},
+		}, received)
+	})
+
+	t.Run("an empty retained message deletes the retained message", func(t *testing.T) {
+		handler.handlePublish(publisherConn, publisher, &packets.Publish{Retain: true, TopicName: "sensor/1/temperature"})
+		assert.Empty(t, handler.retainStore.Get("sensor/1/temperature"))
+	})
+}
+
+func TestHandleSubscribe(t *testing.T) {
+	handler := NewHandler()
+	handler.retainStore.Set(&packets.Publish{Retain: true, QoS: 1, TopicName: "a/b", Payload: []byte("retained")})
+
+	connection, buf := newTestConnection()
+	client := handler.handleConnect(connection, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "client1"})
+	buf.Reset()
+
+	handler.handleSubscribe(connection, client, &packets.Subscribe{
+		PacketID: 3,
+		Subscriptions: []packets.Subscription{
+			{TopicFilter: "a/b", QoS: 2},
+			{TopicFilter: "a/#/b", QoS: 1},
+			{TopicFilter: "c/+", QoS: 0},
+		},
+	})
+
+	// One return code per topic filter in the same order, 0x80 for the invalid one
+	suback, err := packets.ReadPacket(buf, packets.Version311)
+	assert.NoError(t, err)
+	assert.Equal(t, &packets.Suback{PacketID: 3, ReturnCodes: []byte{0x02, 0x80, 0x00}}, suback)
+
+	assert.Equal(t, []Subscriber{{Client: client, QoS: 2}}, handler.topicTree.Get("a/b"))
+	assert.Equal(t, []Subscriber{{Client: client, QoS: 0}}, handler.topicTree.Get("c/d"))
+
+	// The retained message is delivered for the accepted filter
+	retained, err := packets.ReadPacket(buf, packets.Version311)
+	assert.NoError(t, err)
+	assert.Equal(t, &packets.Publish{Retain: true, QoS: 1, PacketID: 1, TopicName: "a/b", Payload: []byte("retained")}, retained)
+}
+
+func TestHandleUnsubscribe(t *testing.T) {
+	handler := NewHandler()
+
+	connection, buf := newTestConnection()
+	client := handler.handleConnect(connection, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "client1"})
+	handler.handleSubscribe(connection, client, &packets.Subscribe{
+		PacketID:      1,
+		Subscriptions: []packets.Subscription{{TopicFilter: "a/b", QoS: 0}},
+	})
+	buf.Reset()
+
+	handler.handleUnsubscribe(connection, client, &packets.Unsubscribe{PacketID: 2, TopicFilters: []string{"a/b", "not/subscribed"}})
+
+	// Check if the UNSUBACK packet was written to the connection
+	assert.Equal(t, []byte{0xB0, 0x02, 0x00, 0x02}, buf.Bytes())
+	assert.Empty(t, handler.topicTree.Get("a/b"))
+}
+
+// testConn is an in-memory net.Conn. Reads return the bytes given by the test
+// and then io.EOF, and writes are recorded.
+type testConn struct {
+	reader  io.Reader
+	written bytes.Buffer
+	mu      sync.Mutex
+}
+
+func (c *testConn) Read(b []byte) (int, error) { return c.reader.Read(b) }
+
+func (c *testConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written.Write(b)
+}
+
+func (c *testConn) Close() error                       { return nil }
+func (c *testConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *testConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *testConn) SetDeadline(t time.Time) error      { return nil }
+func (c *testConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *testConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// testBuffer reads the bytes written to a testConn. It waits for the writer of
+// the connection to write the queued packets before reading.
+type testBuffer struct {
+	connection *Connection
+	conn       *testConn
+}
+
+func (b *testBuffer) Read(p []byte) (int, error) {
+	b.connection.waitIdle()
+	b.conn.mu.Lock()
+	defer b.conn.mu.Unlock()
+	return b.conn.written.Read(p)
+}
+
+func (b *testBuffer) Bytes() []byte {
+	b.connection.waitIdle()
+	b.conn.mu.Lock()
+	defer b.conn.mu.Unlock()
+	return b.conn.written.Bytes()
+}
+
+func (b *testBuffer) Len() int {
+	b.connection.waitIdle()
+	b.conn.mu.Lock()
+	defer b.conn.mu.Unlock()
+	return b.conn.written.Len()
+}
+
+func (b *testBuffer) Reset() {
+	b.connection.waitIdle()
+	b.conn.mu.Lock()
+	defer b.conn.mu.Unlock()
+	b.conn.written.Reset()
+}
+
+// newTestConnection returns a Connection over a testConn and the buffer which
+// records the bytes written to it.
+func newTestConnection() (*Connection, *testBuffer) {
+	conn := &testConn{reader: &bytes.Buffer{}}
+	connection := NewConnection(conn)
+	return connection, &testBuffer{connection: connection, conn: conn}
+}
+
+// runHandle runs Handle over a testConn which sends the packets, and returns
+// the packets written by the handler. Unless the last packet is DISCONNECT,
+// the handler sees the end of the packets as an abnormal close.
+func runHandle(t *testing.T, handler *Handler, pkts ...packets.Packet) []packets.Packet {
+	t.Helper()
+
+	// The packets are encoded in the protocol version of the first CONNECT
+	version := pkts[0].(*packets.Connect).ProtocolLevel
+	input := &bytes.Buffer{}
+	for _, packet := range pkts {
+		assert.NoError(t, packet.Encode(input, version))
+	}
+	conn := &testConn{reader: input}
+
+	handler.Handle(conn)
+
+	received := make([]packets.Packet, 0)
+	for conn.written.Len() > 0 {
+		packet, err := packets.ReadPacket(&conn.written, version)
+		assert.NoError(t, err)
+		received = append(received, packet)
+	}
+	return received
+}
+
+func TestHandleClose(t *testing.T) {
+	subscribe := &packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "a/b", QoS: 1}}}
+
+	t.Run("DISCONNECT removes the client and its clean session", func(t *testing.T) {
+		handler := NewHandler()
+		runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: true, ClientID: "client1"},
+			subscribe,
+			&packets.Disconnect{},
+		)
+
+		assert.Empty(t, handler.clientManager.List())
+		assert.Empty(t, handler.topicTree.Get("a/b"))
+		_, exists := handler.clientManager.LoadSession("client1")
+		assert.False(t, exists, "Expected the session to be discarded")
+	})
+
+	t.Run("abnormal close removes the client and its clean session", func(t *testing.T) {
+		handler := NewHandler()
+		runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: true, ClientID: "client1"},
+			subscribe,
+		)
+
+		assert.Empty(t, handler.clientManager.List())
+		assert.Empty(t, handler.topicTree.Get("a/b"))
+	})
+
+	t.Run("persistent session parks its subscriptions", func(t *testing.T) {
+		handler := NewHandler()
+		runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: false, ClientID: "client1"},
+			subscribe,
+			&packets.Disconnect{},
+		)
+
+		assert.Empty(t, handler.clientManager.List())
+		subscribers := handler.topicTree.Get("a/b")
+		assert.Len(t, subscribers, 1)
+
+		// Messages published while the client is offline are not written to
+		// the closed connection but kept for the next connection
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "a/b", Payload: []byte("hello")})
+		assert.Empty(t, subscribers[0].Client.Inflight())
+	})
+}
+
+func TestHandlePersistentSession(t *testing.T) {
+	persistent := &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: false, ClientID: "device1"}
+	clean := &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: true, ClientID: "device1"}
+	subscribeQoS0 := &packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "commands/qos0", QoS: 0}}}
+	subscribeQoS1 := &packets.Subscribe{PacketID: 2, Subscriptions: []packets.Subscription{{TopicFilter: "commands/qos1", QoS: 1}}}
+
+	t.Run("queues messages while offline and resumes in order on reconnect", func(t *testing.T) {
+		handler := NewHandler()
+		received := runHandle(t, handler, persistent, subscribeQoS0, subscribeQoS1, &packets.Disconnect{})
+		assert.Equal(t, &packets.Connack{SessionPresent: false}, received[0])
+
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "commands/qos1", Payload: []byte("1")})
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 0, TopicName: "commands/qos0", Payload: []byte("dropped")})
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 2, TopicName: "commands/qos1", Payload: []byte("2")})
+
+		received = runHandle(t, handler, persistent, &packets.Disconnect{})
+		assert.Equal(t, []packets.Packet{
+			&packets.Connack{SessionPresent: true},
+			&packets.Publish{QoS: 1, PacketID: 1, TopicName: "commands/qos1", Payload: []byte("1")},
+			&packets.Publish{QoS: 1, PacketID: 2, TopicName: "commands/qos1", Payload: []byte("2")},
+		}, received)
+	})
+
+	t.Run("Clean Session discards the previous session", func(t *testing.T) {
+		handler := NewHandler()
+		runHandle(t, handler, persistent, subscribeQoS0, subscribeQoS1, &packets.Disconnect{})
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "commands/qos1", Payload: []byte("1")})
+
+		received := runHandle(t, handler, clean, &packets.Disconnect{})
+		assert.Equal(t, []packets.Packet{&packets.Connack{SessionPresent: false}}, received)
+		assert.Empty(t, handler.topicTree.Get("commands/qos1"))
+	})
+}
+
+func TestHandleWill(t *testing.T) {
+	connectWithWill := &packets.Connect{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: 4,
+		CleanSession:  true,
+		ClientID:      "device1",
+		WillFlag:      true,
+		WillQoS:       1,
+		WillRetain:    true,
+		WillTopic:     "device/device1/status",
+		WillMessage:   []byte("offline"),
+	}
+
+	// subscribe connects a monitoring client subscribing to the status topics
+	subscribe := func(handler *Handler) *testBuffer {
+		connection, buf := newTestConnection()
+		monitor := handler.handleConnect(connection, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "monitor"})
+		handler.handleSubscribe(connection, monitor, &packets.Subscribe{
+			PacketID:      1,
+			Subscriptions: []packets.Subscription{{TopicFilter: "device/+/status", QoS: 1}},
+		})
+		buf.Reset()
+		return buf
+	}
+
+	t.Run("publishes the will message on abnormal close", func(t *testing.T) {
+		handler := NewHandler()
+		monitorBuf := subscribe(handler)
+
+		runHandle(t, handler, connectWithWill)
+
+		received, err := packets.ReadPacket(monitorBuf, packets.Version311)
+		assert.NoError(t, err)
+		assert.Equal(t, &packets.Publish{QoS: 1, PacketID: 1, TopicName: "device/device1/status", Payload: []byte("offline")}, received)
+
+		// Will Retain stores the will message as the retained message
+		assert.Len(t, handler.retainStore.Get("device/device1/status"), 1)
+	})
+
+	t.Run("discards the will message on DISCONNECT", func(t *testing.T) {
+		handler := NewHandler()
+		monitorBuf := subscribe(handler)
+
+		runHandle(t, handler, connectWithWill, &packets.Disconnect{})
+
+		assert.Empty(t, monitorBuf.Bytes())
+		assert.Empty(t, handler.retainStore.Get("device/device1/status"))
+	})
+
+	t.Run("rejects Will QoS without the Will Flag", func(t *testing.T) {
+		handler := NewHandler()
+		connection, buf := newTestConnection()
+
+		client := handler.handleConnect(connection, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "device1", WillQoS: 1})
+
+		assert.Nil(t, client)
+		assert.Empty(t, buf.Bytes())
+	})
+}
+
+func TestHandleKeepAlive(t *testing.T) {
+	handler := NewHandler()
+	server, client := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.Handle(server)
+	}()
+
+	err := (&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: true, KeepAlive: 1, ClientID: "client1"}).Encode(client, packets.Version311)
+	assert.NoError(t, err)
+	_, err = packets.ReadPacket(client, packets.Version311) // CONNACK
+	assert.NoError(t, err)
+
+	// PINGREQ within the keep alive keeps the connection open
+	time.Sleep(1 * time.Second)
+	assert.NoError(t, (&packets.Pingreq{}).Encode(client, packets.Version311))
+	_, err = packets.ReadPacket(client, packets.Version311) // PINGRESP
+	assert.NoError(t, err)
+
+	// The connection is closed after one and a half times the keep alive without any packets
+	select {
+	case <-done:
+		t.Fatal("Expected the connection to be kept open within the keep alive")
+	case <-time.After(1 * time.Second):
+	}
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Expected the connection to be closed after the keep alive expired")
+	}
+	assert.Empty(t, handler.clientManager.List())
+}
+
+func TestHandleSessionTakeover(t *testing.T) {
+	handler := NewHandler()
+	connect := &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: false, ClientID: "device1"}
+
+	// The first connection subscribes to a topic
+	server1, client1 := net.Pipe()
+	defer client1.Close()
+	done1 := make(chan struct{})
+	go func() {
+		defer close(done1)
+		handler.Handle(server1)
+	}()
+	assert.NoError(t, connect.Encode(client1, packets.Version311))
+	_, err := packets.ReadPacket(client1, packets.Version311) // CONNACK
+	assert.NoError(t, err)
+	assert.NoError(t, (&packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "commands", QoS: 1}}}).Encode(client1, packets.Version311))
+	_, err = packets.ReadPacket(client1, packets.Version311) // SUBACK
+	assert.NoError(t, err)
+
+	// The second connection with the same ClientID takes over the session
+	server2, client2 := net.Pipe()
+	defer client2.Close()
+	go handler.Handle(server2)
+	assert.NoError(t, connect.Encode(client2, packets.Version311))
+	_, err = packets.ReadPacket(client2, packets.Version311) // CONNACK
+	assert.NoError(t, err)
+
+	select {
+	case <-done1:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Expected the existing connection to be disconnected")
+	}
+	_, err = packets.ReadPacket(client1, packets.Version311)
+	assert.Error(t, err, "Expected the existing connection to be closed")
+
+	assert.Equal(t, []ClientID{"device1"}, handler.clientManager.List())
+
+	// The subscription is handed over to the new connection
+	go handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "commands", Payload: []byte("reboot")})
+	received, err := packets.ReadPacket(client2, packets.Version311)
+	assert.NoError(t, err)
+	assert.Equal(t, &packets.Publish{QoS: 1, PacketID: 1, TopicName: "commands", Payload: []byte("reboot")}, received)
+}
+
+func TestHandleMQTT5(t *testing.T) {
+	connect := &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, CleanSession: true, ClientID: "client1"}
+
+	t.Run("tells the assigned Client Identifier in CONNACK", func(t *testing.T) {
+		handler := NewHandler()
+		connect := &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, CleanSession: true}
+		received := runHandle(t, handler, connect, &packets.Disconnect{})
+		assert.Len(t, received, 1)
+		assigned := received[0].(*packets.Connack).Properties.AssignedClientIdentifier
+		assert.Regexp(t, `^auto-[0-9a-f]{32}$`, assigned)
+		assert.Equal(t, []packets.Packet{
+			connackV5(packets.Properties{AssignedClientIdentifier: assigned}),
+		}, received)
+
+		// The ids are not predictable from the previous ones
+		received = runHandle(t, handler, connect, &packets.Disconnect{})
+		assert.NotEqual(t, assigned, received[0].(*packets.Connack).Properties.AssignedClientIdentifier)
+	})
+
+	t.Run("replies with Reason Codes", func(t *testing.T) {
+		handler := NewHandler()
+		received := runHandle(t, handler,
+			connect,
+			&packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "a/#/b", QoS: 1}, {TopicFilter: "a/b", QoS: 1}}},
+			&packets.Unsubscribe{PacketID: 2, TopicFilters: []string{"a/b", "c"}},
+			&packets.Publish{QoS: 1, PacketID: 3, TopicName: "a/b", Payload: []byte("hello")},
+			&packets.Pubrel{PacketID: 4},
+			&packets.Disconnect{},
+		)
+		assert.Equal(t, []packets.Packet{
+			connackV5(packets.Properties{}),
+			&packets.Suback{PacketID: 1, ReturnCodes: []byte{packets.ReasonTopicFilterInvalid, packets.ReasonGrantedQoS1}},
+			&packets.Unsuback{PacketID: 2, ReasonCodes: []byte{packets.ReasonSuccess, packets.ReasonNoSubscriptionExisted}},
+			&packets.Puback{PacketID: 3, ReasonCode: packets.ReasonNoMatchingSubscribers},
+			&packets.Pubcomp{PacketID: 4, ReasonCode: packets.ReasonPacketIdentifierNotFound},
+		}, received)
+	})
+
+	t.Run("applies the subscription options", func(t *testing.T) {
+		handler := NewHandler()
+		handler.retainStore.Set(&packets.Publish{Retain: true, TopicName: "retained", Payload: []byte("r")})
+
+		properties := packets.Properties{ContentType: "text/plain", UserProperties: []packets.UserProperty{{Name: "k", Value: "v"}}}
+		received := runHandle(t, handler,
+			connect,
+			&packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{
+				{TopicFilter: "local", NoLocal: true},
+				{TopicFilter: "published", RetainAsPublished: true},
+				{TopicFilter: "retained", RetainHandling: packets.RetainHandlingDoNotSend},
+			}},
+			&packets.Publish{TopicName: "local", Payload: []byte("dropped")},
+			&packets.Publish{Retain: true, TopicName: "published", Properties: properties, Payload: []byte("p")},
+			&packets.Disconnect{},
+		)
+		assert.Equal(t, []packets.Packet{
+			connackV5(packets.Properties{}),
+			&packets.Suback{PacketID: 1, ReturnCodes: []byte{0, 0, 0}},
+			&packets.Publish{Retain: true, TopicName: "published", Properties: properties, Payload: []byte("p")},
+		}, received)
+	})
+
+	t.Run("delivers a message once with the matching Subscription Identifiers", func(t *testing.T) {
+		handler := NewHandler()
+		received := runHandle(t, handler,
+			connect,
+			&packets.Subscribe{
+				PacketID:      1,
+				Properties:    packets.Properties{SubscriptionIdentifiers: []int{7}},
+				Subscriptions: []packets.Subscription{{TopicFilter: "a/+", QoS: 0}},
+			},
+			&packets.Subscribe{
+				PacketID:      2,
+				Properties:    packets.Properties{SubscriptionIdentifiers: []int{9}},
+				Subscriptions: []packets.Subscription{{TopicFilter: "a/#", QoS: 1}},
+			},
+			&packets.Publish{QoS: 1, PacketID: 1, TopicName: "a/b", Payload: []byte("p")},
+			&packets.Disconnect{},
+		)
+		assert.Equal(t, []packets.Packet{
+			connackV5(packets.Properties{}),
+			&packets.Suback{PacketID: 1, ReturnCodes: []byte{0}},
+			&packets.Suback{PacketID: 2, ReturnCodes: []byte{1}},
+			&packets.Publish{
+				QoS:        1,
+				PacketID:   1,
+				TopicName:  "a/b",
+				Properties: packets.Properties{SubscriptionIdentifiers: []int{7, 9}},
+				Payload:    []byte("p"),
+			},
+			&packets.Puback{PacketID: 1},
+		}, received)
+	})
+
+	t.Run("rejects enhanced authentication", func(t *testing.T) {
+		handler := NewHandler()
+		received := runHandle(t, handler, &packets.Connect{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: 5,
+			ClientID:      "client1",
+			Properties:    packets.Properties{AuthenticationMethod: "SCRAM-SHA-1"},
+		})
+		assert.Equal(t, []packets.Packet{&packets.Connack{ReturnCode: packets.ReasonBadAuthenticationMethod}}, received)
+		assert.Empty(t, handler.clientManager.List())
+	})
+
+	t.Run("disconnects with a Reason Code on a protocol error", func(t *testing.T) {
+		handler := NewHandler()
+		received := runHandle(t, handler, connect, &packets.Auth{ReasonCode: packets.ReasonReAuthenticate})
+		assert.Equal(t, []packets.Packet{
+			connackV5(packets.Properties{}),
+			&packets.Disconnect{ReasonCode: packets.ReasonProtocolError},
+		}, received)
+	})
+
+	t.Run("publishes the will message on DISCONNECT with Will Message", func(t *testing.T) {
+		handler := NewHandler()
+		monitorConn, monitorBuf := newTestConnection()
+		monitor := handler.handleConnect(monitorConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "monitor"})
+		handler.handleSubscribe(monitorConn, monitor, &packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "status"}}})
+		monitorBuf.Reset()
+
+		runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, CleanSession: true, ClientID: "client1", WillFlag: true, WillTopic: "status", WillMessage: []byte("bye")},
+			&packets.Disconnect{ReasonCode: packets.ReasonDisconnectWithWillMessage},
+		)
+
+		received, err := packets.ReadPacket(monitorBuf, packets.Version311)
+		assert.NoError(t, err)
+		assert.Equal(t, &packets.Publish{TopicName: "status", Payload: []byte("bye")}, received)
+	})
+
+	t.Run("cancels the delayed will message when the client reconnects with Clean Start", func(t *testing.T) {
+		handler := NewHandler()
+		monitorConn, monitorBuf := newTestConnection()
+		monitor := handler.handleConnect(monitorConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "monitor"})
+		handler.handleSubscribe(monitorConn, monitor, &packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "status"}}})
+		monitorBuf.Reset()
+
+		runHandle(t, handler, &packets.Connect{
+			ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "client1",
+			Properties: packets.Properties{SessionExpiryInterval: packets.Uint32(10)},
+			WillFlag:   true, WillTopic: "status", WillMessage: []byte("bye"),
+			WillProperties: packets.Properties{WillDelayInterval: packets.Uint32(1)},
+		})
+		connection, _ := newTestConnection()
+		assert.NotNil(t, handler.handleConnect(connection, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, CleanSession: true, ClientID: "client1"}))
+
+		time.Sleep(1500 * time.Millisecond)
+		assert.Zero(t, monitorBuf.Len(), "Expected the will message to be cancelled")
+	})
+
+	t.Run("stops the session expiry and the delayed will messages on shutdown", func(t *testing.T) {
+		handler := NewHandler()
+		monitorConn, monitorBuf := newTestConnection()
+		monitor := handler.handleConnect(monitorConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "monitor"})
+		handler.handleSubscribe(monitorConn, monitor, &packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "status"}}})
+		monitorBuf.Reset()
+
+		connect := func(clientID string) *packets.Connect {
+			return &packets.Connect{
+				ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: clientID,
+				Properties: packets.Properties{SessionExpiryInterval: packets.Uint32(1)},
+				WillFlag:   true, WillTopic: "status", WillMessage: []byte("bye"),
+				WillProperties: packets.Properties{WillDelayInterval: packets.Uint32(1)},
+			}
+		}
+		// client1 is offline before the shutdown, and client2 is disconnected
+		// by the shutdown
+		runHandle(t, handler, connect("client1"))
+		connection, _ := newTestConnection()
+		client2 := handler.handleConnect(connection, connect("client2"))
+
+		handler.closeConnections()
+		handler.handleClose(connection, client2, connect("client2"), nil)
+
+		time.Sleep(1500 * time.Millisecond)
+		assert.Zero(t, monitorBuf.Len(), "Expected the will messages to be cancelled")
+		for _, clientID := range []ClientID{"client1", "client2"} {
+			_, exists := handler.clientManager.LoadSession(clientID)
+			assert.True(t, exists, clientID)
+		}
+	})
+
+	t.Run("keeps the session until the Session Expiry Interval passes", func(t *testing.T) {
+		handler := NewHandler()
+		runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "client1", Properties: packets.Properties{SessionExpiryInterval: packets.Uint32(1)}},
+			&packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "a/b"}}},
+			&packets.Disconnect{},
+		)
+
+		_, exists := handler.clientManager.LoadSession("client1")
+		assert.True(t, exists)
+		assert.Len(t, handler.topicTree.Get("a/b"), 1)
+
+		assert.Eventually(t, func() bool {
+			_, exists := handler.clientManager.LoadSession("client1")
+			return !exists && len(handler.topicTree.Get("a/b")) == 0
+		}, 3*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("leaves the sessions as they were if CONNACK can not be sent", func(t *testing.T) {
+		handler := NewHandler()
+		runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "client1", Properties: packets.Properties{SessionExpiryInterval: packets.Uint32(1)}},
+			&packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "a/b"}}},
+			&packets.Disconnect{},
+		)
+
+		for _, cleanSession := range []bool{false, true} {
+			connection, _ := newTestConnection()
+			connection.Close()
+			assert.Nil(t, handler.handleConnect(connection, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, CleanSession: cleanSession, ClientID: "client1"}))
+		}
+		connection, _ := newTestConnection()
+		connection.Close()
+		assert.Nil(t, handler.handleConnect(connection, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, CleanSession: true, ClientID: "client2"}))
+
+		// The session of client1 still expires, and no session is created for
+		// client2
+		assert.Len(t, handler.topicTree.Get("a/b"), 1)
+		_, exists := handler.clientManager.LoadSession("client2")
+		assert.False(t, exists)
+		assert.Eventually(t, func() bool {
+			_, exists := handler.clientManager.LoadSession("client1")
+			return !exists && len(handler.topicTree.Get("a/b")) == 0
+		}, 3*time.Second, 100*time.Millisecond)
+	})
+}
+
+func TestHandleMQTT31(t *testing.T) {
+	connect := &packets.Connect{ProtocolName: "MQIsdp", ProtocolLevel: 3, CleanSession: false, ClientID: "gateway1"}
+
+	t.Run("shares the topic tree with the other versions", func(t *testing.T) {
+		handler := NewHandler()
+		received := runHandle(t, handler,
+			connect,
+			&packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "plant/+/temperature", QoS: 1}}},
+			&packets.Disconnect{},
+		)
+		assert.Equal(t, []packets.Packet{
+			&packets.Connack{},
+			&packets.Suback{PacketID: 1, ReturnCodes: []byte{0x01}},
+		}, received)
+
+		publisherConn, _ := newTestConnection()
+		publisher := handler.handleConnect(publisherConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "sensor1"})
+		handler.handlePublish(publisherConn, publisher, &packets.Publish{
+			QoS:        1,
+			PacketID:   1,
+			TopicName:  "plant/line1/temperature",
+			Properties: packets.Properties{ContentType: "text/plain"},
+			Payload:    []byte("20"),
+		})
+
+		// CONNACK of MQTT 3.1 has no Session Present, and the properties of
+		// MQTT 5.0 are not sent
+		received = runHandle(t, handler, connect, &packets.Disconnect{})
+		assert.Equal(t, []packets.Packet{
+			&packets.Connack{},
+			&packets.Publish{QoS: 1, PacketID: 1, TopicName: "plant/line1/temperature", Payload: []byte("20")},
+		}, received)
+	})
+
+	t.Run("rejects Client Identifiers out of 1 to 23 characters", func(t *testing.T) {
+		for _, clientID := range []string{"", "abcdefghijklmnopqrstuvwx"} {
+			handler := NewHandler()
+			received := runHandle(t, handler, &packets.Connect{ProtocolName: "MQIsdp", ProtocolLevel: 3, CleanSession: true, ClientID: clientID})
+			assert.Equal(t, []packets.Packet{&packets.Connack{ReturnCode: packets.ConnectIdentifierRejected}}, received, clientID)
+		}
+	})
+
+	t.Run("closes the connection on an invalid topic filter", func(t *testing.T) {
+		handler := NewHandler()
+		received := runHandle(t, handler,
+			connect,
+			&packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "a/#/b"}}},
+		)
+		assert.Equal(t, []packets.Packet{&packets.Connack{}}, received)
+	})
+}
+
+func TestHandleSharedSubscription(t *testing.T) {
+	// connectWorkers connects the workers which share the subscription to
+	// "jobs" in the group "g", and returns them with the buffers of their
+	// connections
+	connectWorkers := func(handler *Handler, ids ...string) ([]*Client, []*testBuffer) {
+		workers := make([]*Client, 0, len(ids))
+		bufs := make([]*testBuffer, 0, len(ids))
+		for _, id := range ids {
+			connection, buf := newTestConnection()
+			worker := handler.handleConnect(connection, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: id})
+			handler.handleSubscribe(connection, worker, &packets.Subscribe{
+				PacketID:      1,
+				Subscriptions: []packets.Subscription{{TopicFilter: "$share/g/jobs", QoS: 1}},
+			})
+			buf.Reset()
+			workers = append(workers, worker)
+			bufs = append(bufs, buf)
+		}
+		return workers, bufs
+	}
+
+	// readPayloads returns the payloads of the PUBLISH packets in the buffer
+	readPayloads := func(t *testing.T, buf *testBuffer) []string {
+		payloads := make([]string, 0)
+		for buf.Len() > 0 {
+			packet, err := packets.ReadPacket(buf, packets.Version311)
+			assert.NoError(t, err)
+			payloads = append(payloads, string(packet.(*packets.Publish).Payload))
+		}
+		return payloads
+	}
+
+	t.Run("delivers each message to one member in turn", func(t *testing.T) {
+		handler := NewHandler()
+		_, bufs := connectWorkers(handler, "worker1", "worker2")
+
+		for _, payload := range []string{"1", "2", "3", "4"} {
+			assert.Equal(t, 1, handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "jobs", Payload: []byte(payload)}))
+		}
+
+		assert.Equal(t, []string{"1", "3"}, readPayloads(t, bufs[0]))
+		assert.Equal(t, []string{"2", "4"}, readPayloads(t, bufs[1]))
+	})
+
+	t.Run("delivers to online members first", func(t *testing.T) {
+		handler := NewHandler()
+		workers, bufs := connectWorkers(handler, "worker1", "worker2")
+		handler.clientManager.Remove(workers[0], handler.clientManager.Get(workers[0]).(*Connection))
+
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "jobs", Payload: []byte("1")})
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "jobs", Payload: []byte("2")})
+
+		assert.Empty(t, readPayloads(t, bufs[0]))
+		assert.Equal(t, []string{"1", "2"}, readPayloads(t, bufs[1]))
+	})
+
+	t.Run("redistributes unacknowledged messages when a member disconnects", func(t *testing.T) {
+		handler := NewHandler()
+		workers, bufs := connectWorkers(handler, "worker1", "worker2")
+
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "jobs", Payload: []byte("1")})
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "jobs", Payload: []byte("2")})
+		assert.Equal(t, []string{"1"}, readPayloads(t, bufs[0]))
+		assert.Equal(t, []string{"2"}, readPayloads(t, bufs[1]))
+
+		handler.handleClose(
+			handler.clientManager.Get(workers[0]).(*Connection), workers[0],
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "worker1"}, nil,
+		)
+
+		assert.Empty(t, workers[0].Inflight())
+		assert.Equal(t, []string{"1"}, readPayloads(t, bufs[1]))
+		assert.Len(t, workers[1].Inflight(), 2)
+	})
+
+	t.Run("keeps QoS 2 messages with the disconnected member", func(t *testing.T) {
+		handler := NewHandler()
+		workers := make([]*Client, 0)
+		bufs := make([]*testBuffer, 0)
+		for _, id := range []string{"worker1", "worker2"} {
+			connection, buf := newTestConnection()
+			worker := handler.handleConnect(connection, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: id})
+			handler.handleSubscribe(connection, worker, &packets.Subscribe{
+				PacketID:      1,
+				Subscriptions: []packets.Subscription{{TopicFilter: "$share/g/bill", QoS: 2}},
+			})
+			buf.Reset()
+			workers = append(workers, worker)
+			bufs = append(bufs, buf)
+		}
+
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 2, TopicName: "bill", Payload: []byte("1")})
+		assert.Equal(t, []string{"1"}, readPayloads(t, bufs[0]))
+
+		handler.handleClose(
+			handler.clientManager.Get(workers[0]).(*Connection), workers[0],
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "worker1"}, nil,
+		)
+
+		assert.Len(t, workers[0].Inflight(), 1)
+		assert.Empty(t, readPayloads(t, bufs[1]))
+		assert.Empty(t, workers[1].Inflight())
+	})
+
+	t.Run("redistributes queued messages when a member disconnects", func(t *testing.T) {
+		handler, err := NewHandlerWithOptions(Options{MaxInflight: 1})
+		assert.NoError(t, err)
+		workers, bufs := connectWorkers(handler, "worker1", "worker2")
+
+		for _, payload := range []string{"1", "2", "3", "4"} {
+			handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "jobs", Payload: []byte(payload)})
+		}
+		assert.Equal(t, []string{"1"}, readPayloads(t, bufs[0]))
+		assert.Equal(t, []string{"2"}, readPayloads(t, bufs[1]))
+
+		handler.handleClose(
+			handler.clientManager.Get(workers[0]).(*Connection), workers[0],
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "worker1"}, nil,
+		)
+
+		assert.Empty(t, workers[0].Inflight())
+		assert.Empty(t, workers[0].Queued())
+		queued := make([]string, 0)
+		for _, message := range workers[1].Queued() {
+			queued = append(queued, string(message.Publish.Payload))
+		}
+		assert.Equal(t, []string{"4", "1", "3"}, queued)
+	})
+
+	t.Run("does not send retained messages and rejects No Local", func(t *testing.T) {
+		handler := NewHandler()
+		handler.retainStore.Set(&packets.Publish{Retain: true, QoS: 1, TopicName: "jobs", Payload: []byte("retained")})
+
+		connection, buf := newTestConnection()
+		client := handler.handleConnect(connection, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "worker1"})
+		buf.Reset()
+
+		handler.handleSubscribe(connection, client, &packets.Subscribe{
+			PacketID: 1,
+			Subscriptions: []packets.Subscription{
+				{TopicFilter: "$share/g/jobs", QoS: 1},
+				{TopicFilter: "$share/g/other", QoS: 1, NoLocal: true},
+			},
+		})
+
+		received, err := packets.ReadPacket(buf, packets.Version5)
+		assert.NoError(t, err)
+		assert.Equal(t, &packets.Suback{PacketID: 1, ReturnCodes: []byte{0x01, packets.ReasonTopicFilterInvalid}}, received)
+		assert.Zero(t, buf.Len(), "Expected no retained message")
+	})
+}
+
+func TestHandleTopicValidation(t *testing.T) {
+	t.Run("closes the connection on PUBLISH to an invalid topic name", func(t *testing.T) {
+		handler := NewHandler()
+		monitorConn, monitorBuf := newTestConnection()
+		monitor := handler.handleConnect(monitorConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "monitor"})
+		handler.handleSubscribe(monitorConn, monitor, &packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "#"}}})
+		monitorBuf.Reset()
+
+		received := runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: true, ClientID: "client1"},
+			&packets.Publish{TopicName: "a/+/b", Payload: []byte("dropped")},
+			&packets.Pingreq{},
+		)
+		assert.Equal(t, []packets.Packet{&packets.Connack{}}, received)
+		assert.Zero(t, monitorBuf.Len(), "Expected the message not to be routed")
+
+		received = runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "client1"},
+			&packets.Publish{TopicName: "a/#", Payload: []byte("dropped")},
+		)
+		assert.Equal(t, []packets.Packet{
+			connackV5(packets.Properties{}),
+			&packets.Disconnect{ReasonCode: packets.ReasonTopicNameInvalid},
+		}, received)
+	})
+
+	t.Run("rejects CONNECT with an invalid Will Topic", func(t *testing.T) {
+		handler := NewHandler()
+		received := runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "client1", WillFlag: true, WillTopic: "status/+", WillMessage: []byte("bye")},
+		)
+		assert.Equal(t, []packets.Packet{&packets.Connack{ReturnCode: packets.ReasonTopicNameInvalid}}, received)
+		assert.Empty(t, handler.clientManager.List())
+	})
+
+	t.Run("limits the depth of topics", func(t *testing.T) {
+		handler, err := NewHandlerWithOptions(Options{MaxTopicDepth: 2})
+		assert.NoError(t, err)
+
+		received := runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: true, ClientID: "client1"},
+			&packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "a/+"}, {TopicFilter: "a/b/#"}}},
+			&packets.Publish{TopicName: "a/b/c", Payload: []byte("dropped")},
+		)
+		assert.Equal(t, []packets.Packet{
+			&packets.Connack{},
+			&packets.Suback{PacketID: 1, ReturnCodes: []byte{0x00, packets.SubackFailure}},
+		}, received)
+
+		_, err = NewHandlerWithOptions(Options{MaxTopicDepth: -1})
+		assert.Error(t, err)
+	})
+
+	t.Run("closes the connection on a topic filter which is not UTF-8", func(t *testing.T) {
+		handler := NewHandler()
+		received := runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "client1"},
+			&packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "a/\xff"}}},
+		)
+		assert.Equal(t, []packets.Packet{
+			connackV5(packets.Properties{}),
+			&packets.Disconnect{ReasonCode: packets.ReasonMalformedPacket},
+		}, received)
+	})
+}
+
+// connackV5 returns the CONNACK accepting an MQTT 5.0 client with the default
+// options, which has the properties in addition.
+func connackV5(properties packets.Properties) *packets.Connack {
+	properties.MaximumPacketSize = packets.Uint32(defaultMaxPacketSize)
+	return &packets.Connack{Properties: properties}
+}
+
+// rawPacket is a packet written as is, to send packets which the packets
+// package does not encode.
+type rawPacket []byte
+
+func (p rawPacket) Type() byte { return p[0] >> 4 }
+
+func (p rawPacket) Encode(w io.Writer, version byte) error {
+	_, err := w.Write(p)
+	return err
+}
+
+func (p rawPacket) Decode(r io.Reader, version byte) error {
+	return errors.New("rawPacket can not be decoded")
+}
+
+// panicReader panics on Read.
+type panicReader struct{}
+
+func (panicReader) Read(b []byte) (int, error) { panic("broken reader") }
+
+func TestHandleProtocolErrors(t *testing.T) {
+	connect := &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "client1"}
+
+	t.Run("closes the connection on malformed packets", func(t *testing.T) {
+		for name, packet := range map[string]rawPacket{
+			"remaining length longer than 4 bytes": {0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F},
+			"invalid flags":                        {0xC1, 0x00},
+			"reserved packet type":                 {0x00, 0x00},
+			"truncated SUBSCRIBE":                  {0x82, 0x02, 0x00, 0x01},
+			"PUBLISH with QoS 3":                   {0x36, 0x05, 0x00, 0x01, 'a', 0x00, 0x01},
+		} {
+			handler := NewHandler()
+			received := runHandle(t, handler, connect, packet, &packets.Pingreq{})
+			assert.Equal(t, []packets.Packet{
+				connackV5(packets.Properties{}),
+				&packets.Disconnect{ReasonCode: packets.ReasonMalformedPacket},
+			}, received, name)
+			assert.Empty(t, handler.clientManager.List(), name)
+		}
+	})
+
+	t.Run("closes the connection on packets sent only by the server", func(t *testing.T) {
+		handler := NewHandler()
+		received := runHandle(t, handler, connect, &packets.Suback{PacketID: 1, ReturnCodes: []byte{0}}, &packets.Pingreq{})
+		assert.Equal(t, []packets.Packet{
+			connackV5(packets.Properties{}),
+			&packets.Disconnect{ReasonCode: packets.ReasonProtocolError},
+		}, received)
+	})
+
+	t.Run("recovers from a panic of the connection", func(t *testing.T) {
+		handler := NewHandler()
+		input := &bytes.Buffer{}
+		assert.NoError(t, connect.Encode(input, packets.Version5))
+		conn := &testConn{reader: io.MultiReader(input, panicReader{})}
+
+		handler.Handle(conn)
+
+		// The client is cleaned up as on an abnormal close
+		assert.Empty(t, handler.clientManager.List())
+		received, err := packets.ReadPacket(&conn.written, packets.Version5)
+		assert.NoError(t, err)
+		assert.Equal(t, connackV5(packets.Properties{}), received)
+		received, err = packets.ReadPacket(&conn.written, packets.Version5)
+		assert.NoError(t, err)
+		assert.Equal(t, &packets.Disconnect{ReasonCode: packets.ReasonImplementationSpecificError}, received)
+	})
+}
+
+func TestHandlePacketSize(t *testing.T) {
+	large := &packets.Publish{TopicName: "a/b", Payload: bytes.Repeat([]byte("x"), 100)}
+
+	t.Run("closes the connection on a packet larger than the maximum packet size", func(t *testing.T) {
+		handler, err := NewHandlerWithOptions(Options{MaxPacketSize: 64})
+		assert.NoError(t, err)
+
+		received := runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "client1"},
+			large,
+			&packets.Pingreq{},
+		)
+		assert.Equal(t, []packets.Packet{
+			&packets.Connack{Properties: packets.Properties{MaximumPacketSize: packets.Uint32(64)}},
+			&packets.Disconnect{ReasonCode: packets.ReasonPacketTooLarge},
+		}, received)
+
+		received = runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "client1"},
+			large,
+			&packets.Pingreq{},
+		)
+		assert.Equal(t, []packets.Packet{&packets.Connack{}}, received)
+
+		assert.Equal(t, Stats{InboundPacketsTooLarge: 2}, handler.Stats())
+	})
+
+	t.Run("does not send messages larger than the Maximum Packet Size of the client", func(t *testing.T) {
+		handler := NewHandler()
+		connection, buf := newTestConnection()
+		client := handler.handleConnect(connection, &packets.Connect{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: 5,
+			ClientID:      "client1",
+			Properties:    packets.Properties{MaximumPacketSize: packets.Uint32(64)},
+		})
+		handler.handleSubscribe(connection, client, &packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "a/b", QoS: 1}}})
+		buf.Reset()
+
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "a/b", Payload: large.Payload})
+		assert.Zero(t, buf.Len())
+		assert.Empty(t, client.Inflight())
+
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "a/b", Payload: []byte("small")})
+		received, err := packets.ReadPacket(buf, packets.Version5)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("small"), received.(*packets.Publish).Payload)
+
+		assert.Equal(t, Stats{OutboundPacketsTooLarge: 1}, handler.Stats())
+	})
+
+	t.Run("rejects an invalid maximum packet size", func(t *testing.T) {
+		for _, size := range []int{-1, maxPacketSizeLimit + 1} {
+			_, err := NewHandlerWithOptions(Options{MaxPacketSize: size})
+			assert.Error(t, err, size)
+		}
+	})
+}
+
+func TestHandleSlowConsumer(t *testing.T) {
+	// connectBlocked connects a subscriber whose connection blocks on writing
+	// CONNACK, so that the messages to it stay in the outbound queue
+	connectBlocked := func(t *testing.T, handler *Handler) (*Client, *blockingConn) {
+		conn := newBlockingConn()
+		connection := NewConnection(conn)
+		client := handler.handleConnect(connection, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "slow"})
+		<-conn.writing
+		handler.handleSubscribe(connection, client, &packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "a/b", QoS: 1}}})
+		return client, conn
+	}
+
+	t.Run("drops messages and forgets them", func(t *testing.T) {
+		handler, err := NewHandlerWithOptions(Options{MaxOutboundQueue: 2, SlowConsumerPolicy: SlowConsumerDropNewest})
+		assert.NoError(t, err)
+		client, conn := connectBlocked(t, handler)
+		defer close(conn.release)
+
+		for i := 0; i < 3; i++ {
+			handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "a/b", Payload: []byte("hello")})
+		}
+
+		assert.Len(t, client.Inflight(), 2)
+		assert.Equal(t, Stats{OutboundMessagesDropped: 1}, handler.Stats())
+	})
+
+	t.Run("disconnects the client and keeps the messages for its session", func(t *testing.T) {
+		handler, err := NewHandlerWithOptions(Options{MaxOutboundQueue: 2})
+		assert.NoError(t, err)
+		client, conn := connectBlocked(t, handler)
+		defer close(conn.release)
+
+		for i := 0; i < 3; i++ {
+			handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "a/b", Payload: []byte("hello")})
+		}
+
+		assert.Len(t, client.Inflight(), 3)
+		assert.Equal(t, Stats{SlowConsumerDisconnects: 1}, handler.Stats())
+	})
+
+	t.Run("does not limit the queue with -1", func(t *testing.T) {
+		handler, err := NewHandlerWithOptions(Options{MaxOutboundQueue: -1})
+		assert.NoError(t, err)
+		client, conn := connectBlocked(t, handler)
+		defer close(conn.release)
+
+		for i := 0; i < defaultMaxOutboundQueue+1; i++ {
+			handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "a/b", Payload: []byte("hello")})
+		}
+
+		assert.Len(t, client.Inflight(), defaultMaxOutboundQueue+1)
+		assert.Equal(t, Stats{}, handler.Stats())
+
+		_, err = NewHandlerWithOptions(Options{MaxOutboundQueue: -2})
+		assert.Error(t, err)
+	})
+
+	t.Run("rejects an unknown policy", func(t *testing.T) {
+		_, err := NewHandlerWithOptions(Options{SlowConsumerPolicy: "block"})
+		assert.Error(t, err)
+	})
+}
+
+func TestHandleMaxInflight(t *testing.T) {
+	handler, err := NewHandlerWithOptions(Options{MaxInflight: 2})
+	assert.NoError(t, err)
+
+	subscriberConn, subscriberBuf := newTestConnection()
+	subscriber := handler.handleConnect(subscriberConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "subscriber"})
+	handler.handleSubscribe(subscriberConn, subscriber, &packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "a/b", QoS: 1}}})
+	subscriberBuf.Reset()
+
+	for _, payload := range []string{"1", "2", "3"} {
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "a/b", Payload: []byte(payload)})
+	}
+	// QoS 0 messages are not limited by the inflight window
+	handler.publishToSubscribers(nil, &packets.Publish{QoS: 0, TopicName: "a/b", Payload: []byte("4")})
+
+	readPublishes := func() []packets.Packet {
+		received := make([]packets.Packet, 0)
+		for subscriberBuf.Len() > 0 {
+			packet, err := packets.ReadPacket(subscriberBuf, packets.Version311)
+			assert.NoError(t, err)
+			received = append(received, packet)
+		}
+		return received
+	}
+	assert.Equal(t, []packets.Packet{
+		&packets.Publish{QoS: 1, PacketID: 1, TopicName: "a/b", Payload: []byte("1")},
+		&packets.Publish{QoS: 1, PacketID: 2, TopicName: "a/b", Payload: []byte("2")},
+		&packets.Publish{QoS: 0, TopicName: "a/b", Payload: []byte("4")},
+	}, readPublishes())
+
+	// The acknowledgement makes room for the queued message
+	assert.NoError(t, handler.handlePuback(subscriber, &packets.Puback{PacketID: 1}))
+	assert.Equal(t, []packets.Packet{
+		&packets.Publish{QoS: 1, PacketID: 3, TopicName: "a/b", Payload: []byte("3")},
+	}, readPublishes())
+	assert.Equal(t, 2, subscriber.InflightCount())
+
+	// After the session is taken over, PUBACK still being handled for the old
+	// connection sends the queued message to the new one
+	handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "a/b", Payload: []byte("5")})
+	reconnectConn, reconnectBuf := newTestConnection()
+	handler.handleConnect(reconnectConn, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "subscriber"})
+	reconnectBuf.Reset()
+	assert.NoError(t, handler.handlePuback(subscriber, &packets.Puback{PacketID: 2}))
+	assert.Empty(t, readPublishes())
+	packet, err := packets.ReadPacket(reconnectBuf, packets.Version311)
+	assert.NoError(t, err)
+	assert.Equal(t, &packets.Publish{QoS: 1, PacketID: 4, TopicName: "a/b", Payload: []byte("5")}, packet)
+}
+
+func TestHandleQueuedMessagesFirst(t *testing.T) {
+	handler := NewHandler()
+	connection, buf := newTestConnection()
+	client := handler.handleConnect(connection, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "client1"})
+	handler.handleSubscribe(connection, client, &packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "a/b", QoS: 1}}})
+	buf.Reset()
+
+	// A message queued while the client was offline, which has not been sent
+	// yet after the client reconnected
+	assert.True(t, client.Enqueue(&packets.Publish{QoS: 1, TopicName: "a/b", Payload: []byte("queued")}, "", 0))
+	handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "a/b", Payload: []byte("new")})
+
+	received := make([]packets.Packet, 0)
+	for buf.Len() > 0 {
+		packet, err := packets.ReadPacket(buf, packets.Version311)
+		assert.NoError(t, err)
+		received = append(received, packet)
+	}
+	assert.Equal(t, []packets.Packet{
+		&packets.Publish{QoS: 1, PacketID: 1, TopicName: "a/b", Payload: []byte("queued")},
+		&packets.Publish{QoS: 1, PacketID: 2, TopicName: "a/b", Payload: []byte("new")},
+	}, received)
+}
+
+func TestHandleReceiveMaximum(t *testing.T) {
+	handler, err := NewHandlerWithOptions(Options{MaxInflight: 10})
+	assert.NoError(t, err)
+
+	// The Receive Maximum of the client is smaller than MaxInflight
+	subscriberConn, subscriberBuf := newTestConnection()
+	subscriber := handler.handleConnect(subscriberConn, &packets.Connect{
+		ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "subscriber",
+		Properties: packets.Properties{ReceiveMaximum: packets.Uint16(1)},
+	})
+	handler.handleSubscribe(subscriberConn, subscriber, &packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{TopicFilter: "a/b", QoS: 1}}})
+	subscriberBuf.Reset()
+
+	for _, payload := range []string{"1", "2"} {
+		handler.publishToSubscribers(nil, &packets.Publish{QoS: 1, TopicName: "a/b", Payload: []byte(payload)})
+	}
+	packet, err := packets.ReadPacket(subscriberBuf, packets.Version5)
+	assert.NoError(t, err)
+	assert.Equal(t, &packets.Publish{QoS: 1, PacketID: 1, TopicName: "a/b", Payload: []byte("1")}, packet)
+	assert.Zero(t, subscriberBuf.Len(), "Expected the second message to wait for PUBACK")
+
+	assert.NoError(t, handler.handlePuback(subscriber, &packets.Puback{PacketID: 1}))
+	packet, err = packets.ReadPacket(subscriberBuf, packets.Version5)
+	assert.NoError(t, err)
+	assert.Equal(t, &packets.Publish{QoS: 1, PacketID: 2, TopicName: "a/b", Payload: []byte("2")}, packet)
+}
+
+func TestHandleMaxConnections(t *testing.T) {
+	handler, err := NewHandlerWithOptions(Options{MaxConnections: 1})
+	assert.NoError(t, err)
+	connection, _ := newTestConnection()
+	assert.True(t, handler.addConnection(connection))
+
+	t.Run("MQTT 3.1.1", func(t *testing.T) {
+		received := runHandle(t, handler, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: true, ClientID: "client1"})
+		assert.Equal(t, []packets.Packet{&packets.Connack{ReturnCode: packets.ConnectServerUnavailable}}, received)
+	})
+
+	t.Run("MQTT 5.0", func(t *testing.T) {
+		received := runHandle(t, handler, &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, CleanSession: true, ClientID: "client1"})
+		assert.Equal(t, []packets.Packet{&packets.Connack{ReturnCode: packets.ReasonServerBusy}}, received)
+	})
+
+	t.Run("accepts a connection after another one is closed", func(t *testing.T) {
+		handler.removeConnection(connection)
+		received := runHandle(t, handler,
+			&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: true, ClientID: "client1"},
+			&packets.Disconnect{},
+		)
+		assert.Equal(t, []packets.Packet{&packets.Connack{}}, received)
+	})
+}
+
+func TestHandleAuthentication(t *testing.T) {
+	connect := func(level byte, username, password string) *packets.Connect {
+		return &packets.Connect{
+			ProtocolName: "MQTT", ProtocolLevel: level, CleanSession: true, ClientID: "client1",
+			UsernameFlag: username != "", Username: username,
+			PasswordFlag: password != "", Password: []byte(password),
+		}
+	}
+	authenticator := Authenticators{
+		StaticUsers{"alice": "secret"},
+		// A known user who is not allowed to connect
+		authenticatorFunc(func(clientID, username string, password []byte) error {
+			if username == "mallory" {
+				return ErrNotAuthorized
+			}
+			return ErrBadUsernameOrPassword
+		}),
+	}
+	// The credentials can not be checked
+	broken := authenticatorFunc(func(clientID, username string, password []byte) error {
+		return errors.New("backend is down")
+	})
+
+	tests := []struct {
+		name          string
+		authenticator Authenticator
+		connect       *packets.Connect
+		expected      packets.Packet
+	}{
+		{name: "valid password", authenticator: authenticator, connect: connect(4, "alice", "secret"), expected: &packets.Connack{}},
+		{name: "wrong password", authenticator: authenticator, connect: connect(4, "alice", "wrong"), expected: &packets.Connack{ReturnCode: packets.ConnectBadUsernameOrPassword}},
+		{name: "no user name", authenticator: authenticator, connect: connect(4, "", ""), expected: &packets.Connack{ReturnCode: packets.ConnectBadUsernameOrPassword}},
+		{name: "not authorized", authenticator: authenticator, connect: connect(4, "mallory", "secret"), expected: &packets.Connack{ReturnCode: packets.ConnectNotAuthorized}},
+		{name: "backend error", authenticator: broken, connect: connect(4, "alice", "secret"), expected: &packets.Connack{ReturnCode: packets.ConnectServerUnavailable}},
+		{name: "no authenticator", authenticator: nil, connect: connect(4, "", ""), expected: &packets.Connack{}},
+		{name: "MQTT 5.0 valid password", authenticator: authenticator, connect: connect(5, "alice", "secret"), expected: connackV5(packets.Properties{})},
+		{name: "MQTT 5.0 wrong password", authenticator: authenticator, connect: connect(5, "alice", "wrong"), expected: &packets.Connack{ReturnCode: packets.ReasonBadUserNameOrPassword}},
+		{name: "MQTT 5.0 not authorized", authenticator: authenticator, connect: connect(5, "mallory", "secret"), expected: &packets.Connack{ReturnCode: packets.ReasonNotAuthorized}},
+		{name: "MQTT 5.0 backend error", authenticator: broken, connect: connect(5, "alice", "secret"), expected: &packets.Connack{ReturnCode: packets.ReasonServerUnavailable}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, err := NewHandlerWithOptions(Options{Authenticator: tt.authenticator})
+			assert.NoError(t, err)
+			received := runHandle(t, handler, tt.connect, &packets.Disconnect{})
+			assert.Equal(t, []packets.Packet{tt.expected}, received)
+		})
+	}
+}
+
+type authenticatorFunc func(clientID, username string, password []byte) error
+
+func (f authenticatorFunc) Authenticate(clientID string, username string, password []byte) error {
+	return f(clientID, username, password)
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
+)
+
+// Hook is called by the Handler at the events of the broker, so that the
+// behavior can be extended without modifying the Handler. Embed HookBase to
+// implement only some of the methods.
+//
+// The methods are called from the goroutines handling the connections, so
+// they must be safe for concurrent use and should return quickly.
+type Hook interface {
+	// OnConnectAuthenticate is called with CONNECT before the session is
+	// loaded. Returning false rejects the connection with Bad User Name or
+	// Password.
+	OnConnectAuthenticate(connect *packets.Connect) bool
+	// OnACLCheck is called before the client publishes to the topic name
+	// (write is true) or subscribes to the topic filter (write is false).
+	// Returning false rejects it with Not Authorized. It is also called with
+	// the Will Topic on CONNECT, before CONNACK is sent, and returning false
+	// then refuses the connection.
+	OnACLCheck(client *Client, topic string, write bool) bool
+	// OnConnect is called after CONNACK is sent to the client.
+	OnConnect(client *Client, connect *packets.Connect)
+	// OnDisconnect is called when the network connection of the client is
+	// closed. disconnect is the DISCONNECT packet from the client, or nil if
+	// the connection was closed without it.
+	OnDisconnect(client *Client, disconnect *packets.Disconnect)
+	// OnSubscribe is called after SUBACK is sent to the client. The return
+	// codes of suback tell which subscriptions were granted.
+	OnSubscribe(client *Client, subscribe *packets.Subscribe, suback *packets.Suback)
+	// OnUnsubscribe is called after UNSUBACK is sent to the client.
+	OnUnsubscribe(client *Client, unsubscribe *packets.Unsubscribe)
+	// OnPublish is called with PUBLISH from the client before it is delivered
+	// to the subscribers. The returned packet is delivered instead, so it may
+	// be a modified copy. Returning an error or a nil packet rejects the
+	// message. The Will Message is also passed when it is published.
+	OnPublish(client *Client, publish *packets.Publish) (*packets.Publish, error)
+	// OnMessageDelivered is called when a message has been delivered to the
+	// client: a QoS 0 message when it is sent, a QoS 1 message when PUBACK is
+	// received and a QoS 2 message when PUBCOMP is received.
+	OnMessageDelivered(client *Client, publish *packets.Publish)
+	// OnSessionExpired is called when the session of the client is discarded:
+	// when the Session Expiry Interval has passed, when the client without a
+	// persistent session disconnects, or when the client connects again with
+	// Clean Session.
+	OnSessionExpired(client *Client)
+}
+
+// HookBase implements Hook doing nothing, allowing everything.
+type HookBase struct{}
+
+func (HookBase) OnConnectAuthenticate(connect *packets.Connect) bool { return true }
+
+func (HookBase) OnACLCheck(client *Client, topic string, write bool) bool { return true }
+
+func (HookBase) OnConnect(client *Client, connect *packets.Connect) {}
+
+func (HookBase) OnDisconnect(client *Client, disconnect *packets.Disconnect) {}
+
+func (HookBase) OnSubscribe(client *Client, subscribe *packets.Subscribe, suback *packets.Suback) {}
+
+func (HookBase) OnUnsubscribe(client *Client, unsubscribe *packets.Unsubscribe) {}
+
+func (HookBase) OnPublish(client *Client, publish *packets.Publish) (*packets.Publish, error) {
+	return publish, nil
+}
+
+func (HookBase) OnMessageDelivered(client *Client, publish *packets.Publish) {}
+
+func (HookBase) OnSessionExpired(client *Client) {}
+
+// hooks chains the hooks in order. Every hook must allow a connection, a
+// topic or a message for it to be allowed.
+type hooks []Hook
+
+func (hs hooks) OnConnectAuthenticate(connect *packets.Connect) bool {
+	for _, h := range hs {
+		if !h.OnConnectAuthenticate(connect) {
+			return false
+		}
+	}
+	return true
+}
+
+func (hs hooks) OnACLCheck(client *Client, topic string, write bool) bool {
+	for _, h := range hs {
+		if !h.OnACLCheck(client, topic, write) {
+			return false
+		}
+	}
+	return true
+}
+
+func (hs hooks) OnConnect(client *Client, connect *packets.Connect) {
+	for _, h := range hs {
+		h.OnConnect(client, connect)
+	}
+}
+
+func (hs hooks) OnDisconnect(client *Client, disconnect *packets.Disconnect) {
+	for _, h := range hs {
+		h.OnDisconnect(client, disconnect)
+	}
+}
+
+func (hs hooks) OnSubscribe(client *Client, subscribe *packets.Subscribe, suback *packets.Suback) {
+	for _, h := range hs {
+		h.OnSubscribe(client, subscribe, suback)
+	}
+}
+
+func (hs hooks) OnUnsubscribe(client *Client, unsubscribe *packets.Unsubscribe) {
+	for _, h := range hs {
+		h.OnUnsubscribe(client, unsubscribe)
+	}
+}
+
+// OnPublish passes the packet returned by each hook to the next one.
+func (hs hooks) OnPublish(client *Client, publish *packets.Publish) (*packets.Publish, error) {
+	for _, h := range hs {
+		var err error
+		publish, err = h.OnPublish(client, publish)
+		if err != nil {
+			return nil, err
+		}
+		if publish == nil {
+			return nil, fmt.Errorf("hook %T returned no message", h)
+		}
+	}
+	return publish, nil
+}
+
+func (hs hooks) OnMessageDelivered(client *Client, publish *packets.Publish) {
+	for _, h := range hs {
+		h.OnMessageDelivered(client, publish)
+	}
+}
+
+func (hs hooks) OnSessionExpired(client *Client) {
+	for _, h := range hs {
+		h.OnSessionExpired(client)
+	}
+}
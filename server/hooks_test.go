@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// pipeListener is an in-memory net.Listener whose connections are made by
+// dial with net.Pipe.
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func (l *pipeListener) dial() net.Conn {
+	server, client := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+// recordingHook records the events of the clients and changes the behavior
+// by the topics and the payloads.
+type recordingHook struct {
+	HookBase
+	name string
+
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *recordingHook) record(format string, args ...any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.events = append(h.events, fmt.Sprintf(format, args...))
+}
+
+// eventsOf returns the events of the client in the order they happened.
+func (h *recordingHook) eventsOf(clientID ClientID) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	events := make([]string, 0)
+	for _, event := range h.events {
+		if strings.HasPrefix(event, string(clientID)+" ") {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func (h *recordingHook) OnConnectAuthenticate(connect *packets.Connect) bool {
+	return connect.ClientID != "intruder"
+}
+
+func (h *recordingHook) OnACLCheck(client *Client, topic string, write bool) bool {
+	return !strings.HasPrefix(topic, "secret")
+}
+
+func (h *recordingHook) OnConnect(client *Client, connect *packets.Connect) {
+	h.record("%s connected", client.ID)
+}
+
+func (h *recordingHook) OnDisconnect(client *Client, disconnect *packets.Disconnect) {
+	h.record("%s disconnected (DISCONNECT: %v)", client.ID, disconnect != nil)
+}
+
+func (h *recordingHook) OnSubscribe(client *Client, subscribe *packets.Subscribe, suback *packets.Suback) {
+	h.record("%s subscribed to %d filters", client.ID, len(suback.ReturnCodes))
+}
+
+func (h *recordingHook) OnUnsubscribe(client *Client, unsubscribe *packets.Unsubscribe) {
+	h.record("%s unsubscribed from %s", client.ID, strings.Join(unsubscribe.TopicFilters, ","))
+}
+
+func (h *recordingHook) OnPublish(client *Client, publish *packets.Publish) (*packets.Publish, error) {
+	if string(publish.Payload) == "reject" {
+		return nil, errors.New("rejected by " + h.name)
+	}
+	if string(publish.Payload) == "drop" {
+		return nil, nil
+	}
+	if string(publish.Payload) == "rebuild" {
+		// A new message without the QoS and the packet identifier
+		return &packets.Publish{TopicName: publish.TopicName, Payload: []byte("rebuilt" + h.name)}, nil
+	}
+	modified := *publish
+	modified.Payload = append(append([]byte{}, publish.Payload...), h.name...)
+	return &modified, nil
+}
+
+func (h *recordingHook) OnMessageDelivered(client *Client, publish *packets.Publish) {
+	h.record("%s received %s", client.ID, publish.Payload)
+}
+
+func (h *recordingHook) OnSessionExpired(client *Client) {
+	h.record("%s session expired", client.ID)
+}
+
+func TestHooks(t *testing.T) {
+	first := &recordingHook{name: "1"}
+	second := &recordingHook{name: "2"}
+	s, err := New(Options{Hooks: []Hook{first, second}})
+	assert.NoError(t, err)
+	listener := newPipeListener()
+	go s.Serve(listener)
+
+	connectWith := func(connect *packets.Connect) (net.Conn, packets.Packet) {
+		conn := listener.dial()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		assert.NoError(t, connect.Encode(conn, packets.Version5))
+		return conn, receivePacket(t, conn)
+	}
+	connect := func(clientID string) (net.Conn, packets.Packet) {
+		return connectWith(&packets.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, CleanSession: true, ClientID: clientID})
+	}
+
+	subscriber, _ := connect("subscriber")
+	defer subscriber.Close()
+	sendPacket(t, subscriber, &packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{
+		{TopicFilter: "a/#", QoS: 1},
+		{TopicFilter: "secret/#", QoS: 1},
+	}})
+	assert.Equal(t, &packets.Suback{PacketID: 1, ReturnCodes: []byte{1, packets.ReasonNotAuthorized}}, receivePacket(t, subscriber))
+
+	publisher, _ := connect("publisher")
+	defer publisher.Close()
+
+	t.Run("delivers the message modified by the hooks in order", func(t *testing.T) {
+		sendPacket(t, publisher, &packets.Publish{QoS: 1, PacketID: 1, TopicName: "a/b", Payload: []byte("hello")})
+		assert.Equal(t, &packets.Puback{PacketID: 1}, receivePacket(t, publisher))
+
+		assert.Equal(t, &packets.Publish{QoS: 1, PacketID: 1, TopicName: "a/b", Payload: []byte("hello12")}, receivePacket(t, subscriber))
+		sendPacket(t, subscriber, &packets.Puback{PacketID: 1})
+	})
+
+	t.Run("rejects the message", func(t *testing.T) {
+		sendPacket(t, publisher, &packets.Publish{QoS: 1, PacketID: 2, TopicName: "secret/b", Payload: []byte("hello")})
+		assert.Equal(t, &packets.Puback{PacketID: 2, ReasonCode: packets.ReasonNotAuthorized}, receivePacket(t, publisher))
+
+		sendPacket(t, publisher, &packets.Publish{QoS: 1, PacketID: 3, TopicName: "a/b", Payload: []byte("reject")})
+		assert.Equal(t, &packets.Puback{PacketID: 3, ReasonCode: packets.ReasonImplementationSpecificError}, receivePacket(t, publisher))
+
+		// Only the next message reaches the subscriber
+		sendPacket(t, publisher, &packets.Publish{QoS: 1, PacketID: 4, TopicName: "a/c", Payload: []byte("next")})
+		assert.Equal(t, &packets.Puback{PacketID: 4}, receivePacket(t, publisher))
+		assert.Equal(t, &packets.Publish{QoS: 1, PacketID: 2, TopicName: "a/c", Payload: []byte("next12")}, receivePacket(t, subscriber))
+		sendPacket(t, subscriber, &packets.Puback{PacketID: 2})
+	})
+
+	t.Run("rejects the message dropped by a hook", func(t *testing.T) {
+		sendPacket(t, publisher, &packets.Publish{QoS: 1, PacketID: 5, TopicName: "a/b", Payload: []byte("drop")})
+		assert.Equal(t, &packets.Puback{PacketID: 5, ReasonCode: packets.ReasonImplementationSpecificError}, receivePacket(t, publisher))
+	})
+
+	t.Run("acknowledges the message rebuilt by the hooks as it was published", func(t *testing.T) {
+		sendPacket(t, publisher, &packets.Publish{QoS: 2, PacketID: 6, TopicName: "a/b", Payload: []byte("rebuild")})
+		assert.Equal(t, &packets.Pubrec{PacketID: 6}, receivePacket(t, publisher))
+		sendPacket(t, publisher, &packets.Pubrel{PacketID: 6})
+		assert.Equal(t, &packets.Pubcomp{PacketID: 6}, receivePacket(t, publisher))
+
+		assert.Equal(t, &packets.Publish{TopicName: "a/b", Payload: []byte("rebuilt12")}, receivePacket(t, subscriber))
+	})
+
+	t.Run("refuses the client", func(t *testing.T) {
+		conn, connack := connect("intruder")
+		defer conn.Close()
+		assert.Equal(t, packets.ReasonBadUserNameOrPassword, connack.(*packets.Connack).ReturnCode)
+	})
+
+	t.Run("refuses the Will Topic", func(t *testing.T) {
+		conn, connack := connectWith(&packets.Connect{
+			ProtocolName: "MQTT", ProtocolLevel: 5, CleanSession: true, ClientID: "spy",
+			WillFlag: true, WillTopic: "secret/will", WillMessage: []byte("bye"),
+		})
+		defer conn.Close()
+		assert.Equal(t, packets.ReasonNotAuthorized, connack.(*packets.Connack).ReturnCode)
+	})
+
+	t.Run("publishes the Will Message modified by the hooks", func(t *testing.T) {
+		conn, connack := connectWith(&packets.Connect{
+			ProtocolName: "MQTT", ProtocolLevel: 5, CleanSession: true, ClientID: "dying",
+			WillFlag: true, WillQoS: 1, WillTopic: "a/will", WillMessage: []byte("bye"),
+		})
+		assert.Equal(t, packets.ConnectAccepted, connack.(*packets.Connack).ReturnCode)
+		conn.Close()
+
+		assert.Equal(t, &packets.Publish{QoS: 1, PacketID: 3, TopicName: "a/will", Payload: []byte("bye12")}, receivePacket(t, subscriber))
+		sendPacket(t, subscriber, &packets.Puback{PacketID: 3})
+	})
+
+	sendPacket(t, subscriber, &packets.Unsubscribe{PacketID: 2, TopicFilters: []string{"a/#"}})
+	assert.IsType(t, &packets.Unsuback{}, receivePacket(t, subscriber))
+	sendPacket(t, subscriber, &packets.Disconnect{})
+
+	// net.Pipe has no buffer, so DISCONNECT on shutdown is written only if
+	// the client reads it
+	go io.Copy(io.Discard, publisher)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+
+	for _, hook := range []*recordingHook{first, second} {
+		assert.Equal(t, []string{
+			"subscriber connected",
+			"subscriber subscribed to 2 filters",
+			"subscriber received hello12",
+			"subscriber received next12",
+			"subscriber received rebuilt12",
+			"subscriber received bye12",
+			"subscriber unsubscribed from a/#",
+			"subscriber disconnected (DISCONNECT: true)",
+			"subscriber session expired",
+		}, hook.eventsOf("subscriber"))
+		assert.Equal(t, []string{
+			"publisher connected",
+			"publisher disconnected (DISCONNECT: false)",
+			"publisher session expired",
+		}, hook.eventsOf("publisher"))
+		assert.Empty(t, hook.eventsOf("intruder"))
+		assert.Empty(t, hook.eventsOf("spy"))
+	}
+}
+
+func sendPacket(t *testing.T, conn net.Conn, packet packets.Packet) {
+	t.Helper()
+	assert.NoError(t, packet.Encode(conn, packets.Version5))
+}
+
+func receivePacket(t *testing.T, conn net.Conn) packets.Packet {
+	t.Helper()
+	packet, err := packets.ReadPacket(conn, packets.Version5)
+	assert.NoError(t, err)
+	return packet
+}
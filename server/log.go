@@ -0,0 +1,57 @@
+package server
+
+import "log"
+
+// LogLevel is the least severe level of the messages the broker logs.
+type LogLevel string
+
+const (
+	// LogLevelDebug logs every packet in addition to the info messages.
+	LogLevelDebug LogLevel = "debug"
+	// LogLevelInfo logs the connections of the clients and the problems
+	// caused by them in addition to the errors.
+	LogLevelInfo LogLevel = "info"
+	// LogLevelError logs only the errors of the broker.
+	LogLevelError LogLevel = "error"
+)
+
+// Valid reports whether the level is one of the known levels.
+func (l LogLevel) Valid() bool {
+	return l.severity() > 0
+}
+
+func (l LogLevel) severity() int {
+	switch l {
+	case LogLevelDebug:
+		return 1
+	case LogLevelInfo:
+		return 2
+	case LogLevelError:
+		return 3
+	}
+	return 0
+}
+
+// logger writes the messages at or above its level with the standard logger.
+type logger struct {
+	level LogLevel
+}
+
+func (l logger) debugf(format string, args ...any) {
+	l.printf(LogLevelDebug, format, args...)
+}
+
+func (l logger) infof(format string, args ...any) {
+	l.printf(LogLevelInfo, format, args...)
+}
+
+func (l logger) errorf(format string, args ...any) {
+	l.printf(LogLevelError, format, args...)
+}
+
+func (l logger) printf(level LogLevel, format string, args ...any) {
+	if level.severity() < l.level.severity() {
+		return
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}()
+
+	tests := []struct {
+		level    LogLevel
+		expected string
+	}{
+		{level: LogLevelDebug, expected: "debug\ninfo\nerror\n"},
+		{level: LogLevelInfo, expected: "info\nerror\n"},
+		{level: LogLevelError, expected: "error\n"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.level), func(t *testing.T) {
+			buf.Reset()
+			l := logger{level: tt.level}
+			l.debugf("debug")
+			l.infof("info")
+			l.errorf("error")
+			assert.Equal(t, tt.expected, buf.String())
+		})
+	}
+
+	t.Run("rejects an unknown level", func(t *testing.T) {
+		_, err := NewHandlerWithOptions(Options{LogLevel: "verbose"})
+		assert.Error(t, err)
+	})
+}
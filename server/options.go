@@ -0,0 +1,94 @@
+package server
+
+import "github.com/shibayu36/go-mqtt-playground/packets"
+
+// Options configures the Handler. The zero value is the default
+// configuration.
+type Options struct {
+	// Addr is the TCP address ListenAndServe listens on. Defaults to ":1883".
+	Addr string
+	// SharedSubscriptionStrategy decides which member of a shared
+	// subscription group receives a message. Defaults to round-robin.
+	SharedSubscriptionStrategy SharedSubscriptionStrategy
+	// MaxConnections is the maximum number of clients connected at the same
+	// time. 0 means no limit.
+	MaxConnections int
+	// MaxTopicDepth is the maximum number of levels of topic names and topic
+	// filters. 0 means no limit.
+	MaxTopicDepth int
+	// MaxPacketSize is the maximum size in bytes of packets accepted from
+	// clients, which is told to MQTT 5.0 clients with Maximum Packet Size.
+	// Defaults to 1 MiB.
+	MaxPacketSize int
+	// MaxInflight is the maximum number of QoS 1 and QoS 2 messages sent to
+	// each client and not acknowledged yet. The other messages wait in the
+	// queue of the client. The Receive Maximum of an MQTT 5.0 client lowers
+	// the limit for the client. 0 means no limit.
+	MaxInflight int
+	// MaxQueuedMessages is the maximum number of QoS 1 and QoS 2 messages
+	// queued for each client while it is offline or its inflight window is
+	// full. Defaults to 1000, and -1 means no limit.
+	MaxQueuedMessages int
+	// MaxOutboundQueue is the maximum number of messages waiting to be
+	// written to each client. Defaults to 1000, and -1 means no limit.
+	MaxOutboundQueue int
+	// Authenticator checks the User Name and Password of the clients. nil
+	// allows all the clients to connect.
+	Authenticator Authenticator
+	// Hooks are called in order at the events of the broker.
+	Hooks []Hook
+	// SlowConsumerPolicy decides what happens when a message is sent to a
+	// client whose outbound queue is full. Defaults to disconnect.
+	SlowConsumerPolicy SlowConsumerPolicy
+	// LogLevel is the least severe level of the messages logged by the
+	// broker. Defaults to info, which does not log every packet.
+	LogLevel LogLevel
+}
+
+// defaultAddr is the default of Options.Addr, the standard port of MQTT.
+const defaultAddr = ":1883"
+
+// defaultMaxPacketSize is the default of Options.MaxPacketSize.
+const defaultMaxPacketSize = 1024 * 1024
+
+// defaultMaxQueuedMessages is the default of Options.MaxQueuedMessages.
+const defaultMaxQueuedMessages = 1000
+
+// defaultMaxOutboundQueue is the default of Options.MaxOutboundQueue.
+const defaultMaxOutboundQueue = 1000
+
+// maxPacketSizeLimit is the size of the largest packet which can be encoded:
+// the fixed header of 5 bytes and the largest Remaining Length.
+const maxPacketSizeLimit = 5 + packets.MaxRemainingLength
+
+// DefaultOptions returns the options the zero value of Options stands for.
+func DefaultOptions() Options {
+	return Options{}.withDefaults()
+}
+
+// withDefaults returns the options whose unset fields are filled with the
+// default values.
+func (o Options) withDefaults() Options {
+	if o.Addr == "" {
+		o.Addr = defaultAddr
+	}
+	if o.SharedSubscriptionStrategy == "" {
+		o.SharedSubscriptionStrategy = SharedSubscriptionRoundRobin
+	}
+	if o.MaxPacketSize == 0 {
+		o.MaxPacketSize = defaultMaxPacketSize
+	}
+	if o.MaxQueuedMessages == 0 {
+		o.MaxQueuedMessages = defaultMaxQueuedMessages
+	}
+	if o.MaxOutboundQueue == 0 {
+		o.MaxOutboundQueue = defaultMaxOutboundQueue
+	}
+	if o.SlowConsumerPolicy == "" {
+		o.SlowConsumerPolicy = SlowConsumerDisconnect
+	}
+	if o.LogLevel == "" {
+		o.LogLevel = LogLevelInfo
+	}
+	return o
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PasswordFile authenticates the clients by the password file, which has a
+// line of "username:hash" for each user. The hashes are made by HashPassword.
+// Empty lines and lines starting with "#" are ignored.
+type PasswordFile struct {
+	// hashes maps the user names to the password hashes
+	hashes map[string]string
+	// dummyHash is verified for the unknown users, so that the time taken
+	// does not tell whether a user exists. It has as many iterations as the
+	// hash with the most iterations, or passwordHashIterations if there are
+	// no users.
+	dummyHash string
+	// maxIterations is the most iterations of the hashes added
+	maxIterations int
+	// verifications limits the verifications running at the same time, so
+	// that clients sending wrong passwords can not use up the CPUs
+	verifications chan struct{}
+}
+
+// NewPasswordFile returns an empty PasswordFile.
+func NewPasswordFile() *PasswordFile {
+	return &PasswordFile{
+		hashes:        make(map[string]string),
+		dummyHash:     dummyPasswordHash(passwordHashIterations),
+		verifications: make(chan struct{}, maxPasswordVerifications()),
+	}
+}
+
+// maxPasswordVerifications returns how many passwords can be verified at the
+// same time: half of the CPUs, leaving the rest to the clients already
+// connected.
+func maxPasswordVerifications() int {
+	if n := runtime.GOMAXPROCS(0) / 2; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// LoadPasswordFile reads the password file at the path.
+func LoadPasswordFile(path string) (*PasswordFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := NewPasswordFile()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:hash", path, lineNumber)
+		}
+		parsed, err := parsePasswordHash(hash)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		f.addHash(username, hash, parsed.iterations)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Save writes the users to the path, sorted by the user name. The file is
+// replaced at once so that a broker reading it never sees a partial file.
+func (f *PasswordFile) Save(path string) error {
+	usernames := f.Usernames()
+	var buf bytes.Buffer
+	for _, username := range usernames {
+		fmt.Fprintf(&buf, "%s:%s\n", username, f.hashes[username])
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	// CreateTemp makes the file readable only by the owner, which is kept
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Usernames returns the user names in the file in sorted order.
+func (f *PasswordFile) Usernames() []string {
+	usernames := make([]string, 0, len(f.hashes))
+	for username := range f.hashes {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// SetPassword adds the user, or changes the password of the existing user.
+func (f *PasswordFile) SetPassword(username string, password []byte) error {
+	if username == "" || strings.ContainsAny(username, ":\r\n") {
+		return fmt.Errorf("invalid user name %q", username)
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	f.addHash(username, hash, passwordHashIterations)
+	return nil
+}
+
+func (f *PasswordFile) addHash(username string, hash string, iterations int) {
+	f.hashes[username] = hash
+	if iterations > f.maxIterations {
+		f.maxIterations = iterations
+		f.dummyHash = dummyPasswordHash(iterations)
+	}
+}
+
+// Delete removes the user. It returns false if there is no such user.
+func (f *PasswordFile) Delete(username string) bool {
+	if _, ok := f.hashes[username]; !ok {
+		return false
+	}
+	delete(f.hashes, username)
+	return true
+}
+
+// Authenticate implements Authenticator. It waits while too many passwords are
+// being verified.
+func (f *PasswordFile) Authenticate(clientID string, username string, password []byte) error {
+	hash, known := f.hashes[username]
+	if !known {
+		hash = f.dummyHash
+	}
+
+	f.verifications <- struct{}{}
+	match, err := verifyPassword(hash, password)
+	<-f.verifications
+
+	if err != nil {
+		return err
+	}
+	if !known || !match {
+		return ErrBadUsernameOrPassword
+	}
+	return nil
+}
+
+// The password hashes are PBKDF2 with HMAC-SHA256, encoded as
+// "$pbkdf2-sha256$<iterations>$<salt>$<key>" with unpadded base64.
+const (
+	passwordHashScheme = "pbkdf2-sha256"
+	// passwordHashIterations follows the recommendation of OWASP for
+	// PBKDF2-HMAC-SHA256.
+	passwordHashIterations = 600000
+	passwordSaltLength     = 16
+	passwordKeyLength      = sha256.Size
+)
+
+var passwordEncoding = base64.RawStdEncoding
+
+// passwordHash is a decoded password hash.
+type passwordHash struct {
+	iterations int
+	salt       []byte
+	key        []byte
+}
+
+// HashPassword returns the hash of the password with a random salt, which is
+// written in the password file.
+func HashPassword(password []byte) (string, error) {
+	return hashPassword(password, passwordHashIterations)
+}
+
+func hashPassword(password []byte, iterations int) (string, error) {
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key(password, salt, iterations, passwordKeyLength, sha256.New)
+	return fmt.Sprintf("$%s$%d$%s$%s", passwordHashScheme, iterations,
+		passwordEncoding.EncodeToString(salt), passwordEncoding.EncodeToString(key)), nil
+}
+
+// dummyPasswordHash returns a hash with the iterations which no password
+// matches.
+func dummyPasswordHash(iterations int) string {
+	salt := make([]byte, passwordSaltLength)
+	key := make([]byte, passwordKeyLength)
+	return fmt.Sprintf("$%s$%d$%s$%s", passwordHashScheme, iterations,
+		passwordEncoding.EncodeToString(salt), passwordEncoding.EncodeToString(key))
+}
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+
+func parsePasswordHash(hash string) (passwordHash, error) {
+	// The hash starts with "$", so the first field is empty
+	fields := strings.Split(hash, "$")
+	if len(fields) != 5 || fields[0] != "" {
+		return passwordHash{}, errInvalidPasswordHash
+	}
+	if fields[1] != passwordHashScheme {
+		return passwordHash{}, fmt.Errorf("%w: unknown scheme %q", errInvalidPasswordHash, fields[1])
+	}
+	iterations, err := strconv.Atoi(fields[2])
+	if err != nil || iterations <= 0 {
+		return passwordHash{}, fmt.Errorf("%w: invalid iterations %q", errInvalidPasswordHash, fields[2])
+	}
+	salt, err := passwordEncoding.DecodeString(fields[3])
+	if err != nil {
+		return passwordHash{}, fmt.Errorf("%w: invalid salt", errInvalidPasswordHash)
+	}
+	key, err := passwordEncoding.DecodeString(fields[4])
+	if err != nil || len(key) == 0 {
+		return passwordHash{}, fmt.Errorf("%w: invalid key", errInvalidPasswordHash)
+	}
+	return passwordHash{iterations: iterations, salt: salt, key: key}, nil
+}
+
+// verifyPassword returns true if the password matches the hash.
+func verifyPassword(hash string, password []byte) (bool, error) {
+	parsed, err := parsePasswordHash(hash)
+	if err != nil {
+		return false, err
+	}
+	key := pbkdf2.Key(password, parsed.salt, parsed.iterations, len(parsed.key), sha256.New)
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1, nil
+}
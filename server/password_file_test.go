@@ -0,0 +1,115 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := hashPassword([]byte("secret"), 1000)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^\$pbkdf2-sha256\$1000\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`, hash)
+
+	match, err := verifyPassword(hash, []byte("secret"))
+	assert.NoError(t, err)
+	assert.True(t, match)
+	match, err = verifyPassword(hash, []byte("wrong"))
+	assert.NoError(t, err)
+	assert.False(t, match)
+
+	// The salt makes the hashes of the same password different
+	another, err := hashPassword([]byte("secret"), 1000)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, another)
+
+	for _, invalid := range []string{"secret", "$bcrypt$1000$c2FsdA$a2V5", "$pbkdf2-sha256$x$c2FsdA$a2V5", "$pbkdf2-sha256$1000$c2FsdA$"} {
+		_, err := verifyPassword(invalid, []byte("secret"))
+		assert.ErrorIs(t, err, errInvalidPasswordHash, invalid)
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	hash, err := hashPassword([]byte("secret"), 1000)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "passwd")
+	assert.NoError(t, os.WriteFile(path, []byte("# users\n\nbob:"+hash+"\nalice:"+hash+"\n"), 0o600))
+
+	f, err := LoadPasswordFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, f.Usernames())
+
+	t.Run("authenticates the users", func(t *testing.T) {
+		assert.NoError(t, f.Authenticate("client1", "alice", []byte("secret")))
+		assert.ErrorIs(t, f.Authenticate("client1", "alice", []byte("wrong")), ErrBadUsernameOrPassword)
+		assert.ErrorIs(t, f.Authenticate("client1", "carol", []byte("secret")), ErrBadUsernameOrPassword)
+		assert.ErrorIs(t, f.Authenticate("client1", "", nil), ErrBadUsernameOrPassword)
+	})
+
+	t.Run("verifies a dummy hash for unknown users", func(t *testing.T) {
+		parsed, err := parsePasswordHash(f.dummyHash)
+		assert.NoError(t, err)
+		assert.Equal(t, 1000, parsed.iterations)
+
+		// The dummy hash has the most iterations in the file wherever the
+		// hash is
+		stronger, err := hashPassword([]byte("secret"), 2000)
+		assert.NoError(t, err)
+		mixed := filepath.Join(t.TempDir(), "passwd")
+		assert.NoError(t, os.WriteFile(mixed, []byte("bob:"+stronger+"\nalice:"+hash+"\n"), 0o600))
+		mixedFile, err := LoadPasswordFile(mixed)
+		assert.NoError(t, err)
+		parsed, err = parsePasswordHash(mixedFile.dummyHash)
+		assert.NoError(t, err)
+		assert.Equal(t, 2000, parsed.iterations)
+
+		parsed, err = parsePasswordHash(NewPasswordFile().dummyHash)
+		assert.NoError(t, err)
+		assert.Equal(t, passwordHashIterations, parsed.iterations)
+	})
+
+	t.Run("limits the verifications running at once", func(t *testing.T) {
+		for i := 0; i < cap(f.verifications); i++ {
+			f.verifications <- struct{}{}
+		}
+		done := make(chan error)
+		go func() { done <- f.Authenticate("client1", "alice", []byte("secret")) }()
+
+		select {
+		case <-done:
+			t.Fatal("Expected the verification to wait")
+		case <-time.After(50 * time.Millisecond):
+		}
+		<-f.verifications
+		assert.NoError(t, <-done)
+		for i := 1; i < cap(f.verifications); i++ {
+			<-f.verifications
+		}
+	})
+
+	t.Run("saves the changes", func(t *testing.T) {
+		assert.True(t, f.Delete("bob"))
+		assert.False(t, f.Delete("bob"))
+		f.hashes["carol"] = hash
+		assert.Error(t, f.SetPassword("dave:1", []byte("secret")))
+		assert.NoError(t, f.Save(path))
+
+		saved, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "alice:"+hash+"\ncarol:"+hash+"\n", string(saved))
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	})
+
+	t.Run("reports invalid lines", func(t *testing.T) {
+		for _, content := range []string{"alice\n", ":" + hash + "\n", "alice:secret\n"} {
+			assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+			_, err := LoadPasswordFile(path)
+			assert.Error(t, err, content)
+		}
+	})
+}
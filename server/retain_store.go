@@ -0,0 +1,137 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
+)
+
+// RetainStore stores the last retained message of each topic name.
+type RetainStore struct {
+	root *retainStoreNode
+	mu   sync.RWMutex
+}
+
+func NewRetainStore() *RetainStore {
+	return &RetainStore{
+		root: newRetainStoreNode(),
+	}
+}
+
+// Set stores the message as the retained message of its topic name. A message
+// with an empty payload deletes the retained message instead.
+func (s *RetainStore) Set(publish *packets.Publish) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.Split(publish.TopicName, "/")
+
+	if len(publish.Payload) == 0 {
+		s.root.delete(parts)
+		return
+	}
+
+	current := s.root
+	for _, part := range parts {
+		if _, exists := current.subnodes[part]; !exists {
+			current.subnodes[part] = newRetainStoreNode()
+		}
+		current = current.subnodes[part]
+	}
+	current.message = publish
+	current.expiresAt = messageExpiry(publish, time.Now())
+}
+
+// Get returns the retained messages whose topic names match the topic filter.
+// The Message Expiry Interval of each message is counted down to the time
+// left, and the expired messages are not returned.
+func (s *RetainStore) Get(filter string) []*packets.Publish {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	parts := strings.Split(filter, "/")
+
+	now := time.Now()
+	messages := make([]*packets.Publish, 0)
+	collect := func(node *retainStoreNode) {
+		if node.message == nil {
+			return
+		}
+		if message, ok := withRemainingExpiry(node.message, node.expiresAt, now); ok {
+			messages = append(messages, message)
+		}
+	}
+
+	var collectAll func(*retainStoreNode)
+	collectAll = func(node *retainStoreNode) {
+		collect(node)
+		for _, subnode := range node.subnodes {
+			collectAll(subnode)
+		}
+	}
+
+	var traverse func(*retainStoreNode, []string, bool)
+	traverse = func(node *retainStoreNode, parts []string, isRoot bool) {
+		if len(parts) == 0 {
+			collect(node)
+			return
+		}
+
+		switch parts[0] {
+		case "#":
+			// "#" matches the parent level and any number of child levels
+			if !isRoot {
+				collect(node)
+			}
+			for part, subnode := range node.subnodes {
+				// Wildcards at the first level do not match topics beginning with "$"
+				if isRoot && strings.HasPrefix(part, "$") {
+					continue
+				}
+				collectAll(subnode)
+			}
+		case "+":
+			for part, subnode := range node.subnodes {
+				if isRoot && strings.HasPrefix(part, "$") {
+					continue
+				}
+				traverse(subnode, parts[1:], false)
+			}
+		default:
+			if subnode, exists := node.subnodes[parts[0]]; exists {
+				traverse(subnode, parts[1:], false)
+			}
+		}
+	}
+	traverse(s.root, parts, true)
+
+	return messages
+}
+
+type retainStoreNode struct {
+	message *packets.Publish
+	// expiresAt is when the message expires, or the zero time if it does not
+	expiresAt time.Time
+	subnodes  map[string]*retainStoreNode
+}
+
+func newRetainStoreNode() *retainStoreNode {
+	return &retainStoreNode{
+		subnodes: make(map[string]*retainStoreNode),
+	}
+}
+
+// delete removes the message stored under parts and prunes the nodes which no
+// longer have messages. It returns true if the node itself became empty.
+func (n *retainStoreNode) delete(parts []string) bool {
+	if len(parts) == 0 {
+		n.message = nil
+	} else if subnode, exists := n.subnodes[parts[0]]; exists {
+		if subnode.delete(parts[1:]) {
+			delete(n.subnodes, parts[0])
+		}
+	}
+	return n.message == nil && len(n.subnodes) == 0
+}
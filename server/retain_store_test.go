@@ -0,0 +1,66 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetainStore(t *testing.T) {
+	t.Run("empty retain store", func(t *testing.T) {
+		store := NewRetainStore()
+		assert.Equal(t, []*packets.Publish{}, store.Get("foo"))
+		assert.Equal(t, []*packets.Publish{}, store.Get("#"))
+		assert.Equal(t, []*packets.Publish{}, store.Get("foo/+"))
+	})
+
+	t.Run("exact and wildcard filters", func(t *testing.T) {
+		store := NewRetainStore()
+		ab := &packets.Publish{Retain: true, TopicName: "a/b", Payload: []byte("ab")}
+		abc := &packets.Publish{Retain: true, TopicName: "a/b/c", Payload: []byte("abc")}
+		ac := &packets.Publish{Retain: true, TopicName: "a/c", Payload: []byte("ac")}
+		a := &packets.Publish{Retain: true, TopicName: "a", Payload: []byte("a")}
+		sys := &packets.Publish{Retain: true, TopicName: "$SYS/uptime", Payload: []byte("1")}
+		for _, publish := range []*packets.Publish{ab, abc, ac, a, sys} {
+			store.Set(publish)
+		}
+
+		assert.ElementsMatch(t, []*packets.Publish{ab}, store.Get("a/b"))
+		assert.ElementsMatch(t, []*packets.Publish{ab, ac}, store.Get("a/+"))
+		assert.ElementsMatch(t, []*packets.Publish{abc}, store.Get("+/+/c"))
+		assert.ElementsMatch(t, []*packets.Publish{a, ab, abc, ac}, store.Get("a/#"))
+		assert.ElementsMatch(t, []*packets.Publish{a, ab, abc, ac}, store.Get("#"))
+		assert.ElementsMatch(t, []*packets.Publish{}, store.Get("b/#"))
+
+		// Wildcards at the first level do not match topics beginning with "$"
+		assert.ElementsMatch(t, []*packets.Publish{}, store.Get("+/uptime"))
+		assert.ElementsMatch(t, []*packets.Publish{sys}, store.Get("$SYS/#"))
+	})
+
+	t.Run("replaces and deletes retained messages", func(t *testing.T) {
+		store := NewRetainStore()
+		store.Set(&packets.Publish{Retain: true, TopicName: "a/b", Payload: []byte("old")})
+		latest := &packets.Publish{Retain: true, TopicName: "a/b", Payload: []byte("new")}
+		store.Set(latest)
+		assert.Equal(t, []*packets.Publish{latest}, store.Get("a/b"))
+
+		// An empty payload deletes the retained message and prunes its nodes
+		store.Set(&packets.Publish{Retain: true, TopicName: "a/b"})
+		assert.Equal(t, []*packets.Publish{}, store.Get("#"))
+		assert.Empty(t, store.root.subnodes)
+	})
+
+	t.Run("counts down the Message Expiry Interval", func(t *testing.T) {
+		store := NewRetainStore()
+		store.Set(&packets.Publish{Retain: true, TopicName: "a/b", Payload: []byte("ab"), Properties: packets.Properties{MessageExpiryInterval: packets.Uint32(60)}})
+		store.Set(&packets.Publish{Retain: true, TopicName: "a/c", Payload: []byte("ac"), Properties: packets.Properties{MessageExpiryInterval: packets.Uint32(60)}})
+		store.root.subnodes["a"].subnodes["b"].expiresAt = time.Now().Add(30 * time.Second)
+		store.root.subnodes["a"].subnodes["c"].expiresAt = time.Now().Add(-time.Second)
+
+		assert.Equal(t, []*packets.Publish{
+			{Retain: true, TopicName: "a/b", Payload: []byte("ab"), Properties: packets.Properties{MessageExpiryInterval: packets.Uint32(30)}},
+		}, store.Get("a/#"))
+	})
+}
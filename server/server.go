@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown is
+// called.
+var ErrServerClosed = errors.New("server closed")
+
+// Server is an MQTT broker which can be embedded into other programs.
+type Server struct {
+	options Options
+	handler *Handler
+
+	mu           sync.Mutex
+	listeners    map[net.Listener]struct{}
+	shuttingDown bool
+	// wg counts the goroutines handling connections
+	wg sync.WaitGroup
+}
+
+// New returns a Server configured by the options. It returns an error if the
+// options are invalid.
+func New(options Options) (*Server, error) {
+	options = options.withDefaults()
+	handler, err := NewHandlerWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		options:   options,
+		handler:   handler,
+		listeners: make(map[net.Listener]struct{}),
+	}, nil
+}
+
+// ListenAndServe listens on the TCP address Options.Addr and serves MQTT
+// clients on it. It always returns a non-nil error, ErrServerClosed after
+// Shutdown.
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.options.Addr)
+	if err != nil {
+		return err
+	}
+	s.handler.logger.infof("Listening on %s\n", listener.Addr())
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on the listener and serves MQTT clients on them.
+// Serve can be called with several listeners to serve on all of them. The
+// listener is closed when Serve returns. It always returns a non-nil error,
+// ErrServerClosed after Shutdown.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.addListener(listener) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer s.removeListener(listener)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.handler.logger.errorf("Error accepting connection: %v\n", err)
+			continue
+		}
+
+		if !s.startConn() {
+			// Shutdown has started waiting for the connections
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.handler.logger.debugf("New connection accepted\n")
+		go s.handleConn(conn)
+	}
+}
+
+// startConn counts a connection to be waited for by Shutdown. It returns false
+// if the server is shutting down. The check and the count are done together
+// so that a connection is never added while Shutdown is waiting.
+func (s *Server) startConn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shuttingDown {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	s.handler.Handle(conn)
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting new
+// connections, sends DISCONNECT with "Server shutting down" to MQTT 5.0
+// clients, closes all the connections and waits for them to be torn down.
+// If the context expires first, Shutdown returns the context's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	for listener := range s.listeners {
+		if err := listener.Close(); err != nil {
+			s.handler.logger.errorf("Error closing listener: %v\n", err)
+		}
+	}
+	s.mu.Unlock()
+
+	s.handler.closeConnections()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns the counters of the server.
+func (s *Server) Stats() Stats {
+	return s.handler.Stats()
+}
+
+func (s *Server) addListener(listener net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shuttingDown {
+		return false
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+func (s *Server) removeListener(listener net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	listener.Close()
+	delete(s.listeners, listener)
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.shuttingDown
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerShutdown(t *testing.T) {
+	s, err := New(Options{})
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(listener) }()
+
+	dial := func(clientID string, version byte) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+
+		connect := &packets.Connect{ProtocolName: "MQTT", ProtocolLevel: version, CleanSession: true, ClientID: clientID}
+		assert.NoError(t, connect.Encode(conn, version))
+		packet, err := packets.ReadPacket(reader, version)
+		assert.NoError(t, err)
+		assert.IsType(t, &packets.Connack{}, packet)
+		return conn, reader
+	}
+	conn5, reader5 := dial("client5", packets.Version5)
+	defer conn5.Close()
+	conn4, reader4 := dial("client4", packets.Version311)
+	defer conn4.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+	assert.ErrorIs(t, <-served, ErrServerClosed)
+
+	// MQTT 5.0 clients are told why they are disconnected
+	packet, err := packets.ReadPacket(reader5, packets.Version5)
+	assert.NoError(t, err)
+	assert.Equal(t, &packets.Disconnect{ReasonCode: packets.ReasonServerShuttingDown}, packet)
+	_, err = reader5.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Older clients are just disconnected
+	_, err = reader4.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// The server does not accept connections any more
+	_, err = net.Dial("tcp", listener.Addr().String())
+	assert.Error(t, err)
+	assert.ErrorIs(t, s.Serve(listener), ErrServerClosed)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+)
+
+// SharedSubscriptionStrategy decides which member of a shared subscription
+// group receives a message.
+type SharedSubscriptionStrategy string
+
+const (
+	// SharedSubscriptionRoundRobin delivers the messages to the members in
+	// turn.
+	SharedSubscriptionRoundRobin SharedSubscriptionStrategy = "round-robin"
+	// SharedSubscriptionRandom delivers each message to a random member.
+	SharedSubscriptionRandom SharedSubscriptionStrategy = "random"
+	// SharedSubscriptionLeastInflight delivers each message to the member with
+	// the fewest unacknowledged or queued messages. The members with the same
+	// number receive the messages in turn.
+	SharedSubscriptionLeastInflight SharedSubscriptionStrategy = "least-inflight"
+	// SharedSubscriptionSticky delivers the messages of the same publisher to
+	// the same member as long as the members do not change.
+	SharedSubscriptionSticky SharedSubscriptionStrategy = "sticky"
+)
+
+// Valid reports whether the strategy is one of the known strategies.
+func (s SharedSubscriptionStrategy) Valid() bool {
+	switch s {
+	case SharedSubscriptionRoundRobin, SharedSubscriptionRandom, SharedSubscriptionLeastInflight, SharedSubscriptionSticky:
+		return true
+	}
+	return false
+}
+
+// sharedBalancer picks the member of a shared subscription group which
+// receives a message.
+type sharedBalancer struct {
+	strategy SharedSubscriptionStrategy
+	mu       sync.Mutex
+	// next is the counter of the round-robin strategy for each group
+	next map[string]uint64
+}
+
+func newSharedBalancer(strategy SharedSubscriptionStrategy) (*sharedBalancer, error) {
+	if !strategy.Valid() {
+		return nil, fmt.Errorf("unknown shared subscription strategy %q", strategy)
+	}
+	return &sharedBalancer{
+		strategy: strategy,
+		next:     make(map[string]uint64),
+	}, nil
+}
+
+// pick returns one of the members of the group identified by filter. members
+// must not be empty and must be in a stable order. from is the publisher of the
+// message, or nil for the Will Message.
+func (b *sharedBalancer) pick(filter string, members []Subscriber, from *Client) Subscriber {
+	switch b.strategy {
+	case SharedSubscriptionRandom:
+		return members[rand.Intn(len(members))]
+	case SharedSubscriptionLeastInflight:
+		least := make([]Subscriber, 0, len(members))
+		fewest := 0
+		for _, member := range members {
+			count := member.Client.PendingCount()
+			if len(least) > 0 && count > fewest {
+				continue
+			}
+			if len(least) == 0 || count < fewest {
+				least, fewest = least[:0], count
+			}
+			least = append(least, member)
+		}
+		return b.roundRobin(filter, least)
+	case SharedSubscriptionSticky:
+		key := filter
+		if from != nil {
+			key = string(from.ID)
+		}
+		hash := fnv.New32a()
+		hash.Write([]byte(key))
+		return members[hash.Sum32()%uint32(len(members))]
+	default:
+		return b.roundRobin(filter, members)
+	}
+}
+
+func (b *sharedBalancer) roundRobin(filter string, members []Subscriber) Subscriber {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.next[filter]
+	b.next[filter] = n + 1
+	return members[n%uint64(len(members))]
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/shibayu36/go-mqtt-playground/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedBalancer(t *testing.T) {
+	client1 := &Client{ID: "client1"}
+	client2 := &Client{ID: "client2"}
+	client3 := &Client{ID: "client3"}
+	members := []Subscriber{{Client: client1}, {Client: client2}, {Client: client3}}
+
+	t.Run("round-robin picks the members in turn for each group", func(t *testing.T) {
+		balancer, err := newSharedBalancer(SharedSubscriptionRoundRobin)
+		assert.NoError(t, err)
+
+		assert.Equal(t, client1, balancer.pick("$share/g1/a", members, nil).Client)
+		assert.Equal(t, client2, balancer.pick("$share/g1/a", members, nil).Client)
+		assert.Equal(t, client1, balancer.pick("$share/g2/a", members, nil).Client)
+		assert.Equal(t, client3, balancer.pick("$share/g1/a", members, nil).Client)
+		assert.Equal(t, client1, balancer.pick("$share/g1/a", members, nil).Client)
+	})
+
+	t.Run("least-inflight picks the member with the fewest pending messages", func(t *testing.T) {
+		balancer, err := newSharedBalancer(SharedSubscriptionLeastInflight)
+		assert.NoError(t, err)
+
+		client1.AddInflight(&packets.Publish{PacketID: 1, QoS: 1}, "$share/g1/a")
+		client2.Enqueue(&packets.Publish{QoS: 1}, "$share/g1/a", 0)
+		assert.Equal(t, client3, balancer.pick("$share/g1/a", members, nil).Client)
+
+		// The members with the fewest messages are picked in turn
+		client3.AddInflight(&packets.Publish{PacketID: 1, QoS: 1}, "$share/g1/a")
+		picked := make([]*Client, 0)
+		for i := 0; i < 4; i++ {
+			picked = append(picked, balancer.pick("$share/g1/a", members, nil).Client)
+		}
+		assert.Equal(t, []*Client{client2, client3, client1, client2}, picked)
+	})
+
+	t.Run("sticky picks the same member for the same publisher", func(t *testing.T) {
+		balancer, err := newSharedBalancer(SharedSubscriptionSticky)
+		assert.NoError(t, err)
+
+		publisher := &Client{ID: "publisher"}
+		picked := balancer.pick("$share/g1/a", members, publisher)
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, picked, balancer.pick("$share/g1/a", members, publisher))
+		}
+	})
+
+	t.Run("random picks one of the members", func(t *testing.T) {
+		balancer, err := newSharedBalancer(SharedSubscriptionRandom)
+		assert.NoError(t, err)
+
+		assert.Contains(t, members, balancer.pick("$share/g1/a", members, nil))
+	})
+
+	t.Run("rejects an unknown strategy", func(t *testing.T) {
+		_, err := newSharedBalancer("weighted")
+		assert.Error(t, err)
+	})
+}
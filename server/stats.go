@@ -0,0 +1,38 @@
+package server
+
+import "sync/atomic"
+
+// Stats is the counters of the Handler.
+type Stats struct {
+	// InboundPacketsTooLarge is the number of packets received from clients
+	// which were larger than the maximum packet size. The connections were
+	// closed.
+	InboundPacketsTooLarge uint64
+	// OutboundPacketsTooLarge is the number of messages which were not sent
+	// because they were larger than the Maximum Packet Size of the client.
+	OutboundPacketsTooLarge uint64
+	// OutboundMessagesDropped is the number of messages dropped because the
+	// outbound queue of the client was full.
+	OutboundMessagesDropped uint64
+	// SlowConsumerDisconnects is the number of connections closed because
+	// the outbound queue of the client was full.
+	SlowConsumerDisconnects uint64
+}
+
+// stats holds the counters updated concurrently by the connections.
+type stats struct {
+	inboundPacketsTooLarge  atomic.Uint64
+	outboundPacketsTooLarge atomic.Uint64
+	outboundMessagesDropped atomic.Uint64
+	slowConsumerDisconnects atomic.Uint64
+}
+
+// Stats returns a snapshot of the counters.
+func (h *Handler) Stats() Stats {
+	return Stats{
+		InboundPacketsTooLarge:  h.stats.inboundPacketsTooLarge.Load(),
+		OutboundPacketsTooLarge: h.stats.outboundPacketsTooLarge.Load(),
+		OutboundMessagesDropped: h.stats.outboundMessagesDropped.Load(),
+		SlowConsumerDisconnects: h.stats.slowConsumerDisconnects.Load(),
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxTopicLength is the maximum length in bytes of topic names and topic
+// filters, which is the maximum length of a UTF-8 Encoded String.
+const maxTopicLength = 65535
+
+var (
+	errTopicEmpty     = errors.New("topic is empty")
+	errTopicTooLong   = errors.New("topic is too long")
+	errTopicMalformed = errors.New("topic is not well-formed UTF-8 or contains U+0000")
+	errTopicWildcard  = errors.New("wildcard is not allowed here")
+	errTopicTooDeep   = errors.New("topic has too many levels")
+	errShareName      = errors.New("share name is invalid")
+)
+
+// validateTopicName checks the topic name of PUBLISH and the Will Topic, which
+// must not contain wildcards. maxDepth is the maximum number of levels, or 0
+// for no limit.
+func validateTopicName(name string, maxDepth int) error {
+	if err := validateTopic(name, maxDepth); err != nil {
+		return err
+	}
+	if strings.ContainsAny(name, "+#") {
+		return errTopicWildcard
+	}
+	return nil
+}
+
+// validateTopicFilter checks the topic filter of SUBSCRIBE. Wildcards must
+// occupy entire levels, with "#" only at the last level. The share name of a
+// shared subscription must be non-empty and have no wildcards. maxDepth is the
+// maximum number of levels of the filter without the "$share/{ShareName}"
+// prefix, or 0 for no limit.
+func validateTopicFilter(filter string, maxDepth int) error {
+	// The length and the encoding apply to the whole filter
+	if err := validateTopic(filter, 0); err != nil {
+		return err
+	}
+
+	shareName, filter, isShared := parseSharedFilter(filter)
+	if isShared && (shareName == "" || strings.ContainsAny(shareName, "+#")) {
+		return errShareName
+	}
+	if err := validateTopic(filter, maxDepth); err != nil {
+		return err
+	}
+
+	parts := strings.Split(filter, "/")
+	for i, part := range parts {
+		if strings.ContainsAny(part, "+#") && len(part) > 1 {
+			return errTopicWildcard
+		}
+		if part == "#" && i != len(parts)-1 {
+			return errTopicWildcard
+		}
+	}
+	return nil
+}
+
+// validateTopic checks the rules common to topic names and topic filters.
+func validateTopic(topic string, maxDepth int) error {
+	if topic == "" {
+		return errTopicEmpty
+	}
+	if len(topic) > maxTopicLength {
+		return errTopicTooLong
+	}
+	if !utf8.ValidString(topic) || strings.ContainsRune(topic, 0) {
+		return errTopicMalformed
+	}
+	if maxDepth > 0 && strings.Count(topic, "/")+1 > maxDepth {
+		return fmt.Errorf("%w: more than %d", errTopicTooDeep, maxDepth)
+	}
+	return nil
+}
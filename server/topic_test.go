@@ -0,0 +1,70 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTopicName(t *testing.T) {
+	for _, name := range []string{"a", "a/b", "/", "a//b", "$SYS/uptime", "日本/東京"} {
+		assert.NoError(t, validateTopicName(name, 0), name)
+	}
+
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{"", errTopicEmpty},
+		{"a/+/b", errTopicWildcard},
+		{"a/#", errTopicWildcard},
+		{"a+", errTopicWildcard},
+		{"a/\xff", errTopicMalformed},
+		{"a/\x00", errTopicMalformed},
+		{strings.Repeat("a", maxTopicLength+1), errTopicTooLong},
+	} {
+		assert.ErrorIs(t, validateTopicName(tc.name, 0), tc.err, tc.name)
+	}
+
+	t.Run("max depth", func(t *testing.T) {
+		assert.NoError(t, validateTopicName("a/b/c", 3))
+		assert.ErrorIs(t, validateTopicName("a/b/c/d", 3), errTopicTooDeep)
+		assert.ErrorIs(t, validateTopicName("a/b/c/", 3), errTopicTooDeep)
+	})
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	for _, filter := range []string{"a", "a/b", "/", "a//b", "+", "#", "a/+/b", "a/#", "+/+/#", "$SYS/#", "$share/g/a/#", "$share/g/+"} {
+		assert.NoError(t, validateTopicFilter(filter, 0), filter)
+	}
+
+	for _, tc := range []struct {
+		filter string
+		err    error
+	}{
+		{"", errTopicEmpty},
+		{"a#", errTopicWildcard},
+		{"a/#/b", errTopicWildcard},
+		{"#/a", errTopicWildcard},
+		{"a+", errTopicWildcard},
+		{"a/b+/c", errTopicWildcard},
+		{"a/++", errTopicWildcard},
+		{"a/\xff", errTopicMalformed},
+		{"a/\x00/#", errTopicMalformed},
+		{strings.Repeat("a", maxTopicLength+1), errTopicTooLong},
+		{"$share/g", errTopicEmpty},
+		{"$share//a", errShareName},
+		{"$share/g+/a", errShareName},
+		{"$share/g/a#", errTopicWildcard},
+	} {
+		assert.ErrorIs(t, validateTopicFilter(tc.filter, 0), tc.err, tc.filter)
+	}
+
+	t.Run("max depth", func(t *testing.T) {
+		assert.NoError(t, validateTopicFilter("a/+/#", 3))
+		assert.ErrorIs(t, validateTopicFilter("a/+/b/#", 3), errTopicTooDeep)
+		// The prefix of a shared subscription is not counted
+		assert.NoError(t, validateTopicFilter("$share/g/a/+/#", 3))
+	})
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+type TopicTree struct {
+	root *topicTreeNode
+	mu   sync.RWMutex
+}
+
+func NewTopicTree() *TopicTree {
+	return &TopicTree{
+		root: newTopicTreeNode(""),
+	}
+}
+
+// Subscriber is a client subscribing to a topic filter with the granted QoS
+// and the MQTT 5.0 subscription options.
+type Subscriber struct {
+	Client            *Client
+	QoS               byte
+	NoLocal           bool
+	RetainAsPublished bool
+	// SubscriptionIdentifiers are the Subscription Identifiers of MQTT 5.0
+	// sent with the messages matching the subscription.
+	SubscriptionIdentifiers []int
+}
+
+// SharedGroup is a shared subscription group and its members. Each message
+// matching the topic filter is delivered to only one of the members.
+type SharedGroup struct {
+	// Filter is the whole shared subscription "$share/{ShareName}/{filter}",
+	// which identifies the group.
+	Filter string
+	// Members are sorted by ClientID.
+	Members []Subscriber
+}
+
+// Add subscribes the client to the topic filter, which may be a shared
+// subscription. If the client already subscribes to the filter, the
+// subscription is replaced. It returns true if the subscription is new.
+func (t *TopicTree) Add(topic string, subscriber Subscriber) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	shareName, topic, isShared := parseSharedFilter(topic)
+	parts := strings.Split(topic, "/")
+
+	current := t.root
+	for _, part := range parts {
+		if _, exists := current.subnodes[part]; !exists {
+			current.subnodes[part] = newTopicTreeNode(part)
+		}
+		current = current.subnodes[part]
+	}
+
+	clients := current.clients
+	if isShared {
+		if _, exists := current.shared[shareName]; !exists {
+			current.shared[shareName] = make(map[*Client]Subscriber)
+		}
+		clients = current.shared[shareName]
+	}
+	_, exists := clients[subscriber.Client]
+	clients[subscriber.Client] = subscriber
+	return !exists
+}
+
+// Remove unsubscribes the client from the topic filter and prunes the nodes
+// which no longer have subscriptions. It returns false if the client does not
+// subscribe to the filter.
+func (t *TopicTree) Remove(topic string, client *Client) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	shareName, topic, isShared := parseSharedFilter(topic)
+	parts := strings.Split(topic, "/")
+
+	removed := false
+	var remove func(*topicTreeNode, []string)
+	remove = func(node *topicTreeNode, parts []string) {
+		if len(parts) == 0 {
+			clients := node.clients
+			if isShared {
+				clients = node.shared[shareName]
+			}
+			if _, exists := clients[client]; exists {
+				delete(clients, client)
+				removed = true
+			}
+			if isShared && len(clients) == 0 {
+				delete(node.shared, shareName)
+			}
+			return
+		}
+
+		part := parts[0]
+		if nextNode, exists := node.subnodes[part]; exists {
+			remove(nextNode, parts[1:])
+			if nextNode.isEmpty() {
+				delete(node.subnodes, part)
+			}
+		}
+	}
+	remove(t.root, parts)
+
+	return removed
+}
+
+// RemoveClient removes all subscriptions of the client and prunes the nodes
+// which no longer have subscriptions.
+func (t *TopicTree) RemoveClient(client *Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var remove func(*topicTreeNode)
+	remove = func(node *topicTreeNode) {
+		delete(node.clients, client)
+		for shareName, members := range node.shared {
+			delete(members, client)
+			if len(members) == 0 {
+				delete(node.shared, shareName)
+			}
+		}
+		for part, subnode := range node.subnodes {
+			remove(subnode)
+			if subnode.isEmpty() {
+				delete(node.subnodes, part)
+			}
+		}
+	}
+	remove(t.root)
+}
+
+// Get returns the subscribers whose topic filters match the topic name. A
+// client subscribing with several overlapping filters is returned once, with
+// the highest granted QoS and the Subscription Identifiers of all of them.
+func (t *TopicTree) Get(topic string) []Subscriber {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	matchingClients := make([]Subscriber, 0)
+	indexes := make(map[*Client]int)
+
+	t.match(topic, func(node *topicTreeNode, filter []string) {
+		for client, subscriber := range node.clients {
+			i, exists := indexes[client]
+			if !exists {
+				indexes[client] = len(matchingClients)
+				matchingClients = append(matchingClients, subscriber)
+				continue
+			}
+			matchingClients[i] = mergeSubscribers(matchingClients[i], subscriber)
+		}
+	})
+
+	return matchingClients
+}
+
+// mergeSubscribers combines two subscriptions of the same client into one. The
+// message is delivered at the higher QoS. It is skipped as a message of the
+// client itself only if both subscriptions are No Local, and the RETAIN flag is
+// kept if either is Retain As Published.
+func mergeSubscribers(a, b Subscriber) Subscriber {
+	merged := a
+	if b.QoS > merged.QoS {
+		merged.QoS = b.QoS
+	}
+	merged.NoLocal = a.NoLocal && b.NoLocal
+	merged.RetainAsPublished = a.RetainAsPublished || b.RetainAsPublished
+	if len(b.SubscriptionIdentifiers) > 0 {
+		// Copy not to modify the slice stored in the tree
+		ids := make([]int, 0, len(a.SubscriptionIdentifiers)+len(b.SubscriptionIdentifiers))
+		ids = append(ids, a.SubscriptionIdentifiers...)
+		merged.SubscriptionIdentifiers = append(ids, b.SubscriptionIdentifiers...)
+	}
+	return merged
+}
+
+// GetShared returns the shared subscription groups whose topic filters match
+// the topic name.
+func (t *TopicTree) GetShared(topic string) []SharedGroup {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	groups := make([]SharedGroup, 0)
+
+	t.match(topic, func(node *topicTreeNode, filter []string) {
+		for shareName, members := range node.shared {
+			groups = append(groups, SharedGroup{
+				Filter:  sharedSubscriptionPrefix + shareName + "/" + strings.Join(filter, "/"),
+				Members: sortedSubscribers(members),
+			})
+		}
+	})
+
+	return groups
+}
+
+// match calls visit with every node whose topic filter matches the topic name,
+// and the levels of the filter. The caller must hold the lock.
+//
+//   - "+" matches exactly one level, which may be empty.
+//   - "#" matches the parent level and any number of child levels, so "a/#"
+//     matches "a", "a/b" and "a/b/c".
+//   - Wildcards at the first level do not match topic names starting with "$",
+//     so "#" does not match "$SYS/uptime".
+func (t *TopicTree) match(topic string, visit func(node *topicTreeNode, filter []string)) {
+	var traverse func(node *topicTreeNode, parts []string, filter []string)
+	traverse = func(node *topicTreeNode, parts []string, filter []string) {
+		if len(parts) == 0 {
+			visit(node, filter)
+			if multi, exists := node.subnodes["#"]; exists {
+				visit(multi, append(filter, "#"))
+			}
+			return
+		}
+
+		part := parts[0]
+		if nextNode, exists := node.subnodes[part]; exists {
+			traverse(nextNode, parts[1:], append(filter, part))
+		}
+		if node == t.root && strings.HasPrefix(part, "$") {
+			return
+		}
+		if nextNode, exists := node.subnodes["+"]; exists {
+			traverse(nextNode, parts[1:], append(filter, "+"))
+		}
+		if multi, exists := node.subnodes["#"]; exists {
+			visit(multi, append(filter, "#"))
+		}
+	}
+	traverse(t.root, strings.Split(topic, "/"), nil)
+}
+
+// GetSharedGroup returns the members of the shared subscription group, or nil
+// if the group does not exist.
+func (t *TopicTree) GetSharedGroup(filter string) []Subscriber {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	shareName, topic, isShared := parseSharedFilter(filter)
+	if !isShared {
+		return nil
+	}
+
+	current := t.root
+	for _, part := range strings.Split(topic, "/") {
+		next, exists := current.subnodes[part]
+		if !exists {
+			return nil
+		}
+		current = next
+	}
+	if members, exists := current.shared[shareName]; exists {
+		return sortedSubscribers(members)
+	}
+	return nil
+}
+
+func sortedSubscribers(clients map[*Client]Subscriber) []Subscriber {
+	subscribers := make([]Subscriber, 0, len(clients))
+	for _, subscriber := range clients {
+		subscribers = append(subscribers, subscriber)
+	}
+	sort.Slice(subscribers, func(i, j int) bool {
+		return subscribers[i].Client.ID < subscribers[j].Client.ID
+	})
+	return subscribers
+}
+
+// sharedSubscriptionPrefix is the prefix of shared subscriptions.
+const sharedSubscriptionPrefix = "$share/"
+
+// parseSharedFilter splits a shared subscription "$share/{ShareName}/{filter}"
+// into the share name and the topic filter. isShared is false if the filter
+// is not a shared subscription, in which case it is returned as is.
+func parseSharedFilter(filter string) (shareName string, topicFilter string, isShared bool) {
+	if !strings.HasPrefix(filter, sharedSubscriptionPrefix) {
+		return "", filter, false
+	}
+	rest := strings.TrimPrefix(filter, sharedSubscriptionPrefix)
+	shareName, topicFilter, _ = strings.Cut(rest, "/")
+	return shareName, topicFilter, true
+}
+
+type topicTreeNode struct {
+	part    string
+	clients map[*Client]Subscriber
+	// shared holds the members of the shared subscriptions by share name
+	shared   map[string]map[*Client]Subscriber
+	subnodes map[string]*topicTreeNode
+}
+
+func newTopicTreeNode(part string) *topicTreeNode {
+	return &topicTreeNode{
+		part:     part,
+		clients:  make(map[*Client]Subscriber),
+		shared:   make(map[string]map[*Client]Subscriber),
+		subnodes: make(map[string]*topicTreeNode),
+	}
+}
+
+// isEmpty reports whether the node has neither subscriptions nor subnodes, so
+// it can be pruned from the tree.
+func (n *topicTreeNode) isEmpty() bool {
+	return len(n.clients) == 0 && len(n.shared) == 0 && len(n.subnodes) == 0
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicTreeSubscribeAndClientsToPublish(t *testing.T) {
+	t.Run("empty topic tree", func(t *testing.T) {
+		tree := NewTopicTree()
+		assert.Equal(t, tree.Get(("foo")), []Subscriber{})
+		assert.Equal(t, tree.Get(("foo/bar")), []Subscriber{})
+		assert.Equal(t, tree.Get(("foo/bar/#")), []Subscriber{})
+		assert.Equal(t, tree.Get(("#")), []Subscriber{})
+		assert.Equal(t, tree.Get(("foo/+/baz")), []Subscriber{})
+	})
+
+	t.Run("simple topic tree", func(t *testing.T) {
+		tree := NewTopicTree()
+		client1 := &Client{ID: "client1"}
+		client2 := &Client{ID: "client2"}
+		client3 := &Client{ID: "client3"}
+
+		tree.Add("foo/bar", Subscriber{Client: client1, QoS: 0})
+		tree.Add("foo/bar/baz", Subscriber{Client: client1, QoS: 0})
+
+		tree.Add("foo/bar", Subscriber{Client: client2, QoS: 0})
+		tree.Add("hoge", Subscriber{Client: client2, QoS: 0})
+
+		tree.Add("foo/bar", Subscriber{Client: client3, QoS: 0})
+		tree.Add("hoge", Subscriber{Client: client3, QoS: 0})
+		tree.Add("hoge/fuga", Subscriber{Client: client3, QoS: 0})
+
+		assert.ElementsMatch(t, tree.Get(("foo/bar")), []Subscriber{{Client: client1}, {Client: client2}, {Client: client3}})
+		assert.ElementsMatch(t, tree.Get(("foo/bar/baz")), []Subscriber{{Client: client1}})
+		assert.ElementsMatch(t, tree.Get(("hoge")), []Subscriber{{Client: client2}, {Client: client3}})
+		assert.ElementsMatch(t, tree.Get(("hoge/fuga")), []Subscriber{{Client: client3}})
+		assert.ElementsMatch(t, tree.Get(("notexists/1")), []Subscriber{})
+	})
+
+	t.Run("wildcard topic tree", func(t *testing.T) {
+		tree := NewTopicTree()
+		client1 := &Client{ID: "client1"}
+		client2 := &Client{ID: "client2"}
+		client3 := &Client{ID: "client3"}
+		client4 := &Client{ID: "client4"}
+
+		tree.Add("#", Subscriber{Client: client1, QoS: 0})
+		tree.Add("a/b/c", Subscriber{Client: client2, QoS: 0})
+		tree.Add("a/+/c", Subscriber{Client: client3, QoS: 0})
+		tree.Add("a/#", Subscriber{Client: client4, QoS: 0})
+
+		// "#" also matches the parent level
+		assert.ElementsMatch(t, tree.Get(("a")), []Subscriber{{Client: client1}, {Client: client4}})
+		assert.ElementsMatch(t, tree.Get(("a/b")), []Subscriber{{Client: client1}, {Client: client4}})
+		assert.ElementsMatch(t, tree.Get(("a/b/c")), []Subscriber{{Client: client1}, {Client: client2}, {Client: client3}, {Client: client4}})
+		assert.ElementsMatch(t, tree.Get(("a/b/c/d")), []Subscriber{{Client: client1}, {Client: client4}})
+
+		assert.ElementsMatch(t, tree.Get(("b")), []Subscriber{{Client: client1}})
+
+		// "+" matches an empty level
+		assert.ElementsMatch(t, tree.Get(("a//c")), []Subscriber{{Client: client1}, {Client: client3}, {Client: client4}})
+	})
+
+	t.Run("wildcards at the first level do not match topics beginning with $", func(t *testing.T) {
+		tree := NewTopicTree()
+		client1 := &Client{ID: "client1"}
+		client2 := &Client{ID: "client2"}
+		client3 := &Client{ID: "client3"}
+
+		tree.Add("#", Subscriber{Client: client1, QoS: 0})
+		tree.Add("+/uptime", Subscriber{Client: client2, QoS: 0})
+		tree.Add("$SYS/#", Subscriber{Client: client3, QoS: 0})
+
+		assert.ElementsMatch(t, tree.Get(("$SYS/uptime")), []Subscriber{{Client: client3}})
+		assert.ElementsMatch(t, tree.Get(("a/$SYS")), []Subscriber{{Client: client1}})
+	})
+
+	t.Run("overlapping subscriptions of a client", func(t *testing.T) {
+		tree := NewTopicTree()
+		client1 := &Client{ID: "client1"}
+		client2 := &Client{ID: "client2"}
+
+		tree.Add("a/b", Subscriber{Client: client1, QoS: 0, NoLocal: true, SubscriptionIdentifiers: []int{1}})
+		tree.Add("a/+", Subscriber{Client: client1, QoS: 2, SubscriptionIdentifiers: []int{2}})
+		tree.Add("#", Subscriber{Client: client1, QoS: 1, RetainAsPublished: true})
+		tree.Add("a/#", Subscriber{Client: client2, QoS: 1})
+		tree.Add("a/b", Subscriber{Client: client2, QoS: 0})
+
+		// Each client is returned once with the highest QoS and all the
+		// Subscription Identifiers
+		assert.ElementsMatch(t, tree.Get(("a/b")), []Subscriber{
+			{Client: client1, QoS: 2, RetainAsPublished: true, SubscriptionIdentifiers: []int{1, 2}},
+			{Client: client2, QoS: 1},
+		})
+		// The subscriptions in the tree are not modified
+		assert.ElementsMatch(t, tree.Get(("a/c")), []Subscriber{
+			{Client: client1, QoS: 2, RetainAsPublished: true, SubscriptionIdentifiers: []int{2}},
+			{Client: client2, QoS: 1},
+		})
+	})
+
+	t.Run("granted QoS", func(t *testing.T) {
+		tree := NewTopicTree()
+		client1 := &Client{ID: "client1"}
+		client2 := &Client{ID: "client2"}
+
+		assert.True(t, tree.Add("a/b", Subscriber{Client: client1, QoS: 1}))
+		assert.True(t, tree.Add("a/+", Subscriber{Client: client2, QoS: 0}))
+
+		assert.ElementsMatch(t, tree.Get(("a/b")), []Subscriber{{Client: client1, QoS: 1}, {Client: client2, QoS: 0}})
+
+		// Subscribing to the same filter again replaces the QoS
+		assert.False(t, tree.Add("a/b", Subscriber{Client: client1, QoS: 0}))
+		assert.ElementsMatch(t, tree.Get(("a/b")), []Subscriber{{Client: client1, QoS: 0}, {Client: client2, QoS: 0}})
+	})
+}
+
+func TestTopicTreeRemove(t *testing.T) {
+	t.Run("removes the subscription and prunes empty nodes", func(t *testing.T) {
+		tree := NewTopicTree()
+		client1 := &Client{ID: "client1"}
+		client2 := &Client{ID: "client2"}
+
+		tree.Add("a/b/c", Subscriber{Client: client1, QoS: 0})
+		tree.Add("a/b", Subscriber{Client: client2, QoS: 0})
+
+		assert.True(t, tree.Remove("a/b/c", client1))
+		assert.False(t, tree.Remove("a/b/c", client1), "Expected false for the removed subscription")
+		assert.False(t, tree.Remove("a/b", client1), "Expected false for a filter the client does not subscribe")
+
+		assert.ElementsMatch(t, tree.Get("a/b/c"), []Subscriber{})
+		assert.ElementsMatch(t, tree.Get("a/b"), []Subscriber{{Client: client2}})
+		assert.NotContains(t, tree.root.subnodes["a"].subnodes["b"].subnodes, "c")
+
+		assert.True(t, tree.Remove("a/b", client2))
+		assert.Empty(t, tree.root.subnodes)
+	})
+
+	t.Run("removes all subscriptions of the client", func(t *testing.T) {
+		tree := NewTopicTree()
+		client1 := &Client{ID: "client1"}
+		client2 := &Client{ID: "client2"}
+
+		tree.Add("a/b", Subscriber{Client: client1, QoS: 0})
+		tree.Add("a/#", Subscriber{Client: client1, QoS: 1})
+		tree.Add("x/+/z", Subscriber{Client: client1, QoS: 2})
+		tree.Add("a/b", Subscriber{Client: client2, QoS: 0})
+
+		tree.RemoveClient(client1)
+
+		assert.ElementsMatch(t, tree.Get("a/b"), []Subscriber{{Client: client2}})
+		assert.ElementsMatch(t, tree.Get("x/y/z"), []Subscriber{})
+		assert.NotContains(t, tree.root.subnodes, "x")
+		assert.NotContains(t, tree.root.subnodes["a"].subnodes, "#")
+	})
+}
+
+func TestTopicTreeShared(t *testing.T) {
+	tree := NewTopicTree()
+	client1 := &Client{ID: "client1"}
+	client2 := &Client{ID: "client2"}
+	client3 := &Client{ID: "client3"}
+
+	assert.True(t, tree.Add("$share/g1/a/+", Subscriber{Client: client2, QoS: 1}))
+	assert.True(t, tree.Add("$share/g1/a/+", Subscriber{Client: client1, QoS: 0}))
+	assert.True(t, tree.Add("$share/g2/a/#", Subscriber{Client: client3, QoS: 2}))
+	assert.True(t, tree.Add("a/b", Subscriber{Client: client3, QoS: 0}))
+
+	// Shared subscriptions are not returned by Get
+	assert.Equal(t, []Subscriber{{Client: client3, QoS: 0}}, tree.Get("a/b"))
+
+	// The members are sorted by Client Identifier
+	assert.ElementsMatch(t, []SharedGroup{
+		{Filter: "$share/g1/a/+", Members: []Subscriber{{Client: client1, QoS: 0}, {Client: client2, QoS: 1}}},
+		{Filter: "$share/g2/a/#", Members: []Subscriber{{Client: client3, QoS: 2}}},
+	}, tree.GetShared("a/b"))
+	assert.Equal(t, []Subscriber{{Client: client1, QoS: 0}, {Client: client2, QoS: 1}}, tree.GetSharedGroup("$share/g1/a/+"))
+	assert.Nil(t, tree.GetSharedGroup("$share/g3/a/+"))
+
+	assert.True(t, tree.Remove("$share/g1/a/+", client1))
+	assert.False(t, tree.Remove("a/+", client2), "Expected the shared subscription not to be removed by the plain filter")
+	tree.RemoveClient(client2)
+	tree.RemoveClient(client3)
+	assert.Empty(t, tree.GetShared("a/b"))
+	assert.Empty(t, tree.root.subnodes)
+}
+
+func TestTopicTreeConcurrency(t *testing.T) {
+	tree := NewTopicTree()
+
+	var wg sync.WaitGroup
+	const numGoroutines = 100
+
+	// 同時にクライアントを追加するgoroutineを起動
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			client := &Client{ID: ClientID(fmt.Sprint(id))}
+			tree.Add("topic", Subscriber{Client: client, QoS: 0})
+		}(i)
+	}
+
+	// 同時にトピックを取得するgoroutineを起動
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tree.Get("topic")
+		}()
+	}
+
+	// すべてのgoroutineが終了するのを待つ
+	wg.Wait()
+
+	// 最終的な結果を確認
+	clients := tree.Get("topic")
+	if len(clients) != numGoroutines {
+		t.Errorf("Expected %d clients, but got %d", numGoroutines, len(clients))
+	}
+}